@@ -0,0 +1,460 @@
+//
+// alerts.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/damicon/zfswatcher/notifier"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Active alerts. An alert is open as long as a problem is visible in the
+// current state: a pool or a device in a bad state or a pool running out
+// of space, as defined by the severity maps and "level" of the "alerts"
+// section. Alerts can be acknowledged and they are resolved automatically
+// when the problem goes away. Unacknowledged alerts are escalated to other
+// outputs according to the "escalation" sections. The active alerts are
+// saved in "statedir" so that a restart does not reset the timers.
+
+// How many resolved alerts are kept for the web interface.
+const alert_HISTORY = 50
+
+const alert_FILE = "alerts.json"
+
+type alert struct {
+	Key          string            `json:"key"`
+	Pool         string            `json:"pool,omitempty"`
+	Device       string            `json:"device,omitempty"`
+	Text         string            `json:"text"`
+	Severity     notifier.Severity `json:"severity"`
+	Started      time.Time         `json:"started"`
+	Resolved     time.Time         `json:"-"`
+	AckedBy      string            `json:"ackedby,omitempty"`
+	AckedTime    time.Time         `json:"ackedtime"`
+	LastNotified time.Time         `json:"lastnotified"`
+	Escalated    map[string]int    `json:"escalated,omitempty"` // steps taken by escalation name
+}
+
+var alertState struct {
+	active   map[string]*alert
+	resolved []*alert          // the latest first
+	restored map[string]*alert // saved before a restart, until the first update
+	mutex    sync.RWMutex
+}
+
+// Returns the alert conditions in the current state by alert key.
+func currentAlertConditions() map[string]*alert {
+	currentState.mutex.RLock()
+	defer currentState.mutex.RUnlock()
+
+	conds := make(map[string]*alert)
+	for _, pool := range currentState.state {
+		if s := cfg.Severity.Poolstatemap.getSeverity(pool.state); s <= cfg.Alerts.Level {
+			conds["pool/"+pool.name] = &alert{
+				Pool:     pool.name,
+				Text:     fmt.Sprintf(`pool "%s" state is %s`, pool.name, pool.state),
+				Severity: s,
+			}
+		}
+		for n, dev := range pool.devs {
+			if n == 0 || dev.state == "" {
+				continue // the pool itself or a group such as "logs"
+			}
+			if s := cfg.Severity.Devstatemap.getSeverity(dev.state); s <= cfg.Alerts.Level {
+				conds["dev/"+pool.name+"/"+dev.name] = &alert{
+					Pool:     pool.name,
+					Device:   dev.name,
+					Text:     fmt.Sprintf(`pool "%s" device "%s" state is %s`, pool.name, dev.name, dev.state),
+					Severity: s,
+				}
+			}
+		}
+		u, ok := currentState.usage[pool.name]
+		if !ok || u.Avail+u.Used == 0 {
+			continue
+		}
+		used := u.GetUsedPercent()
+		if s, ok := cfg.Severity.Usedspace.GetByPercentage(used); ok && s <= cfg.Alerts.Level {
+			conds["usage/"+pool.name] = &alert{
+				Pool:     pool.name,
+				Text:     fmt.Sprintf(`pool "%s" usage is %d%%`, pool.name, used),
+				Severity: s,
+			}
+		}
+	}
+	return conds
+}
+
+// Open, update and resolve the alerts according to the current state. If
+// initial is true, a notification is sent about the alerts which are open
+// when the program starts (unless they were open already before a
+// restart), otherwise the notifications about the state changes are
+// enough.
+func updateAlerts(now time.Time, initial bool) {
+	if !cfg.Alerts.Enable {
+		return
+	}
+	conds := currentAlertConditions()
+	renotify := time.Duration(cfg.Alerts.Renotify) * time.Second
+
+	alertState.mutex.Lock()
+	defer alertState.mutex.Unlock()
+
+	if alertState.active == nil {
+		alertState.active = make(map[string]*alert)
+	}
+	// the alerts which were resolved while the program was not running:
+	for key, r := range alertState.restored {
+		if _, ok := conds[key]; !ok {
+			alertState.active[key] = r
+		}
+	}
+	changed := false
+	for key, c := range conds {
+		a, ok := alertState.active[key]
+		if !ok {
+			c.Key = key
+			c.Started = now
+			c.LastNotified = now
+			if r, ok := alertState.restored[key]; ok {
+				c.Started = r.Started
+				c.LastNotified = r.LastNotified
+				c.Escalated = r.Escalated
+				if c.Severity >= r.Severity {
+					c.AckedBy, c.AckedTime = r.AckedBy, r.AckedTime
+				}
+			} else if initial {
+				notifyEvent(c.Severity, "alertopen", c.Pool, c.Device,
+					"alert open at startup: %s", c.Text)
+			}
+			alertState.active[key] = c
+			sendAlertIncident(c, "alertopen", "firing", c.Text)
+			changed = true
+			continue
+		}
+		if c.Severity < a.Severity {
+			// worse than when it was acknowledged
+			a.AckedBy = ""
+			a.AckedTime = time.Time{}
+		}
+		if c.Severity != a.Severity || c.Text != a.Text {
+			changed = true
+		}
+		severityChanged := c.Severity != a.Severity
+		a.Severity = c.Severity
+		a.Text = c.Text
+		if severityChanged {
+			sendAlertIncident(a, "alertopen", "firing", a.Text)
+		}
+	}
+	alertState.restored = nil
+	for key, a := range alertState.active {
+		if _, ok := conds[key]; ok {
+			if renotify > 0 && a.AckedBy == "" && now.Sub(a.LastNotified) >= renotify {
+				a.LastNotified = now
+				changed = true
+				notifyEvent(a.Severity, "alertreminder", a.Pool, a.Device,
+					"alert open for %s and not acknowledged: %s",
+					myDurationString(now.Sub(a.Started)), a.Text)
+			}
+			if escalateAlert(a, now) {
+				changed = true
+			}
+			continue
+		}
+		delete(alertState.active, key)
+		a.Resolved = now
+		alertState.resolved = append([]*alert{a}, alertState.resolved...)
+		if len(alertState.resolved) > alert_HISTORY {
+			alertState.resolved = alertState.resolved[:alert_HISTORY]
+		}
+		changed = true
+		notifyEvent(cfg.Severity.Alertresolved, "alertresolved", a.Pool, a.Device,
+			"alert resolved after %s: %s", myDurationString(now.Sub(a.Started)), a.Text)
+		sendAlertIncident(a, "alertresolved", "resolved", "alert resolved: "+a.Text)
+	}
+	if changed {
+		saveAlerts()
+	}
+}
+
+// Send the escalation notifications of an unacknowledged alert which are
+// due. Each escalation whose "level" and "pool" match the alert is
+// followed step by step. Returns true if a step was taken.
+func escalateAlert(a *alert, now time.Time) bool {
+	if a.AckedBy != "" {
+		return false
+	}
+	var names []string
+	for name, e := range cfg.Escalation {
+		if e.Enable {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	taken := false
+	for _, name := range names {
+		e := cfg.Escalation[name]
+		if a.Severity > e.Level {
+			continue
+		}
+		if !e.Pool.matches(a.Pool) {
+			continue
+		}
+		for a.Escalated[name] < len(e.Steps) {
+			n := a.Escalated[name]
+			step := e.Steps[n]
+			if now.Sub(a.Started) < step.after {
+				break
+			}
+			if a.Escalated == nil {
+				a.Escalated = make(map[string]int)
+			}
+			a.Escalated[name] = n + 1
+			taken = true
+			f := alertFields(a, "alertescalated", "firing")
+			f["escalation"] = name
+			err := notify.PrintfFieldsTo(step.outputs, a.Severity, f,
+				`alert not acknowledged in %s (escalation "%s" step %d): %s`,
+				myDurationString(now.Sub(a.Started)), name, n+1, a.Text)
+			if err != nil {
+				notify.Printf(notifier.ERR, `escalation "%s" failed: %s`, name, err)
+			}
+		}
+	}
+	return taken
+}
+
+// The alert names for the incident outputs by the kind of the alert key.
+var alertNames = map[string]string{
+	"pool":  "ZfsPoolState",
+	"dev":   "ZfsDeviceState",
+	"usage": "ZfsPoolUsage",
+}
+
+// Returns the fields of a message about an alert. The incident outputs
+// act on the messages with "alertstatus" (see the notifier package).
+func alertFields(a *alert, event, status string) notifier.Fields {
+	f := notifier.Fields{
+		"event":         event,
+		"alert":         a.Key,
+		"alertname":     alertNames[strings.SplitN(a.Key, "/", 2)[0]],
+		"alertseverity": a.Severity.String(),
+		"alertstarted":  a.Started.Format(time.RFC3339),
+	}
+	if a.Pool != "" {
+		f["pool"] = a.Pool
+	}
+	if a.Device != "" {
+		f["device"] = a.Device
+	}
+	if status != "" {
+		f["alertstatus"] = status
+	}
+	return f
+}
+
+// Returns the names of the incident outputs which get the alert. All of
+// them get the changes of the alerts which may have been sent already.
+func incidentOutputs(s notifier.Severity, status string) []string {
+	var names []string
+	for prof, ic := range cfg.Incident {
+		if ic.Enable && (status != "firing" || s <= ic.Level) {
+			names = append(names, "incident:"+prof)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Send the state of an alert to the incident outputs. The other outputs
+// get the ordinary notifications.
+func sendAlertIncident(a *alert, event, status, text string) {
+	outputs := incidentOutputs(a.Severity, status)
+	if len(outputs) == 0 {
+		return
+	}
+	err := notify.SendFieldsTo(outputs, a.Severity, alertFields(a, event, status), text)
+	if err != nil {
+		notify.Printf(notifier.ERR, "error sending alert to incident outputs: %s", err)
+	}
+}
+
+// Send the firing alerts to the incident outputs again, for example after
+// the outputs have been reconfigured.
+func resendAlerts() {
+	alertState.mutex.RLock()
+	defer alertState.mutex.RUnlock()
+
+	for _, a := range alertState.active {
+		sendAlertIncident(a, "alertopen", "firing", a.Text)
+	}
+}
+
+// The silences which were active when checkSilencesEnded() was called.
+var activeSilences map[string]bool
+
+// Send the firing alerts to the incident outputs again when a silence has
+// ended or it has been removed: the alerts which opened during the silence
+// were not sent to them.
+func checkSilencesEnded() {
+	active := make(map[string]bool)
+	for _, s := range notify.Silences() {
+		if s.Active {
+			active[s.ID] = true
+		}
+	}
+	for id := range activeSilences {
+		if !active[id] {
+			resendAlerts()
+			break
+		}
+	}
+	activeSilences = active
+}
+
+func alertFilePath() string {
+	return filepath.Join(cfg.Main.Statedir, alert_FILE)
+}
+
+// Save the active alerts. Called with alertState.mutex held.
+func saveAlerts() {
+	var as []*alert
+	for _, a := range alertState.active {
+		as = append(as, a)
+	}
+	fn := alertFilePath()
+	b, err := json.MarshalIndent(as, "", "\t")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(fn), 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(fn+".tmp", append(b, '\n'), 0644)
+	}
+	if err == nil {
+		err = os.Rename(fn+".tmp", fn)
+	}
+	if err != nil {
+		notify.Printf(notifier.ERR, "error saving alerts: %s", err)
+	}
+}
+
+// Load the alerts saved before a restart. They are matched to the current
+// state on the first update.
+func loadAlerts() {
+	if !cfg.Alerts.Enable {
+		return
+	}
+	b, err := ioutil.ReadFile(alertFilePath())
+	if os.IsNotExist(err) {
+		return
+	}
+	var as []*alert
+	if err == nil {
+		err = json.Unmarshal(b, &as)
+	}
+	if err != nil {
+		notify.Printf(notifier.ERR, "error loading alerts: %s", err)
+		return
+	}
+	alertState.mutex.Lock()
+	defer alertState.mutex.Unlock()
+
+	alertState.restored = make(map[string]*alert)
+	for _, a := range as {
+		alertState.restored[a.Key] = a
+	}
+}
+
+// Acknowledge an alert or remove the acknowledgement. Returns false if
+// the alert is not open.
+func ackAlert(key, user string, ack bool) bool {
+	alertState.mutex.Lock()
+	defer alertState.mutex.Unlock()
+
+	a, ok := alertState.active[key]
+	if !ok {
+		return false
+	}
+	if ack {
+		a.AckedBy = user
+		a.AckedTime = time.Now()
+		notify.Printf(notifier.INFO, `alert acknowledged by "%s": %s`, user, a.Text)
+		sendAlertIncident(a, "alertacked", "acknowledged", a.Text)
+	} else {
+		a.AckedBy = ""
+		a.AckedTime = time.Time{}
+		notify.Printf(notifier.INFO, `alert acknowledgement removed by "%s": %s`, user, a.Text)
+	}
+	saveAlerts()
+	return true
+}
+
+type alertsBySeverity []alert
+
+func (as alertsBySeverity) Len() int      { return len(as) }
+func (as alertsBySeverity) Swap(i, j int) { as[i], as[j] = as[j], as[i] }
+func (as alertsBySeverity) Less(i, j int) bool {
+	if as[i].Severity != as[j].Severity {
+		return as[i].Severity < as[j].Severity
+	}
+	return as[i].Started.Before(as[j].Started)
+}
+
+// Returns copies of the active alerts, the worst first, and the resolved
+// alerts, the latest first.
+func getAlerts() (active, resolved []alert) {
+	alertState.mutex.RLock()
+	defer alertState.mutex.RUnlock()
+
+	for _, a := range alertState.active {
+		active = append(active, a.copy())
+	}
+	sort.Sort(alertsBySeverity(active))
+	for _, a := range alertState.resolved {
+		resolved = append(resolved, a.copy())
+	}
+	return active, resolved
+}
+
+// Returns a copy of the alert which does not share the escalation state,
+// it is modified when the alerts are updated. Called with alertState.mutex
+// held.
+func (a *alert) copy() alert {
+	c := *a
+	if a.Escalated != nil {
+		c.Escalated = make(map[string]int)
+		for name, n := range a.Escalated {
+			c.Escalated[name] = n
+		}
+	}
+	return c
+}
+
+// eof
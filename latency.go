@@ -0,0 +1,136 @@
+//
+// latency.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Device latency monitoring based on "zpool iostat -l" average latencies
+// and "zpool iostat -w" latency histograms.
+
+type devLatency struct {
+	avg       time.Duration // latest average disk latency
+	p99       time.Duration // latest 99th percentile disk latency
+	highSince time.Time     // when the latency went above the threshold
+	alerted   bool
+}
+
+var latencyState struct {
+	devs  map[statKey]*devLatency
+	mutex sync.Mutex
+}
+
+// Must be called when latencyState.mutex is locked!
+func getDevLatency(pool, dev string) *devLatency {
+	if latencyState.devs == nil {
+		latencyState.devs = make(map[statKey]*devLatency)
+	}
+	key := statKey{pool: pool, dev: dev}
+	dl, ok := latencyState.devs[key]
+	if !ok {
+		dl = &devLatency{avg: -1, p99: -1}
+		latencyState.devs[key] = dl
+	}
+	return dl
+}
+
+// Returns true if the device is a leaf device (disk) of the pool.
+func isLeafDev(pool, dev string) bool {
+	p := findPool(pool)
+	if p == nil {
+		return false
+	}
+	n := p.findDev(dev)
+	return n != -1 && n != 0 && len(p.devs[n].subDevs) == 0
+}
+
+// Must be called when latencyState.mutex is locked!
+func evalDevLatency(now time.Time, pool, dev string, dl *devLatency) {
+	avgLimit := time.Duration(cfg.Latency.Avgthreshold) * time.Millisecond
+	p99Limit := time.Duration(cfg.Latency.P99threshold) * time.Millisecond
+	duration := time.Duration(cfg.Latency.Duration) * time.Second
+
+	high := (avgLimit > 0 && dl.avg > avgLimit) || (p99Limit > 0 && dl.p99 > p99Limit)
+
+	switch {
+	case high && dl.highSince.IsZero():
+		dl.highSince = now
+	case high && !dl.alerted && now.Sub(dl.highSince) >= duration:
+		notifyEvent(cfg.Severity.Devlatencyhigh, "devlatencyhigh", pool, dev,
+			`pool "%s" device "%s" latency high for %s: average %s, 99th percentile %s`,
+			pool, dev, myDurationString(now.Sub(dl.highSince)),
+			latencyString(dl.avg), latencyString(dl.p99))
+		dl.alerted = true
+	case !high && dl.alerted:
+		notifyEvent(cfg.Severity.Devlatencynormal, "devlatencynormal", pool, dev,
+			`pool "%s" device "%s" latency back to normal: average %s, 99th percentile %s`,
+			pool, dev, latencyString(dl.avg), latencyString(dl.p99))
+		dl.alerted = false
+		dl.highSince = time.Time{}
+	case !high:
+		dl.highSince = time.Time{}
+	}
+}
+
+func latencyString(d time.Duration) string {
+	if d < 0 {
+		return "-"
+	}
+	return d.String()
+}
+
+// Check average latencies from "zpool iostat -l" output.
+func checkIostatLatency(now time.Time, table *ZpoolIostatTable) {
+	if !cfg.Latency.Enable {
+		return
+	}
+	latencyState.mutex.Lock()
+	defer latencyState.mutex.Unlock()
+
+	for pool, entry := range *table {
+		for dev, row := range entry {
+			if !isLeafDev(pool, dev) {
+				continue
+			}
+			dl := getDevLatency(pool, dev)
+			dl.avg = row.GetDiskWait()
+			evalDevLatency(now, pool, dev, dl)
+		}
+	}
+}
+
+// Check 99th percentile latencies from "zpool iostat -w" output.
+func checkIostatHistLatency(now time.Time, pool string, hist *ZpoolIostatHist) {
+	if !cfg.Latency.Enable || !isLeafDev(pool, hist.Dev) {
+		return
+	}
+	latencyState.mutex.Lock()
+	defer latencyState.mutex.Unlock()
+
+	dl := getDevLatency(pool, hist.Dev)
+	dl.p99 = hist.GetDiskWaitPercentile(99)
+	evalDevLatency(now, pool, hist.Dev, dl)
+}
+
+// eof
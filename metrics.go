@@ -0,0 +1,339 @@
+//
+// metrics.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metrics in the Prometheus text exposition format.
+
+const metrics_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+type metricFamily struct {
+	name    string
+	typ     string // "gauge" or "counter"
+	help    string
+	samples []string
+}
+
+// Collects samples grouped by metric name, as required by the format.
+type metricsWriter struct {
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+func newMetricsWriter() *metricsWriter {
+	return &metricsWriter{byName: make(map[string]*metricFamily)}
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Add a sample. The labels are given as name, value pairs.
+func (mw *metricsWriter) add(name, typ, help string, v float64, labels ...string) {
+	mf, ok := mw.byName[name]
+	if !ok {
+		mf = &metricFamily{name: name, typ: typ, help: help}
+		mw.families = append(mw.families, mf)
+		mw.byName[name] = mf
+	}
+	var b bytes.Buffer
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, `%s="%s"`, labels[i], metricsLabelEscaper.Replace(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+	mf.samples = append(mf.samples, b.String())
+}
+
+func (mw *metricsWriter) gauge(name, help string, v float64, labels ...string) {
+	mw.add(name, "gauge", help, v, labels...)
+}
+
+func (mw *metricsWriter) counter(name, help string, v float64, labels ...string) {
+	mw.add(name, "counter", help, v, labels...)
+}
+
+func (mw *metricsWriter) writeTo(w io.Writer) error {
+	for _, mf := range mw.families {
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s\n",
+			mf.name, mf.help, mf.name, mf.typ, strings.Join(mf.samples, "\n"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the keys of a map with string keys in sorted order.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var scanProgressRegexp = regexp.MustCompile(`([0-9.]+)% done`)
+
+// Returns the type of a running scan ("scrub" or "resilver") and its
+// progress between 0 and 1 from "zpool status" scan text. The type is
+// empty if no scan is running.
+func parseScanProgress(scan string) (string, float64) {
+	if !strings.Contains(scan, " in progress") {
+		return "", 0
+	}
+	typ := strings.Fields(scan)[0]
+	m := scanProgressRegexp.FindStringSubmatch(scan)
+	if m == nil {
+		return typ, 0
+	}
+	pct, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return typ, 0
+	}
+	return typ, pct / 100
+}
+
+func addPoolMetrics(mw *metricsWriter) {
+	currentState.mutex.RLock()
+	defer currentState.mutex.RUnlock()
+
+	for _, pool := range currentState.state {
+		mw.gauge("zfswatcher_pool_state", "Pool state.", 1,
+			"pool", pool.name, "state", pool.state)
+		mw.gauge("zfswatcher_pool_online", "Whether the pool is ONLINE.",
+			boolToFloat(pool.state == "ONLINE"), "pool", pool.name)
+		typ, progress := parseScanProgress(pool.scan)
+		for _, t := range []string{"scrub", "resilver"} {
+			mw.gauge("zfswatcher_pool_scan_active", "Whether a scrub or resilver is running.",
+				boolToFloat(typ == t), "pool", pool.name, "type", t)
+		}
+		if typ != "" {
+			mw.gauge("zfswatcher_pool_scan_progress_ratio", "Progress of the running scan.",
+				progress, "pool", pool.name, "type", typ)
+		}
+		for n, dev := range pool.devs {
+			if n == 0 || dev.state == "" {
+				continue // the pool itself or a group such as "logs"
+			}
+			mw.gauge("zfswatcher_device_state", "Device state.", 1,
+				"pool", pool.name, "device", dev.name, "state", dev.state)
+			for _, e := range []struct {
+				typ string
+				v   int64
+			}{{"read", dev.read}, {"write", dev.write}, {"checksum", dev.cksum}} {
+				mw.gauge("zfswatcher_device_errors", "Device error counters reported by zpool status.",
+					float64(e.v), "pool", pool.name, "device", dev.name, "type", e.typ)
+			}
+		}
+	}
+	for _, name := range sortedKeys(currentState.usage) {
+		u := currentState.usage[name]
+		for _, v := range []struct {
+			metric string
+			help   string
+			bytes  int64
+		}{
+			{"avail", "Available space.", u.Avail},
+			{"used", "Used space.", u.Used},
+			{"used_snapshots", "Space used by snapshots.", u.Usedsnap},
+			{"used_dataset", "Space used by the dataset itself.", u.Usedds},
+			{"used_refreservation", "Space used by a refreservation.", u.Usedrefreserv},
+			{"used_children", "Space used by children.", u.Usedchild},
+			{"referenced", "Referenced space.", u.Refer},
+		} {
+			mw.gauge("zfswatcher_pool_"+v.metric+"_bytes", v.help,
+				float64(v.bytes), "pool", name)
+		}
+	}
+}
+
+func addIostatMetrics(mw *metricsWriter) {
+	statistics.mutex.RLock()
+	defer statistics.mutex.RUnlock()
+
+	if statistics.lastIostat == nil {
+		return
+	}
+	mw.gauge("zfswatcher_iostat_timestamp_seconds", "Time of the latest iostat report.",
+		float64(statistics.lastIostatTime.Unix()))
+	for _, pool := range sortedKeys(*statistics.lastIostat) {
+		entry := (*statistics.lastIostat)[pool]
+		for _, dev := range sortedKeys(entry) {
+			row := entry[dev]
+			l := []string{"pool", pool, "device", dev}
+			if row.CapacityAlloc >= 0 {
+				mw.gauge("zfswatcher_iostat_alloc_bytes", "Allocated capacity.",
+					float64(row.CapacityAlloc), l...)
+				mw.gauge("zfswatcher_iostat_free_bytes", "Free capacity.",
+					float64(row.CapacityFree), l...)
+			}
+			mw.gauge("zfswatcher_iostat_operations_per_second", "I/O operations per second.",
+				float64(row.OperationsRead), append(l, "op", "read")...)
+			mw.gauge("zfswatcher_iostat_operations_per_second", "I/O operations per second.",
+				float64(row.OperationsWrite), append(l, "op", "write")...)
+			mw.gauge("zfswatcher_iostat_bandwidth_bytes_per_second", "I/O bandwidth.",
+				float64(row.BandwidthRead), append(l, "op", "read")...)
+			mw.gauge("zfswatcher_iostat_bandwidth_bytes_per_second", "I/O bandwidth.",
+				float64(row.BandwidthWrite), append(l, "op", "write")...)
+			for _, w := range []struct {
+				metric string
+				help   string
+				op     string
+				d      time.Duration
+			}{
+				{"total_wait", "Average total I/O latency.", "read", row.TotalWaitRead},
+				{"total_wait", "Average total I/O latency.", "write", row.TotalWaitWrite},
+				{"disk_wait", "Average disk I/O latency.", "read", row.DiskWaitRead},
+				{"disk_wait", "Average disk I/O latency.", "write", row.DiskWaitWrite},
+			} {
+				if w.d < 0 {
+					continue // not available
+				}
+				mw.gauge("zfswatcher_iostat_"+w.metric+"_seconds", w.help,
+					w.d.Seconds(), append(l, "op", w.op)...)
+			}
+		}
+	}
+}
+
+func addProcessMetrics(mw *metricsWriter) {
+	css := getCommandStats()
+	for _, name := range sortedKeys(css) {
+		cs := css[name]
+		mw.counter("zfswatcher_command_runs_total", "Times the command has been run.",
+			float64(cs.runs), "command", name)
+		mw.counter("zfswatcher_command_failures_total", "Times the command has failed.",
+			float64(cs.failures), "command", name)
+		mw.counter("zfswatcher_command_timeouts_total", "Times the command has timed out.",
+			float64(cs.timeouts), "command", name)
+		mw.counter("zfswatcher_command_skipped_total", "Times the command was skipped because of an earlier timeout.",
+			float64(cs.skipped), "command", name)
+		mw.gauge("zfswatcher_command_duration_seconds", "Duration of the latest run of the command.",
+			cs.lastDuration.Seconds(), "command", name)
+		if !cs.lastSuccess.IsZero() {
+			mw.gauge("zfswatcher_command_last_success_timestamp_seconds", "Time of the latest successful run.",
+				float64(cs.lastSuccess.Unix()), "command", name)
+		}
+	}
+	for _, hc := range getHungCommands() {
+		if !hc.finished {
+			mw.gauge("zfswatcher_command_hung_seconds", "How long a hung command has been running.",
+				time.Since(hc.started).Seconds(), "command", hc.name, "cmdline", hc.cmdstr)
+		}
+	}
+	for _, st := range getProcessStatuses() {
+		mw.gauge("zfswatcher_process_up", "Whether the background process is running.",
+			boolToFloat(st.State == psRUNNING), "process", st.Name)
+		mw.gauge("zfswatcher_process_failing", "Whether the background process has reached the crash limit and is not stable yet.",
+			boolToFloat(st.Failing), "process", st.Name)
+		mw.counter("zfswatcher_process_restarts_total", "Times the background process has been restarted.",
+			float64(st.Restarts), "process", st.Name)
+	}
+}
+
+func addNotifierMetrics(mw *metricsWriter) {
+	for n, st := range notify.Stats() {
+		name := st.Name
+		if name == "" {
+			name = strconv.Itoa(n)
+		}
+		l := []string{"output", name, "type", st.Type}
+		mw.counter("zfswatcher_notifier_messages_total", "Messages passed to the notification output.",
+			float64(st.Messages), l...)
+		mw.counter("zfswatcher_notifier_dropped_total", "Messages dropped because the notification output was busy.",
+			float64(st.Dropped), l...)
+		mw.counter("zfswatcher_notifier_errors_total", "Failed deliveries of the notification output.",
+			float64(st.Errors), l...)
+		mw.gauge("zfswatcher_notifier_healthy", "Whether the latest delivery attempt of the notification output succeeded.",
+			boolToFloat(st.Healthy()), l...)
+		if !st.LastSuccess.IsZero() {
+			mw.gauge("zfswatcher_notifier_last_success_timestamp_seconds", "Time of the latest successful delivery.",
+				float64(st.LastSuccess.Unix()), l...)
+		}
+		mw.counter("zfswatcher_notifier_deduplicated_total", "Repeated messages folded into digests.",
+			float64(st.Deduplicated), l...)
+		if st.Spool != "" {
+			mw.gauge("zfswatcher_notifier_queued", "Messages waiting in the spool of the notification output.",
+				float64(st.Queued), l...)
+		}
+	}
+}
+
+func addAlertMetrics(mw *metricsWriter) {
+	if !cfg.Alerts.Enable {
+		return
+	}
+	active, _ := getAlerts()
+	var acked, unacked int
+	for _, a := range active {
+		if a.AckedBy != "" {
+			acked++
+		} else {
+			unacked++
+		}
+	}
+	mw.gauge("zfswatcher_alerts_active", "Active alerts.",
+		float64(unacked), "acknowledged", "false")
+	mw.gauge("zfswatcher_alerts_active", "Active alerts.",
+		float64(acked), "acknowledged", "true")
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	mw := newMetricsWriter()
+	addPoolMetrics(mw)
+	addIostatMetrics(mw)
+	addProcessMetrics(mw)
+	addNotifierMetrics(mw)
+	addAlertMetrics(mw)
+
+	w.Header().Set("Content-Type", metrics_CONTENT_TYPE)
+	mw.writeTo(w)
+}
+
+// eof
@@ -0,0 +1,392 @@
+//
+// mqtt.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"github.com/damicon/zfswatcher/notifier"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The MQTT publisher keeps a connection to the broker and publishes the
+// state of the pools and devices as retained messages whenever it changes,
+// and the notifications as event messages. The connection is made once
+// at startup like the web server and it is not affected by reconfiguring.
+
+const (
+	mqtt_QUEUE_SIZE = 1000            // events buffered while disconnected
+	mqtt_RETRY_MIN  = 5 * time.Second // the first reconnect interval
+	mqtt_RETRY_MAX  = 5 * time.Minute // maximum reconnect interval
+)
+
+var mqttState = struct {
+	events  chan *notifier.Msg
+	update  chan bool
+	stop    chan bool
+	done    chan bool
+	started bool
+}{
+	events: make(chan *notifier.Msg, mqtt_QUEUE_SIZE),
+	update: make(chan bool, 1),
+	stop:   make(chan bool),
+	done:   make(chan bool),
+}
+
+// An event message.
+type mqttEvent struct {
+	Time     time.Time       `json:"time"`
+	Severity string          `json:"severity"`
+	Text     string          `json:"text"`
+	Fields   notifier.Fields `json:"fields,omitempty"`
+}
+
+// Home Assistant MQTT discovery configuration of a sensor.
+type mqttDiscovery struct {
+	Name              string              `json:"name"`
+	UniqueID          string              `json:"unique_id"`
+	StateTopic        string              `json:"state_topic"`
+	AvailabilityTopic string              `json:"availability_topic"`
+	Unit              string              `json:"unit_of_measurement,omitempty"`
+	StateClass        string              `json:"state_class,omitempty"`
+	Icon              string              `json:"icon,omitempty"`
+	Device            mqttDiscoveryDevice `json:"device"`
+}
+
+type mqttDiscoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	SWVersion    string   `json:"sw_version"`
+}
+
+// Make a name usable as a topic level.
+func mqttTopicLevel(name string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(name)
+}
+
+var mqttObjectIDRegexp = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// Make a name usable as a Home Assistant object ID.
+func mqttObjectID(name string) string {
+	return mqttObjectIDRegexp.ReplaceAllString(name, "_")
+}
+
+// Returns the retained topics and their values: the state of the pools and
+// devices and the discovery configurations if enabled.
+func mqttRetained(c *mqttConfig, prefix, host string) map[string]string {
+	topics := make(map[string]string)
+	node := "zfswatcher_" + mqttObjectID(host)
+	device := mqttDiscoveryDevice{
+		Identifiers:  []string{node},
+		Name:         "ZFS " + host,
+		Manufacturer: "Damicon Kraa Oy",
+		Model:        "zfswatcher",
+		SWVersion:    VERSION,
+	}
+	add := func(topic, object, name, icon, unit string, numeric bool, value string) {
+		if value == "" {
+			return // an empty retained message would delete the topic
+		}
+		topics[topic] = value
+		if !c.Discovery {
+			return
+		}
+		d := mqttDiscovery{
+			Name:              name,
+			UniqueID:          node + "_" + object,
+			StateTopic:        topic,
+			AvailabilityTopic: prefix + "/status",
+			Unit:              unit,
+			Icon:              icon,
+			Device:            device,
+		}
+		if numeric {
+			d.StateClass = "measurement"
+		}
+		b, _ := json.Marshal(&d)
+		topics[c.Discoveryprefix+"/sensor/"+node+"/"+object+"/config"] = string(b)
+	}
+
+	currentState.mutex.RLock()
+	defer currentState.mutex.RUnlock()
+
+	for _, pool := range currentState.state {
+		base := prefix + "/pool/" + mqttTopicLevel(pool.name)
+		obj := mqttObjectID(pool.name)
+		add(base+"/state", obj+"_state", pool.name+" state",
+			"mdi:database", "", false, pool.state)
+		add(base+"/errors", obj+"_errors", pool.name+" errors",
+			"mdi:alert-circle-outline", "", false, pool.errors)
+		if u, ok := currentState.usage[pool.name]; ok && u.Avail+u.Used > 0 {
+			add(base+"/usage", obj+"_usage", pool.name+" usage",
+				"mdi:chart-pie", "%", true, strconv.Itoa(u.GetUsedPercent()))
+		}
+		typ, progress := parseScanProgress(pool.scan)
+		if typ == "" {
+			typ = "none"
+		}
+		add(base+"/scan", obj+"_scan", pool.name+" scan",
+			"mdi:magnify", "", false, typ)
+		add(base+"/scanprogress", obj+"_scanprogress", pool.name+" scan progress",
+			"mdi:progress-clock", "%", true, strconv.FormatFloat(progress*100, 'f', 1, 64))
+		for n, dev := range pool.devs {
+			if n == 0 || dev.state == "" {
+				continue // the pool itself or a group such as "logs"
+			}
+			dbase := base + "/device/" + mqttTopicLevel(dev.name)
+			dobj := obj + "_" + mqttObjectID(dev.name)
+			dname := pool.name + " " + dev.name
+			add(dbase+"/state", dobj+"_state", dname+" state",
+				"mdi:harddisk", "", false, dev.state)
+			for _, e := range []struct {
+				field string
+				name  string
+				v     int64
+			}{{"read", "read errors", dev.read}, {"write", "write errors", dev.write}, {"cksum", "checksum errors", dev.cksum}} {
+				if e.v < 0 {
+					continue // not known
+				}
+				add(dbase+"/"+e.field, dobj+"_"+e.field, dname+" "+e.name,
+					"mdi:alert-circle-outline", "", true, strconv.FormatInt(e.v, 10))
+			}
+		}
+	}
+	return topics
+}
+
+func mqttPublisher(c mqttConfig, tlsConfig *tls.Config) {
+	defer close(mqttState.done)
+	host, _ := os.Hostname()
+	prefix := c.Topic
+	if prefix == "" {
+		prefix = "zfswatcher/" + host
+	}
+	clientID := c.Clientid
+	if clientID == "" {
+		clientID = "zfswatcher-" + host
+	}
+	status := prefix + "/status"
+	will := &mqttWill{topic: status, payload: "offline", qos: c.Qos, retain: true}
+
+	var mc *mqttConn
+	var queue []*notifier.Msg            // events waiting to be published
+	published := make(map[string]string) // the retained topics as published
+	var resend, failed bool
+	var retryTimer *time.Timer
+	retryDelay := mqtt_RETRY_MIN
+	pingTicker := time.NewTicker(time.Duration(c.Keepalive) * time.Second / 2)
+	defer pingTicker.Stop()
+
+	// drop the connection, only the first error is reported:
+	fail := func(str string, err error) {
+		if mc != nil {
+			mc.close()
+			mc = nil
+		}
+		if !failed {
+			notify.Printf(notifier.ERR, "MQTT %s: %s", str, err)
+			failed = true
+		}
+	}
+	// publish the events and the changed state, returns false if there
+	// was an error:
+	send := func() bool {
+		var err error
+		if mc == nil {
+			mc, err = dialMqtt(&c, tlsConfig, clientID, will)
+			if err != nil {
+				mc = nil
+				fail("error connecting to "+c.Broker, err)
+				return false
+			}
+			if err = mc.publish(status, "online", c.Qos, true); err != nil {
+				fail("error publishing", err)
+				return false
+			}
+			if failed {
+				notify.Printf(notifier.INFO, "MQTT connection to %s restored", c.Broker)
+				failed = false
+			}
+			resend = true // the broker may have lost the retained messages
+		}
+		for len(queue) > 0 {
+			m := queue[0]
+			b, _ := json.Marshal(&mqttEvent{
+				Time:     m.Time,
+				Severity: m.Severity.String(),
+				Text:     m.Text,
+				Fields:   m.Fields,
+			})
+			if err = mc.publish(prefix+"/event", string(b), c.Qos, false); err != nil {
+				fail("error publishing", err)
+				return false
+			}
+			queue = queue[1:]
+		}
+		wanted := mqttRetained(&c, prefix, host)
+		// the discovery configurations first, then the state:
+		var discovery, state []string
+		for topic, v := range wanted {
+			if !resend && published[topic] == v {
+				continue
+			}
+			if c.Discovery && strings.HasPrefix(topic, c.Discoveryprefix+"/") {
+				discovery = append(discovery, topic)
+			} else {
+				state = append(state, topic)
+			}
+		}
+		sort.Strings(discovery)
+		sort.Strings(state)
+		for _, topic := range append(discovery, state...) {
+			if err = mc.publish(topic, wanted[topic], c.Qos, true); err != nil {
+				fail("error publishing", err)
+				return false
+			}
+			published[topic] = wanted[topic]
+		}
+		// remove the pools and devices which are gone, the state first:
+		discovery, state = nil, nil
+		for topic := range published {
+			if _, ok := wanted[topic]; ok {
+				continue
+			}
+			if c.Discovery && strings.HasPrefix(topic, c.Discoveryprefix+"/") {
+				discovery = append(discovery, topic)
+			} else {
+				state = append(state, topic)
+			}
+		}
+		sort.Strings(discovery)
+		sort.Strings(state)
+		for _, topic := range append(state, discovery...) {
+			if err = mc.publish(topic, "", c.Qos, true); err != nil {
+				fail("error publishing", err)
+				return false
+			}
+			delete(published, topic)
+		}
+		resend = false
+		return true
+	}
+
+LOOP:
+	for {
+		var retryC <-chan time.Time
+		if retryTimer != nil {
+			retryC = retryTimer.C
+		}
+		select {
+		case m := <-mqttState.events:
+			if len(queue) >= mqtt_QUEUE_SIZE {
+				queue = queue[1:] // drop the oldest event
+			}
+			queue = append(queue, m)
+		case <-mqttState.update:
+		case <-pingTicker.C:
+			if mc != nil {
+				if err := mc.ping(); err != nil {
+					fail("connection to "+c.Broker+" lost", err)
+				}
+			}
+		case <-retryC:
+			retryTimer = nil
+		case <-mqttState.stop:
+			break LOOP
+		}
+		if retryTimer != nil {
+			continue // waiting before reconnecting
+		}
+		if send() {
+			retryDelay = mqtt_RETRY_MIN
+		} else {
+			retryTimer = time.NewTimer(retryDelay)
+			retryDelay *= 2
+			if retryDelay > mqtt_RETRY_MAX {
+				retryDelay = mqtt_RETRY_MAX
+			}
+		}
+	}
+	// exiting, publish what is left and the offline status:
+	if retryTimer != nil {
+		retryTimer.Stop()
+	}
+	if mc != nil && send() {
+		mc.publish(status, "offline", c.Qos, true)
+		mc.disconnect()
+	} else if mc != nil {
+		mc.close()
+	}
+}
+
+// Receives the notifications from the logging output "mqtt".
+func mqttLogReceiver(m *notifier.Msg) {
+	if m.MsgType != notifier.MSGTYPE_MESSAGE {
+		return
+	}
+	select {
+	case mqttState.events <- m:
+	default:
+		// the publisher is not running or it is far behind
+	}
+}
+
+// Tell the MQTT publisher that the state may have changed.
+func mqttStateChanged() {
+	select {
+	case mqttState.update <- true:
+	default:
+	}
+}
+
+// Start the MQTT publisher goroutine.
+func startMqtt() {
+	tlsConfig, err := mqttTLSConfig(&cfg.Mqtt)
+	if err != nil {
+		notify.Printf(notifier.ERR, "MQTT TLS settings: %s", err)
+		return
+	}
+	mqttState.started = true
+	go mqttPublisher(cfg.Mqtt, tlsConfig)
+	mqttStateChanged()
+}
+
+// Stop the MQTT publisher and wait a moment for it to disconnect.
+func stopMqtt() {
+	if !mqttState.started {
+		return
+	}
+	close(mqttState.stop)
+	select {
+	case <-mqttState.done:
+	case <-time.After(2 * mqtt_TIMEOUT):
+	}
+}
+
+// eof
@@ -0,0 +1,293 @@
+//
+// mqttclient.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// This implements the parts of the MQTT 3.1.1 protocol needed for
+// publishing: CONNECT with a last will, PUBLISH with QoS 0 or 1, PINGREQ
+// and DISCONNECT. Nothing is subscribed, so the broker only sends the
+// acknowledgements and they are read synchronously.
+
+// MQTT control packet types.
+const (
+	mqtt_CONNECT    = 1
+	mqtt_CONNACK    = 2
+	mqtt_PUBLISH    = 3
+	mqtt_PUBACK     = 4
+	mqtt_PINGREQ    = 12
+	mqtt_PINGRESP   = 13
+	mqtt_DISCONNECT = 14
+)
+
+const mqtt_TIMEOUT = 10 * time.Second // for connecting and acknowledgements
+
+var mqttConnackErrors = []string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// A message published by the broker when the connection is lost.
+type mqttWill struct {
+	topic   string
+	payload string
+	qos     int
+	retain  bool
+}
+
+type mqttConn struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	packetID uint16
+}
+
+// Make the TLS settings for "tls://" broker addresses.
+func mqttTLSConfig(c *mqttConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.Insecureskipverify}
+	if strings.HasPrefix(c.Broker, "tls://") {
+		host, _, err := net.SplitHostPort(c.Broker[len("tls://"):])
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = host
+	}
+	if c.Cafile != "" {
+		pem, err := ioutil.ReadFile(c.Cafile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New(`no certificates found in "` + c.Cafile + `"`)
+		}
+	}
+	if c.Certfile != "" || c.Keyfile != "" {
+		cert, err := tls.LoadX509KeyPair(c.Certfile, c.Keyfile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func appendMqttString(b []byte, s string) []byte {
+	return append(append(b, byte(len(s)>>8), byte(len(s))), s...)
+}
+
+func (mc *mqttConn) writePacket(typ, flags byte, body []byte) error {
+	buf := []byte{typ<<4 | flags}
+	l := len(body)
+	for {
+		digit := byte(l % 128)
+		l /= 128
+		if l > 0 {
+			digit |= 0x80
+		}
+		buf = append(buf, digit)
+		if l == 0 {
+			break
+		}
+	}
+	mc.conn.SetWriteDeadline(time.Now().Add(mqtt_TIMEOUT))
+	_, err := mc.conn.Write(append(buf, body...))
+	return err
+}
+
+func (mc *mqttConn) readPacket() (byte, []byte, error) {
+	h, err := mc.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var l, mul int = 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed MQTT packet")
+		}
+		digit, err := mc.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		l += int(digit&0x7f) * mul
+		mul *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, l)
+	if _, err = io.ReadFull(mc.r, body); err != nil {
+		return 0, nil, err
+	}
+	return h >> 4, body, nil
+}
+
+// Wait for a packet of the given type, other packets are skipped.
+func (mc *mqttConn) expect(typ byte) ([]byte, error) {
+	mc.conn.SetReadDeadline(time.Now().Add(mqtt_TIMEOUT))
+	for {
+		t, body, err := mc.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		if t == typ {
+			return body, nil
+		}
+	}
+}
+
+// Connect to a broker at "host:port", "tcp://host:port" or
+// "tls://host:port".
+func dialMqtt(c *mqttConfig, tlsConfig *tls.Config, clientID string, will *mqttWill) (*mqttConn, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: mqtt_TIMEOUT}
+	switch {
+	case strings.HasPrefix(c.Broker, "tls://"):
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.Broker[len("tls://"):], tlsConfig)
+	case strings.HasPrefix(c.Broker, "tcp://"):
+		conn, err = dialer.Dial("tcp", c.Broker[len("tcp://"):])
+	default:
+		conn, err = dialer.Dial("tcp", c.Broker)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return connectMqtt(conn, c, clientID, will)
+}
+
+// Send CONNECT and wait for CONNACK on an established connection. The
+// connection is closed in case of errors.
+func connectMqtt(conn net.Conn, c *mqttConfig, clientID string, will *mqttWill) (*mqttConn, error) {
+	mc := &mqttConn{conn: conn, r: bufio.NewReader(conn)}
+
+	flags := byte(0x02) // clean session
+	if will != nil {
+		flags |= 0x04 | byte(will.qos)<<3
+		if will.retain {
+			flags |= 0x20
+		}
+	}
+	if c.User != "" {
+		flags |= 0x80
+		if c.Password != "" {
+			flags |= 0x40
+		}
+	}
+	body := appendMqttString(nil, "MQTT")
+	body = append(body, 4, flags, byte(c.Keepalive>>8), byte(c.Keepalive))
+	body = appendMqttString(body, clientID)
+	if will != nil {
+		body = appendMqttString(body, will.topic)
+		body = appendMqttString(body, will.payload)
+	}
+	if c.User != "" {
+		body = appendMqttString(body, c.User)
+		if c.Password != "" {
+			body = appendMqttString(body, c.Password)
+		}
+	}
+	if err := mc.writePacket(mqtt_CONNECT, 0, body); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ack, err := mc.expect(mqtt_CONNACK)
+	if err == nil && len(ack) != 2 {
+		err = errors.New("malformed MQTT CONNACK")
+	}
+	if err == nil && ack[1] != 0 {
+		if int(ack[1]) < len(mqttConnackErrors) {
+			err = errors.New("connection refused: " + mqttConnackErrors[ack[1]])
+		} else {
+			err = fmt.Errorf("connection refused: code %d", ack[1])
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return mc, nil
+}
+
+// Publish a message, with QoS 1 wait until the broker acknowledges it.
+func (mc *mqttConn) publish(topic, payload string, qos int, retain bool) error {
+	flags := byte(qos) << 1
+	if retain {
+		flags |= 0x01
+	}
+	body := appendMqttString(nil, topic)
+	if qos > 0 {
+		mc.packetID++
+		if mc.packetID == 0 {
+			mc.packetID++
+		}
+		body = append(body, byte(mc.packetID>>8), byte(mc.packetID))
+	}
+	body = append(body, payload...)
+	if err := mc.writePacket(mqtt_PUBLISH, flags, body); err != nil {
+		return err
+	}
+	for qos > 0 {
+		ack, err := mc.expect(mqtt_PUBACK)
+		if err != nil {
+			return err
+		}
+		if len(ack) == 2 && ack[0] == byte(mc.packetID>>8) && ack[1] == byte(mc.packetID) {
+			break
+		}
+	}
+	return nil
+}
+
+// Keep the connection alive and check that the broker is still there.
+func (mc *mqttConn) ping() error {
+	if err := mc.writePacket(mqtt_PINGREQ, 0, nil); err != nil {
+		return err
+	}
+	_, err := mc.expect(mqtt_PINGRESP)
+	return err
+}
+
+// Disconnect cleanly, the broker does not publish the last will then.
+func (mc *mqttConn) disconnect() {
+	mc.writePacket(mqtt_DISCONNECT, 0, nil)
+	mc.conn.Close()
+}
+
+func (mc *mqttConn) close() {
+	mc.conn.Close()
+}
+
+// eof
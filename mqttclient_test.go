@@ -0,0 +1,204 @@
+//
+// mqttclient_test.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// One end of a connection made with net.Pipe.
+func newPipeConn(conn net.Conn) *mqttConn {
+	return &mqttConn{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// Read a string with a 2 byte length prefix, an empty rest if it is
+// truncated.
+func readMqttString(t *testing.T, b []byte) (string, []byte) {
+	if len(b) < 2 {
+		t.Errorf("truncated string in %q", b)
+		return "", nil
+	}
+	l := int(b[0])<<8 | int(b[1])
+	if len(b) < 2+l {
+		t.Errorf("truncated string in %q", b)
+		return "", nil
+	}
+	return string(b[2 : 2+l]), b[2+l:]
+}
+
+var mqttRemainingLengthTests = []struct {
+	length  int
+	encoded []byte
+}{
+	{0, []byte{0x00}},
+	{127, []byte{0x7f}},
+	{128, []byte{0x80, 0x01}},
+	{16383, []byte{0xff, 0x7f}},
+	{16384, []byte{0x80, 0x80, 0x01}},
+	{2097151, []byte{0xff, 0xff, 0x7f}},
+	{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+}
+
+func TestMqttRemainingLength(t *testing.T) {
+	for _, tt := range mqttRemainingLengthTests {
+		client, server := net.Pipe()
+		mc := newPipeConn(client)
+		body := bytes.Repeat([]byte{'x'}, tt.length)
+		go func() {
+			mc.writePacket(mqtt_PUBLISH, 0, body)
+		}()
+		broker := newPipeConn(server)
+		head := make([]byte, 1+len(tt.encoded))
+		if _, err := io.ReadFull(broker.r, head); err != nil {
+			t.Fatalf("length %d: %s", tt.length, err)
+		}
+		if head[0] != mqtt_PUBLISH<<4 || !bytes.Equal(head[1:], tt.encoded) {
+			t.Errorf("length %d: header % x, want %02x % x", tt.length, head, mqtt_PUBLISH<<4, tt.encoded)
+		}
+		if _, err := io.ReadFull(broker.r, make([]byte, tt.length)); err != nil {
+			t.Errorf("length %d: %s", tt.length, err)
+		}
+		client.Close()
+		server.Close()
+
+		// and back:
+		client, server = net.Pipe()
+		go func() {
+			server.Write(append(append([]byte{mqtt_PUBACK << 4}, tt.encoded...), body...))
+		}()
+		typ, got, err := newPipeConn(client).readPacket()
+		if err != nil || typ != mqtt_PUBACK || len(got) != tt.length {
+			t.Errorf("length %d: read type %d length %d (%v)", tt.length, typ, len(got), err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestMqttConnectPublish(t *testing.T) {
+	c := &mqttConfig{User: "user", Password: "secret", Keepalive: 60}
+	will := &mqttWill{topic: "zfswatcher/host/status", payload: "offline", qos: 1, retain: true}
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		broker := newPipeConn(server)
+
+		typ, body, err := broker.readPacket()
+		if err != nil || typ != mqtt_CONNECT {
+			t.Errorf("CONNECT: type %d (%v)", typ, err)
+			return
+		}
+		proto, rest := readMqttString(t, body)
+		if proto != "MQTT" || len(rest) < 4 || rest[0] != 4 {
+			t.Errorf("CONNECT: protocol %q % x", proto, rest)
+			return
+		}
+		// user, password, will retain, will QoS 1, will, clean session:
+		if rest[1] != 0x80|0x40|0x20|0x08|0x04|0x02 {
+			t.Errorf("CONNECT: flags %08b", rest[1])
+		}
+		if rest[2] != 0 || rest[3] != 60 {
+			t.Errorf("CONNECT: keepalive % x", rest[2:4])
+		}
+		var fields []string
+		for rest = rest[4:]; len(rest) > 0; {
+			var s string
+			s, rest = readMqttString(t, rest)
+			fields = append(fields, s)
+		}
+		if strings.Join(fields, " ") != "client1 zfswatcher/host/status offline user secret" {
+			t.Errorf("CONNECT: payload %q", fields)
+		}
+		broker.writePacket(mqtt_CONNACK, 0, []byte{0, 0})
+
+		// QoS 1: the other acknowledgements are skipped
+		typ, body, err = broker.readPacket()
+		if err != nil || typ != mqtt_PUBLISH {
+			t.Errorf("PUBLISH: type %d (%v)", typ, err)
+			return
+		}
+		topic, rest := readMqttString(t, body)
+		if topic != "zfswatcher/host/pool/tank" || len(rest) < 2 || string(rest[2:]) != "ONLINE" {
+			t.Errorf("PUBLISH: topic %q rest %q", topic, rest)
+		}
+		id := rest[:2]
+		broker.writePacket(mqtt_PUBACK, 0, []byte{id[0], id[1] + 1})
+		broker.writePacket(mqtt_PINGRESP, 0, nil)
+		broker.writePacket(mqtt_PUBACK, 0, id)
+
+		// QoS 0 has no packet identifier and no acknowledgement
+		typ, body, err = broker.readPacket()
+		if err != nil || typ != mqtt_PUBLISH {
+			t.Errorf("PUBLISH: type %d (%v)", typ, err)
+			return
+		}
+		topic, rest = readMqttString(t, body)
+		if topic != "zfswatcher/host/event" || string(rest) != "{}" {
+			t.Errorf("PUBLISH: topic %q rest %q", topic, rest)
+		}
+
+		typ, _, err = broker.readPacket()
+		if err != nil || typ != mqtt_DISCONNECT {
+			t.Errorf("DISCONNECT: type %d (%v)", typ, err)
+		}
+	}()
+
+	mc, err := connectMqtt(client, c, "client1", will)
+	if err != nil {
+		t.Fatalf("connect: %s", err)
+	}
+	if err = mc.publish("zfswatcher/host/pool/tank", "ONLINE", 1, true); err != nil {
+		t.Errorf("publish QoS 1: %s", err)
+	}
+	if err = mc.publish("zfswatcher/host/event", "{}", 0, false); err != nil {
+		t.Errorf("publish QoS 0: %s", err)
+	}
+	mc.disconnect()
+	<-done
+}
+
+func TestMqttConnectRefused(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		broker := newPipeConn(server)
+		if _, _, err := broker.readPacket(); err == nil {
+			broker.writePacket(mqtt_CONNACK, 0, []byte{0, 5})
+		}
+	}()
+	_, err := connectMqtt(client, &mqttConfig{}, "client1", nil)
+	if err == nil || err.Error() != "connection refused: not authorized" {
+		t.Errorf("got error %v", err)
+	}
+}
+
+// eof
@@ -0,0 +1,169 @@
+//
+// dedup.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package notifier
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// How often the dispatcher checks for digests to send.
+const dedup_TICK = 10 * time.Second
+
+// Repeated messages of an output within the deduplication window.
+type dedupEntry struct {
+	start    time.Time
+	count    int      // messages folded since start
+	severity Severity // the worst severity of the folded messages
+	last     *Msg
+}
+
+type dedupState struct {
+	window  time.Duration
+	entries map[string]*dedupEntry
+	pools   map[string]bool // pools with messages forwarded since the previous flush
+}
+
+var dedupNumberRegexp = regexp.MustCompile(`[0-9]+`)
+
+// Messages are regarded as repeated if they have the same fields and the
+// same text except for numbers (such as error counts).
+func dedupKey(m *Msg) string {
+	return m.Fields["pool"] + "\x00" + m.Fields["device"] + "\x00" +
+		m.Fields["event"] + "\x00" + dedupNumberRegexp.ReplaceAllString(m.Text, "#")
+}
+
+// Check whether a message should be forwarded to the output. The first
+// message is forwarded and the repeated ones are folded into a digest.
+// The attachments are forwarded only if a message about the same pool was
+// forwarded.
+func (d *dedupState) check(m *Msg, st *outputStats) bool {
+	pool := m.Fields["pool"]
+	switch m.MsgType {
+	case MSGTYPE_ATTACHMENT:
+		return pool == "" || d.pools[pool]
+	case MSGTYPE_MESSAGE:
+		key := dedupKey(m)
+		if e, ok := d.entries[key]; ok {
+			e.count++
+			if e.count == 1 || m.Severity < e.severity {
+				e.severity = m.Severity
+			}
+			e.last = m
+			st.deduplicated()
+			return false
+		}
+		d.entries[key] = &dedupEntry{start: m.Time, last: m}
+		if pool != "" {
+			d.pools[pool] = true
+		}
+	}
+	return true
+}
+
+func (d *dedupState) flush() {
+	d.pools = make(map[string]bool)
+}
+
+// Format a duration rounded to seconds without needless zero units, such
+// as "1h" instead of "1h0m0s".
+func shortDuration(d time.Duration) string {
+	d = (d + time.Second/2) / time.Second * time.Second
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// Send the digests of the entries whose window has passed (or all of them
+// if final is true) and forget the entries which had no repeated messages.
+func (n *Notifier) sendDigests(now time.Time, final bool) {
+	for i := range n.out {
+		out := &n.out[i]
+		d := out.dedup
+		if d == nil {
+			continue
+		}
+		sent := false
+		for key, e := range d.entries {
+			if !final && now.Sub(e.start) < d.window {
+				continue
+			}
+			if e.count == 0 {
+				delete(d.entries, key)
+				continue
+			}
+			m := &Msg{
+				Time:     now,
+				MsgType:  MSGTYPE_MESSAGE,
+				Severity: e.severity,
+				Text: fmt.Sprintf("%s (repeated %d times in the last %s)",
+					e.last.Text, e.count, shortDuration(now.Sub(e.start))),
+				Fields: e.last.Fields,
+			}
+			if m.Severity <= out.severity {
+				out.forward(m)
+				sent = true
+			}
+			// keep folding the repeated messages for another window:
+			e.start = now
+			e.count = 0
+		}
+		if sent && out.flush {
+			out.forward(&Msg{Time: now, MsgType: MSGTYPE_FLUSH})
+		}
+	}
+}
+
+// SetOutputDedup enables deduplication for the output which was added
+// last. The first message is sent immediately and the repeated messages
+// within the window are folded into a digest message with the number of
+// repeated messages, which is sent when the window has passed. Messages
+// are regarded as repeated if they concern the same pool, device and event
+// and their text differs only by numbers. Zero window disables
+// deduplication.
+func (n *Notifier) SetOutputDedup(window time.Duration) error {
+	switch {
+	case len(n.out) == 0:
+		return errors.New("no output to set")
+	case window < 0:
+		return errors.New(`invalid "dedup"`)
+	case window == 0:
+		n.out[len(n.out)-1].dedup = nil
+		return nil
+	}
+	n.out[len(n.out)-1].dedup = &dedupState{
+		window:  window,
+		entries: make(map[string]*dedupEntry),
+		pools:   make(map[string]bool),
+	}
+	return nil
+}
+
+// eof
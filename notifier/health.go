@@ -0,0 +1,127 @@
+//
+// health.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package notifier
+
+import (
+	"errors"
+	"time"
+)
+
+// Failures of an output are reported to the other outputs at most this
+// often.
+const report_INTERVAL = time.Minute
+
+// Add an output and connect its statistics to the failure reporting.
+func (n *Notifier) addOutput(out notifyOutput) {
+	i := len(n.out)
+	out.stats.setReport(func(text string) bool { return n.reportOutputError(i, text) })
+	n.out = append(n.out, out)
+}
+
+// SetOutputErrors defines how failed deliveries of an output are reported.
+// The error is sent as a message with severity s (SEVERITY_NONE disables
+// reporting) to the first healthy output in the fallback list of output
+// names. If the list is empty, the message is sent to all healthy outputs.
+// The failed output itself never gets the message. The errors are always
+// written to standard error as well.
+func (n *Notifier) SetOutputErrors(s Severity, fallback []string) error {
+	if s != SEVERITY_NONE && (s < severity_MIN || s > severity_MAX) {
+		return errors.New(`invalid "severity"`)
+	}
+	var outputs []int
+	for _, name := range fallback {
+		i := n.findOutput(name)
+		if i < 0 {
+			return errors.New(`unknown output "` + name + `"`)
+		}
+		outputs = append(outputs, i)
+	}
+	n.mutex.Lock()
+	n.errorSeverity = s
+	n.fallback = outputs
+	n.mutex.Unlock()
+	return nil
+}
+
+// Queue a report about a failed delivery of output i. Returns false if
+// reporting is disabled or the report was dropped. This is called from the
+// goroutines of the outputs, so it must never block.
+func (n *Notifier) reportOutputError(i int, text string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.closed || n.errorSeverity == SEVERITY_NONE {
+		return false
+	}
+	m := &Msg{
+		Time:     time.Now(),
+		MsgType:  MSGTYPE_MESSAGE,
+		Severity: n.errorSeverity,
+		Text:     sanitizeMessageText(text),
+		failed:   i + 1,
+	}
+	select {
+	case n.ch <- m:
+		return true
+	default:
+		internalError("dispatcher error: output failure report dropped")
+		return false
+	}
+}
+
+// Make the message of a failure report and select the outputs it is sent
+// to.
+func (n *Notifier) errorReport(m *Msg) (*Msg, map[int]bool) {
+	i := m.failed - 1
+	name := n.out[i].name
+	if name == "" {
+		name = n.out[i].stats.Type
+	}
+	m.Text = `notification output "` + name + `" failed: ` + m.Text
+	m.Fields = Fields{"event": "outputfailed", "output": name}
+
+	usable := func(j int) bool {
+		return j != i && m.Severity <= n.out[j].severity &&
+			n.out[j].severity != SEVERITY_NONE && n.out[j].stats.healthy()
+	}
+	outputs := make(map[int]bool)
+	n.mutex.Lock()
+	fallback := n.fallback
+	n.mutex.Unlock()
+	if len(fallback) == 0 {
+		for j := range n.out {
+			if usable(j) {
+				outputs[j] = true
+			}
+		}
+		return m, outputs
+	}
+	for _, j := range fallback {
+		if usable(j) {
+			outputs[j] = true
+			break
+		}
+	}
+	return m, outputs
+}
+
+// eof
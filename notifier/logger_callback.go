@@ -21,7 +21,7 @@
 
 package notifier
 
-func (n Notifier) loggerCallback(ch chan *Msg, f func(*Msg)) {
+func (n *Notifier) loggerCallback(ch chan *Msg, f func(*Msg)) {
 	defer n.wg.Done()
 	for m := range ch {
 		f(m)
@@ -34,7 +34,7 @@ func (n *Notifier) AddLoggerCallback(s Severity, f func(*Msg)) error {
 	ch := make(chan *Msg, chan_SIZE)
 	n.wg.Add(1)
 	go n.loggerCallback(ch, f)
-	n.out = append(n.out, notifyOutput{severity: s, ch: ch, attachment: true})
+	n.addOutput(notifyOutput{severity: s, ch: ch, attachment: true, stats: newOutputStats("callback")})
 	return nil
 }
 
@@ -0,0 +1,178 @@
+//
+// logger_chat.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package notifier
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// This implements Slack compatible incoming webhooks (also supported by
+// Mattermost and others).
+
+// ChatConfig defines the settings of a chat logging output. The HTTP
+// settings are the same as for webhooks, Batch is ignored.
+type ChatConfig struct {
+	WebhookConfig
+	Channel   string // channel override (optional)
+	Username  string // user name override (optional)
+	IconURL   string // icon override (optional)
+	StatusURL string // prefix for links to pools, the pool name is appended (optional)
+	Template  TemplateConfig
+}
+
+// Colors by severity, used in chat messages and HTML e-mail.
+var severityColors = []string{
+	EMERG:   "#d00000",
+	ALERT:   "#d00000",
+	CRIT:    "#d00000",
+	ERR:     "#e8590c",
+	WARNING: "#f0ad4e",
+	NOTICE:  "#3a87ad",
+	INFO:    "#3a87ad",
+	DEBUG:   "#999999",
+}
+
+type chatAttachment struct {
+	Fallback  string   `json:"fallback"`
+	Color     string   `json:"color,omitempty"`
+	Title     string   `json:"title,omitempty"`
+	TitleLink string   `json:"title_link,omitempty"`
+	Text      string   `json:"text"`
+	MrkdwnIn  []string `json:"mrkdwn_in,omitempty"`
+}
+
+type chatPayload struct {
+	Channel     string           `json:"channel,omitempty"`
+	Username    string           `json:"username,omitempty"`
+	IconURL     string           `json:"icon_url,omitempty"`
+	Text        string           `json:"text"`
+	Attachments []chatAttachment `json:"attachments"`
+}
+
+var chatEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// Make one chat message of a batch. The messages are grouped by pool, each
+// pool in an attachment of its own, followed by the related attachments
+// as code blocks.
+func makeChatPayload(c *ChatConfig, t *outputTemplates, host string, mbuf, abuf []*Msg) ([]byte, error) {
+	sum := summarizeMsgs(mbuf)
+	d := t.data(host, "", mbuf, abuf, t.formatLines(host, mbuf, (*Msg).TimeString))
+	p := chatPayload{
+		Channel:  c.Channel,
+		Username: c.Username,
+		IconURL:  c.IconURL,
+		Text: chatEscaper.Replace(t.formatSubject(d, host+": "+sum.Text+
+			" ["+sum.Severity.String()+"]")),
+	}
+
+	// group the messages by pool, keeping the order:
+	var pools []string
+	groups := make(map[string][]*Msg)
+	for _, m := range mbuf {
+		pool := m.Fields["pool"]
+		if _, ok := groups[pool]; !ok {
+			pools = append(pools, pool)
+		}
+		groups[pool] = append(groups[pool], m)
+	}
+	for _, pool := range pools {
+		group := summarizeMsgs(groups[pool])
+		var lines []string
+		for _, m := range groups[pool] {
+			lines = append(lines, t.formatLine(host, m, (*Msg).TimeString))
+		}
+		a := chatAttachment{
+			Fallback: chatEscaper.Replace(group.Text),
+			Color:    severityColors[group.Severity],
+			Title:    host,
+			Text:     chatEscaper.Replace(strings.Join(lines, "\n")),
+		}
+		if pool != "" {
+			a.Title = `pool "` + pool + `" on ` + host
+			if c.StatusURL != "" {
+				a.TitleLink = c.StatusURL + url.PathEscape(pool)
+			}
+		}
+		p.Attachments = append(p.Attachments, a)
+
+		for _, att := range abuf {
+			if att.Fields["pool"] != pool {
+				continue
+			}
+			p.Attachments = append(p.Attachments, chatAttachment{
+				Fallback: "details",
+				Color:    severityColors[group.Severity],
+				Text:     "```\n" + chatEscaper.Replace(strings.TrimRight(att.Text, "\n")) + "\n```",
+				MrkdwnIn: []string{"text"},
+			})
+		}
+	}
+	return json.Marshal(&p)
+}
+
+func (n *Notifier) loggerChat(ch chan *Msg, st *outputStats, sp *spool, client *http.Client, c *ChatConfig, t *outputTemplates) {
+	defer n.wg.Done()
+
+	host, err := os.Hostname()
+	checkInternalError("error getting host name", err)
+
+	throttledFlushLoop(ch, c.Throttle, func(mbuf, abuf []*Msg) {
+		body, err := makeChatPayload(c, t, host, mbuf, abuf)
+		checkInternalError("error making chat payload", err)
+		n.sendWebhooks(st, sp, client, &c.WebhookConfig, [][]byte{body})
+	})
+	sp.close()
+}
+
+// AddLoggerChat adds a logging output which sends the messages to a Slack
+// compatible incoming webhook whenever Flush() is called. All messages
+// since the previous flush are sent in one chat message.
+func (n *Notifier) AddLoggerChat(s Severity, c ChatConfig) error {
+	if s < severity_MIN || s > SEVERITY_NONE {
+		return errors.New(`invalid "severity"`)
+	}
+	client, err := checkWebhookConfig(&c.WebhookConfig)
+	if err != nil {
+		return err
+	}
+	t, err := n.newOutputTemplates(c.Template)
+	if err != nil {
+		return err
+	}
+	st := newOutputStats("chat")
+	sp, err := n.newWebhookSpool(st, client, &c.WebhookConfig)
+	if err != nil {
+		return err
+	}
+	ch := make(chan *Msg, chan_SIZE)
+	n.wg.Add(1)
+	go n.loggerChat(ch, st, sp, client, &c, t)
+	n.addOutput(notifyOutput{severity: s, ch: ch, attachment: true, flush: true, stats: st, spool: sp})
+	return nil
+}
+
+// eof
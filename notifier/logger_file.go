@@ -22,73 +22,245 @@
 package notifier
 
 import (
+	"compress/gzip"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"strings"
+	"time"
 )
 
-func (n *Notifier) loggerFile(ch chan *Msg, filename string) {
-	defer n.wg.Done()
+// Default number of old generations kept if rotation is enabled.
+const file_KEEP = 7
+
+// FileConfig defines the settings of a file logging output.
+type FileConfig struct {
+	File     string // path name of the log file
+	MaxSize  int64  // rotate before the file grows larger than this (bytes, 0: no limit)
+	Daily    bool   // rotate when the date changes
+	Keep     int    // number of old generations to keep
+	Compress bool   // compress the old generations with gzip
+	JSON     bool   // write JSON Lines instead of text
+	Template TemplateConfig
+}
 
-	var fileopen bool
+// Format a message or an attachment for the file and stdout outputs. In
+// text format the lines of attachments are prefixed with ">" and the
+// messages are formatted with the line template if there is one.
+func formatLogEntry(m *Msg, json bool, t *outputTemplates, host string) string {
+	switch {
+	case json:
+		return m.JSONString() + "\n"
+	case m.MsgType == MSGTYPE_ATTACHMENT:
+		return ">" + strings.Replace(strings.TrimRight(m.Text, "\n"), "\n", "\n>", -1) + "\n"
+	}
+	return t.formatLine(host, m, (*Msg).String) + "\n"
+}
 
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+// An open log file. The old generations are named "file.1", "file.2" etc.
+// ("file.1.gz" and so on if compressed), "file.1" being the newest.
+type logFile struct {
+	c    *FileConfig
+	f    *os.File
+	size int64
+	day  string // the date when the file was started
+}
 
+func (lf *logFile) open() error {
+	f, err := os.OpenFile(lf.c.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	lf.f = f
+	lf.size = fi.Size()
+	lf.day = time.Now().Format(date_FORMAT)
+	if lf.size > 0 {
+		lf.day = fi.ModTime().Format(date_FORMAT)
+	}
+	return nil
+}
+
+func (lf *logFile) close() error {
+	if lf.f == nil {
+		return nil
+	}
+	err := lf.f.Close()
+	lf.f = nil
+	return err
+}
+
+// Tells if the file has been moved or deleted since it was opened.
+func (lf *logFile) moved() bool {
+	fi, err := os.Stat(lf.c.File)
+	if err != nil {
+		return true
+	}
+	ofi, err := lf.f.Stat()
+	return err != nil || !os.SameFile(fi, ofi)
+}
+
+func (lf *logFile) generation(gen int) string {
+	name := fmt.Sprintf("%s.%d", lf.c.File, gen)
+	if lf.c.Compress {
+		name += ".gz"
+	}
+	return name
+}
+
+func (lf *logFile) needRotate(n int) bool {
+	switch {
+	case lf.size == 0:
+		return false
+	case lf.c.MaxSize > 0 && lf.size+int64(n) > lf.c.MaxSize:
+		return true
+	case lf.c.Daily && time.Now().Format(date_FORMAT) != lf.day:
+		return true
+	}
+	return false
+}
+
+// Compress a file with gzip and remove the original.
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
 	if err == nil {
-		fileopen = true
-	} else {
-		checkInternalError("error opening log file", err)
-		fileopen = false
+		err = zw.Close()
 	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(dst+".tmp", dst)
+	}
+	if err != nil {
+		os.Remove(dst + ".tmp")
+		return err
+	}
+	return os.Remove(src)
+}
+
+// Move the file to the first old generation and start a new file.
+func (lf *logFile) rotate() error {
+	checkInternalError("error closing log file", lf.close())
+	os.Remove(lf.generation(lf.c.Keep))
+	for gen := lf.c.Keep - 1; gen >= 1; gen-- {
+		// the older generations may be missing:
+		os.Rename(lf.generation(gen), lf.generation(gen+1))
+	}
+	first := lf.c.File + ".1"
+	err := os.Rename(lf.c.File, first)
+	if err == nil && lf.c.Compress {
+		err = gzipFile(first, lf.generation(1))
+	}
+	if oerr := lf.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+// Write to the file, reopening it if it has been moved or deleted and
+// rotating it as configured.
+func (lf *logFile) write(text string) error {
+	if lf.f != nil && lf.moved() {
+		checkInternalError("error closing log file", lf.close())
+	}
+	if lf.f == nil {
+		if err := lf.open(); err != nil {
+			return err
+		}
+	}
+	if lf.needRotate(len(text)) {
+		err := lf.rotate()
+		if lf.f == nil {
+			return err
+		}
+		checkInternalError("error rotating log file", err)
+	}
+	n, err := lf.f.WriteString(text)
+	lf.size += int64(n)
+	return err
+}
+
+func (n *Notifier) loggerFile(ch chan *Msg, st *outputStats, c *FileConfig, t *outputTemplates) {
+	defer n.wg.Done()
+
+	host, err := os.Hostname()
+	checkInternalError("error getting host name", err)
+
+	lf := &logFile{c: c}
+	st.check("error opening log file", lf.open())
 
 	for m := range ch {
+		var err error
 		switch m.MsgType {
-		case MSGTYPE_MESSAGE:
-			if !fileopen {
-				continue
-			}
-			_, err = f.WriteString(m.String() + "\n")
-			checkInternalError("error writing log file", err)
-		case MSGTYPE_ATTACHMENT:
-			if !fileopen {
-				continue
-			}
-			_, err = f.WriteString(">" +
-				strings.Replace(strings.TrimRight(m.Text, "\n"), "\n", "\n>", -1) +
-				"\n")
-			checkInternalError("error writing log file", err)
+		case MSGTYPE_MESSAGE, MSGTYPE_ATTACHMENT:
+			err = lf.write(formatLogEntry(m, c.JSON, t, host))
 		case MSGTYPE_REOPEN:
-			if fileopen {
-				err = f.Close()
-				checkInternalError("error closing log file", err)
-			}
-			f, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
-			if err == nil {
-				fileopen = true
-			} else {
-				checkInternalError("error re-opening log file", err)
-				fileopen = false
-			}
+			checkInternalError("error closing log file", lf.close())
+			st.check("error re-opening log file", lf.open())
+			continue
+		default:
+			continue
+		}
+		st.check("error writing log file", err)
+		if err == nil {
+			st.success()
 		}
 	}
-	if fileopen {
-		err = f.Close()
-		checkInternalError("error closing log file", err)
-	}
+	checkInternalError("error closing log file", lf.close())
 }
 
 // AddLoggerFile adds a file based logging output.
 func (n *Notifier) AddLoggerFile(s Severity, file string) error {
+	return n.AddLoggerFileConfig(s, FileConfig{File: file})
+}
+
+// AddLoggerFileConfig adds a file based logging output with optional
+// rotation. The file is rotated before it would grow larger than MaxSize
+// and/or when the date changes, keeping Keep old generations. The file is
+// also reopened automatically if it is moved or deleted, so that external
+// rotation works without calling Reopen().
+func (n *Notifier) AddLoggerFileConfig(s Severity, c FileConfig) error {
 	switch {
 	case s < severity_MIN || s > severity_MAX:
 		return errors.New(`invalid "severity"`)
-	case file == "":
+	case c.File == "":
 		return errors.New(`"file" not defined`)
+	case c.MaxSize < 0:
+		return errors.New(`invalid "maxsize"`)
+	case c.Keep < 0:
+		return errors.New(`invalid "keep"`)
+	}
+	if c.Keep == 0 {
+		c.Keep = file_KEEP
+	}
+	t, err := n.newOutputTemplates(c.Template)
+	if err != nil {
+		return err
 	}
 	ch := make(chan *Msg, chan_SIZE)
+	st := newOutputStats("file")
 	n.wg.Add(1)
-	go n.loggerFile(ch, file)
-	n.out = append(n.out, notifyOutput{severity: s, ch: ch, attachment: true})
+	go n.loggerFile(ch, st, &c, t)
+	n.addOutput(notifyOutput{severity: s, ch: ch, attachment: true, stats: st})
 	return nil
 }
 
@@ -0,0 +1,431 @@
+//
+// logger_incident.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package notifier
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// This implements incident management APIs: the Prometheus Alertmanager
+// API v2 (POST /api/v2/alerts) and Events API v2 compatible services (such
+// as PagerDuty). Only the messages about alerts are sent, they are
+// recognized by the "alert" field (a stable key of the problem) and the
+// "alertstatus" field which is "firing", "acknowledged" or "resolved".
+// Optional fields are "alertname", "alertseverity" (the severity of the
+// alert if it differs from the message) and "alertstarted" (RFC 3339).
+
+// Supported incident APIs.
+const (
+	INCIDENT_ALERTMANAGER = "alertmanager"
+	INCIDENT_EVENTS       = "events"
+)
+
+// Defaults used if zero values are given in IncidentConfig.
+const (
+	incident_RESEND     = 60 * time.Second
+	incident_ALERTNAME  = "zfswatcher"
+	incident_SUMMARYMAX = 1024
+)
+
+// IncidentConfig defines the settings of an incident output. The HTTP
+// settings are the same as for webhooks, Batch, Secret and Throttle are
+// ignored.
+type IncidentConfig struct {
+	WebhookConfig
+	API        string        // INCIDENT_ALERTMANAGER or INCIDENT_EVENTS
+	RoutingKey string        // integration key (Events API)
+	Resend     time.Duration // how often the firing alerts are sent again (Alertmanager)
+	StatusURL  string        // prefix for links to pools, the pool name is appended (optional)
+}
+
+// An alert in the Alertmanager API v2 format.
+type amAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     string            `json:"startsAt,omitempty"`
+	EndsAt       string            `json:"endsAt,omitempty"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// An event in the Events API v2 format.
+type eventsPayload struct {
+	RoutingKey  string         `json:"routing_key"`
+	EventAction string         `json:"event_action"`
+	DedupKey    string         `json:"dedup_key"`
+	Payload     *eventsDetails `json:"payload,omitempty"`
+	Client      string         `json:"client,omitempty"`
+	ClientURL   string         `json:"client_url,omitempty"`
+}
+
+type eventsDetails struct {
+	Summary       string `json:"summary"`
+	Source        string `json:"source"`
+	Severity      string `json:"severity"`
+	Timestamp     string `json:"timestamp,omitempty"`
+	Component     string `json:"component,omitempty"`
+	Group         string `json:"group,omitempty"`
+	Class         string `json:"class,omitempty"`
+	CustomDetails Fields `json:"custom_details,omitempty"`
+}
+
+// Events API severities.
+var eventsSeverities = []string{
+	EMERG:   "critical",
+	ALERT:   "critical",
+	CRIT:    "critical",
+	ERR:     "error",
+	WARNING: "warning",
+	NOTICE:  "info",
+	INFO:    "info",
+	DEBUG:   "info",
+}
+
+func truncate(str string, max int) string {
+	if len(str) > max {
+		return str[:max-3] + "..."
+	}
+	return str
+}
+
+func incidentStatusURL(c *IncidentConfig, pool string) string {
+	if c.StatusURL == "" || pool == "" {
+		return ""
+	}
+	return c.StatusURL + pool
+}
+
+func makeAMAlert(c *IncidentConfig, host string, m *Msg) *amAlert {
+	sev := m.Severity.String()
+	if v := m.Fields["alertseverity"]; v != "" {
+		sev = v
+	}
+	a := &amAlert{
+		Labels: map[string]string{
+			"alertname": incident_ALERTNAME,
+			"instance":  host,
+			"severity":  sev,
+		},
+		Annotations: map[string]string{
+			"summary": m.Text,
+		},
+		GeneratorURL: incidentStatusURL(c, m.Fields["pool"]),
+	}
+	if name := m.Fields["alertname"]; name != "" {
+		a.Labels["alertname"] = name
+	}
+	for _, k := range []string{"pool", "device"} {
+		if v := m.Fields[k]; v != "" {
+			a.Labels[k] = v
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, m.Fields["alertstarted"]); err == nil {
+		a.StartsAt = t.Format(time.RFC3339)
+	} else {
+		a.StartsAt = m.Time.Format(time.RFC3339)
+	}
+	return a
+}
+
+// Returns true if the labels of the alerts are the same.
+func sameLabels(a, b *amAlert) bool {
+	if len(a.Labels) != len(b.Labels) {
+		return false
+	}
+	for k, v := range a.Labels {
+		if b.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func makeEventsPayload(c *IncidentConfig, host string, m *Msg) ([]byte, error) {
+	p := eventsPayload{
+		RoutingKey: c.RoutingKey,
+		DedupKey:   host + "/" + m.Fields["alert"],
+	}
+	switch m.Fields["alertstatus"] {
+	case "firing":
+		p.EventAction = "trigger"
+		p.Payload = &eventsDetails{
+			Summary:       truncate(m.Text, incident_SUMMARYMAX),
+			Source:        host,
+			Severity:      eventsSeverities[m.Severity],
+			Timestamp:     m.Time.Format(time.RFC3339),
+			Component:     m.Fields["device"],
+			Group:         m.Fields["pool"],
+			Class:         m.Fields["alertname"],
+			CustomDetails: m.Fields,
+		}
+		p.Client = "zfswatcher"
+		p.ClientURL = incidentStatusURL(c, m.Fields["pool"])
+	case "acknowledged":
+		p.EventAction = "acknowledge"
+	case "resolved":
+		p.EventAction = "resolve"
+	default:
+		return nil, nil
+	}
+	return json.Marshal(&p)
+}
+
+// A request waiting in incidentSender.
+type incidentRequest struct {
+	body   []byte
+	resend bool // the firing alerts sent again, tried only once
+}
+
+// Sends the requests in order in a goroutine of its own, so that the
+// output keeps reading its channel while the server is retried and no
+// events (especially resolve events) are dropped. The queue is not bounded,
+// but only the changes of the alerts are queued and the repeated resends
+// replace each other.
+type incidentSender struct {
+	mutex sync.Mutex
+	queue []incidentRequest
+	wakeC chan bool
+	stopC chan bool
+}
+
+func (n *Notifier) newIncidentSender(st *outputStats, client *http.Client, c *IncidentConfig) *incidentSender {
+	is := &incidentSender{
+		wakeC: make(chan bool, 1),
+		stopC: make(chan bool),
+	}
+	n.wg.Add(1)
+	go is.run(n.wg, st, client, c)
+	return is
+}
+
+func (is *incidentSender) add(body []byte, resend bool) {
+	is.mutex.Lock()
+	replaced := false
+	if resend {
+		for i := range is.queue {
+			if is.queue[i].resend {
+				is.queue[i].body = body
+				replaced = true
+			}
+		}
+	}
+	if !replaced {
+		is.queue = append(is.queue, incidentRequest{body: body, resend: resend})
+	}
+	is.mutex.Unlock()
+
+	select {
+	case is.wakeC <- true:
+	default:
+	}
+}
+
+func (is *incidentSender) run(wg *sync.WaitGroup, st *outputStats, client *http.Client, c *IncidentConfig) {
+	defer wg.Done()
+
+	stopping := false
+	for {
+		var r *incidentRequest
+		is.mutex.Lock()
+		if len(is.queue) > 0 {
+			req := is.queue[0]
+			r = &req
+			is.queue = is.queue[1:]
+		}
+		is.mutex.Unlock()
+		if r == nil {
+			if stopping {
+				return
+			}
+			select {
+			case <-is.wakeC:
+			case <-is.stopC:
+				stopping = true
+			}
+			continue
+		}
+		if !r.resend {
+			sendWebhook(st, client, &c.WebhookConfig, r.body)
+		} else if _, err := postWebhook(client, &c.WebhookConfig, r.body); err != nil {
+			st.check("error sending alerts to alertmanager", err)
+		} else {
+			st.success()
+		}
+	}
+}
+
+// Send the queued requests and stop.
+func (is *incidentSender) close() {
+	close(is.stopC)
+}
+
+// Send a request body or add it to the spool.
+func sendIncident(sp *spool, is *incidentSender, body []byte) {
+	if sp != nil {
+		sp.add(body)
+		return
+	}
+	is.add(body, false)
+}
+
+// Alertmanager output: the firing alerts are sent again at "resend"
+// intervals, otherwise Alertmanager resolves them after its own timeout.
+// The resolved alerts are sent with the end time.
+func (n *Notifier) loggerAlertmanager(ch chan *Msg, sp *spool, is *incidentSender, c *IncidentConfig, host string) {
+	firing := make(map[string]*amAlert)
+	post := func(as []*amAlert) {
+		body, err := json.Marshal(as)
+		checkInternalError("error making alertmanager payload", err)
+		sendIncident(sp, is, body)
+	}
+	ticker := time.NewTicker(c.Resend)
+	defer ticker.Stop()
+LOOP:
+	for {
+		select {
+		case m, ok := <-ch:
+			if !ok {
+				break LOOP
+			}
+			key := m.Fields["alert"]
+			if m.MsgType != MSGTYPE_MESSAGE || key == "" || m.Fields["alertstatus"] == "" {
+				continue
+			}
+			a := makeAMAlert(c, host, m)
+			old := firing[key]
+			switch m.Fields["alertstatus"] {
+			case "firing":
+				as := []*amAlert{a}
+				if old != nil && !sameLabels(old, a) {
+					// the labels changed (such as severity), end the old alert:
+					old.EndsAt = m.Time.Format(time.RFC3339)
+					as = append(as, old)
+				}
+				firing[key] = a
+				post(as)
+			case "resolved":
+				if old != nil {
+					a = old
+				}
+				a.EndsAt = m.Time.Format(time.RFC3339)
+				delete(firing, key)
+				post([]*amAlert{a})
+			}
+		case <-ticker.C:
+			if len(firing) == 0 {
+				continue
+			}
+			var keys []string
+			for key := range firing {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			var as []*amAlert
+			for _, key := range keys {
+				as = append(as, firing[key])
+			}
+			body, err := json.Marshal(as)
+			checkInternalError("error making alertmanager payload", err)
+			// not spooled, sent again anyway:
+			is.add(body, true)
+		}
+	}
+}
+
+// Events API output: each message about an alert is sent as a trigger,
+// acknowledge or resolve event.
+func (n *Notifier) loggerEvents(ch chan *Msg, sp *spool, is *incidentSender, c *IncidentConfig, host string) {
+	for m := range ch {
+		if m.MsgType != MSGTYPE_MESSAGE || m.Fields["alert"] == "" || m.Fields["alertstatus"] == "" {
+			continue
+		}
+		body, err := makeEventsPayload(c, host, m)
+		checkInternalError("error making events payload", err)
+		if body != nil {
+			sendIncident(sp, is, body)
+		}
+	}
+}
+
+func (n *Notifier) loggerIncident(ch chan *Msg, st *outputStats, sp *spool, client *http.Client, c *IncidentConfig) {
+	defer n.wg.Done()
+
+	host, err := os.Hostname()
+	checkInternalError("error getting host name", err)
+
+	is := n.newIncidentSender(st, client, c)
+	if c.API == INCIDENT_ALERTMANAGER {
+		n.loggerAlertmanager(ch, sp, is, c, host)
+	} else {
+		n.loggerEvents(ch, sp, is, c, host)
+	}
+	is.close()
+	sp.close()
+}
+
+// AddLoggerIncident adds a logging output which sends the alerts to an
+// incident management API: trigger events when an alert is firing and
+// resolve events when it is resolved, identified by a stable key. The
+// messages without the "alert" and "alertstatus" fields are ignored. The
+// messages are sent immediately, not when Flush() is called, but the
+// output is silenced like the outputs which are flushed.
+func (n *Notifier) AddLoggerIncident(s Severity, c IncidentConfig) error {
+	if s < severity_MIN || s > SEVERITY_NONE {
+		return errors.New(`invalid "severity"`)
+	}
+	switch c.API {
+	case INCIDENT_ALERTMANAGER:
+		if c.Resend < 0 {
+			return errors.New(`invalid "resend"`)
+		}
+		if c.Resend == 0 {
+			c.Resend = incident_RESEND
+		}
+	case INCIDENT_EVENTS:
+		if c.RoutingKey == "" {
+			return errors.New(`"routingkey" not defined`)
+		}
+	default:
+		return errors.New(`invalid "api"`)
+	}
+	client, err := checkWebhookConfig(&c.WebhookConfig)
+	if err != nil {
+		return err
+	}
+	st := newOutputStats("incident")
+	sp, err := n.newWebhookSpool(st, client, &c.WebhookConfig)
+	if err != nil {
+		return err
+	}
+	ch := make(chan *Msg, chan_SIZE)
+	n.wg.Add(1)
+	go n.loggerIncident(ch, st, sp, client, &c)
+	n.addOutput(notifyOutput{severity: s, ch: ch, flush: true, stats: st, spool: sp})
+	return nil
+}
+
+// eof
@@ -0,0 +1,143 @@
+//
+// logger_journal.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package notifier
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// This implements the native systemd journal protocol.
+
+const journal_SOCKET = "/run/systemd/journal/socket"
+
+// Append a field to a journal entry. Values containing newlines are
+// serialized in the binary format.
+func appendJournalField(b *bytes.Buffer, key, value string) {
+	if strings.Contains(value, "\n") {
+		b.WriteString(key)
+		b.WriteByte('\n')
+		binary.Write(b, binary.LittleEndian, uint64(len(value)))
+		b.WriteString(value)
+		b.WriteByte('\n')
+	} else {
+		b.WriteString(key + "=" + value + "\n")
+	}
+}
+
+// Convert a message field name to a valid journal field name (upper case
+// letters, digits and underscores).
+func journalFieldName(prefix, key string) string {
+	name := []byte(strings.ToUpper(prefix + key))
+	for i, c := range name {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			name[i] = '_'
+		}
+	}
+	return strings.TrimLeft(string(name), "_0123456789")
+}
+
+func makeJournalEntry(m *Msg, prefix, identifier string) []byte {
+	var b bytes.Buffer
+	appendJournalField(&b, "MESSAGE", strings.TrimRight(m.Text, "\n"))
+	appendJournalField(&b, "PRIORITY", strconv.Itoa(int(m.Severity)))
+	appendJournalField(&b, "SYSLOG_IDENTIFIER", identifier)
+	for k, v := range m.Fields {
+		if name := journalFieldName(prefix, k); name != "" {
+			appendJournalField(&b, name, v)
+		}
+	}
+	return b.Bytes()
+}
+
+func (n *Notifier) loggerJournal(ch chan *Msg, st *outputStats, socket, prefix string) {
+	defer n.wg.Done()
+	identifier := path.Base(os.Args[0])
+
+	var c net.Conn
+	var err error
+
+	for m := range ch {
+		switch m.MsgType {
+		case MSGTYPE_MESSAGE, MSGTYPE_ATTACHMENT:
+			// attachments are sent as entries of their own with
+			// a multi-line message
+			entry := makeJournalEntry(m, prefix, identifier)
+			for retries := 0; retries < 2; retries++ {
+				if c == nil {
+					c, err = net.Dial("unixgram", socket)
+					if err != nil {
+						c = nil
+						continue
+					}
+				}
+				_, err = c.Write(entry)
+				if err == nil {
+					break
+				}
+				// try to reopen the socket if there was error:
+				c.Close()
+				c = nil
+			}
+			if err == nil {
+				st.success()
+			}
+			st.check("error writing to journal socket", err)
+		case MSGTYPE_REOPEN:
+			if c != nil {
+				c.Close()
+				c = nil
+			}
+		}
+	}
+	if c != nil {
+		c.Close()
+	}
+}
+
+// AddLoggerJournal adds a logging output which writes to the systemd
+// journal using the native protocol. The message fields are included as
+// journal fields with the given prefix, for example with prefix "ZFS_"
+// the field "pool" becomes "ZFS_POOL". If socket is empty, the default
+// journal socket is used.
+func (n *Notifier) AddLoggerJournal(s Severity, socket, prefix string) error {
+	if s < severity_MIN || s > severity_MAX {
+		return errors.New(`invalid "severity"`)
+	}
+	if socket == "" {
+		socket = journal_SOCKET
+	}
+	ch := make(chan *Msg, chan_SIZE)
+	st := newOutputStats("journal")
+	n.wg.Add(1)
+	go n.loggerJournal(ch, st, socket, prefix)
+	n.addOutput(notifyOutput{severity: s, ch: ch, attachment: true, stats: st})
+	return nil
+}
+
+// eof
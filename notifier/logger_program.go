@@ -0,0 +1,253 @@
+//
+// logger_program.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package notifier
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Defaults used if zero values are given in ProgramConfig.
+const (
+	program_TIMEOUT  = 60 * time.Second
+	program_MAXPROCS = 4
+)
+
+// ProgramConfig defines the settings of a program logging output.
+type ProgramConfig struct {
+	Command  string        // run with "/bin/sh -c"
+	Batch    bool          // run once for all messages of a flush
+	Timeout  time.Duration // the program is killed if it runs longer
+	MaxProcs int           // maximum number of programs running at the same time
+	Template TemplateConfig
+}
+
+// Make the environment variables describing a message for the program.
+func programEnv(m *Msg) []string {
+	env := []string{
+		"NOTIFY_SEVERITY=" + m.Severity.String(),
+		"NOTIFY_TIME=" + m.Time.Format(date_time_FORMAT),
+		"NOTIFY_TEXT=" + m.Text,
+	}
+	for k, v := range m.Fields {
+		env = append(env, "NOTIFY_"+strings.ToUpper(k)+"="+v)
+	}
+	return env
+}
+
+// An attachment belongs to a message if all fields of the attachment
+// match the fields of the message.
+func attachmentMatches(a, m *Msg) bool {
+	for k, v := range a.Fields {
+		if m.Fields[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func makeProgramInput(lines []string, abuf []*Msg) string {
+	var text string
+	for _, line := range lines {
+		text += line + "\n"
+	}
+	for _, a := range abuf {
+		text += ">" + strings.Replace(strings.TrimRight(a.Text, "\n"), "\n", "\n>", -1) + "\n"
+	}
+	return text
+}
+
+// Summarize a batch of messages to a single message: the worst severity,
+// the text of the first message with that severity and the fields which
+// are the same in all messages.
+func summarizeMsgs(mbuf []*Msg) *Msg {
+	sum := *mbuf[0]
+	sum.Fields = make(Fields)
+	for k, v := range mbuf[0].Fields {
+		sum.Fields[k] = v
+	}
+	for _, m := range mbuf[1:] {
+		if m.Severity < sum.Severity {
+			sum.Severity = m.Severity
+			sum.Text = m.Text
+		}
+		for k, v := range sum.Fields {
+			if m.Fields[k] != v {
+				delete(sum.Fields, k)
+			}
+		}
+	}
+	return &sum
+}
+
+func (n *Notifier) runProgram(st *outputStats, sem chan bool, command string, timeout time.Duration, env []string, input string) {
+	defer n.wg.Done()
+	defer func() { <-sem }()
+
+	var out bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// run in a process group of its own so that the whole group can be
+	// killed if the program hangs:
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err := cmd.Start()
+	if err != nil {
+		st.check(`error running program "`+command+`"`, err)
+		return
+	}
+	doneC := make(chan error, 1)
+	go func() {
+		doneC <- cmd.Wait()
+	}()
+	select {
+	case err = <-doneC:
+	case <-time.After(timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-doneC
+		err = errors.New("timed out after " + timeout.String())
+	}
+	if err != nil {
+		if o := strings.TrimSpace(out.String()); o != "" {
+			err = fmt.Errorf("%s: %s", err, strings.Replace(o, "\n", " ", -1))
+		}
+		st.check(`error running program "`+command+`"`, err)
+		return
+	}
+	st.success()
+}
+
+func (n *Notifier) loggerProgram(ch chan *Msg, st *outputStats, c *ProgramConfig, t *outputTemplates) {
+	defer n.wg.Done()
+	var mbuf []*Msg
+	var abuf []*Msg
+
+	host, err := os.Hostname()
+	checkInternalError("error getting host name", err)
+
+	// limits the number of programs running at the same time:
+	sem := make(chan bool, c.MaxProcs)
+
+	run := func(env []string, mbuf, abuf []*Msg) {
+		lines := t.formatLines(host, mbuf, (*Msg).String)
+		input := t.formatBody(t.data(host, "", mbuf, abuf, lines), func() string {
+			return makeProgramInput(lines, abuf)
+		})
+		sem <- true
+		n.wg.Add(1)
+		go n.runProgram(st, sem, c.Command, c.Timeout, env, input)
+	}
+	flush := func() {
+		if len(mbuf) == 0 {
+			return
+		}
+		if c.Batch {
+			env := programEnv(summarizeMsgs(mbuf))
+			env = append(env, "NOTIFY_COUNT="+strconv.Itoa(len(mbuf)))
+			run(env, mbuf, abuf)
+		} else {
+			for _, m := range mbuf {
+				var attachments []*Msg
+				for _, a := range abuf {
+					if attachmentMatches(a, m) {
+						attachments = append(attachments, a)
+					}
+				}
+				run(programEnv(m), []*Msg{m}, attachments)
+			}
+		}
+		mbuf, abuf = nil, nil
+	}
+
+	for m := range ch {
+		switch m.MsgType {
+		case MSGTYPE_MESSAGE:
+			mbuf = append(mbuf, m)
+		case MSGTYPE_ATTACHMENT:
+			abuf = append(abuf, m)
+		case MSGTYPE_FLUSH:
+			flush()
+		}
+	}
+	// exiting, run the program for the last messages:
+	flush()
+}
+
+// AddLoggerProgram adds a logging output which runs an external program
+// (with "/bin/sh -c") whenever Flush() is called. If batch is true, the
+// program is run once for all messages since the previous flush, otherwise
+// it is run once for each message. The severity, time and text of the
+// message as well as the message fields are passed in environment variables
+// NOTIFY_SEVERITY, NOTIFY_TIME, NOTIFY_TEXT, NOTIFY_POOL etc. The messages
+// and related attachments are written to the standard input of the
+// program. The program is killed if it runs longer than timeout and at most
+// maxprocs programs are run at the same time.
+func (n *Notifier) AddLoggerProgram(s Severity, command string, batch bool, timeout time.Duration, maxprocs int) error {
+	return n.AddLoggerProgramConfig(s, ProgramConfig{
+		Command:  command,
+		Batch:    batch,
+		Timeout:  timeout,
+		MaxProcs: maxprocs,
+	})
+}
+
+// AddLoggerProgramConfig is like AddLoggerProgram but the settings are
+// given in ProgramConfig, which also allows templates for the standard
+// input of the program.
+func (n *Notifier) AddLoggerProgramConfig(s Severity, c ProgramConfig) error {
+	switch {
+	case s < severity_MIN || s > SEVERITY_NONE:
+		return errors.New(`invalid "severity"`)
+	case c.Command == "":
+		return errors.New(`"command" not defined`)
+	case c.MaxProcs < 0:
+		return errors.New(`invalid "maxprocs"`)
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = program_TIMEOUT
+	}
+	if c.MaxProcs == 0 {
+		c.MaxProcs = program_MAXPROCS
+	}
+	t, err := n.newOutputTemplates(c.Template)
+	if err != nil {
+		return err
+	}
+	ch := make(chan *Msg, chan_SIZE)
+	st := newOutputStats("program")
+	n.wg.Add(1)
+	go n.loggerProgram(ch, st, &c, t)
+	n.addOutput(notifyOutput{severity: s, ch: ch, attachment: true, flush: true, stats: st})
+	return nil
+}
+
+// eof
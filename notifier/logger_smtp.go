@@ -22,152 +22,261 @@
 package notifier
 
 import (
+	"crypto/tls"
 	"errors"
 	"github.com/snabb/smtp"
 	"net"
+	"net/textproto"
+	"os"
 	"strings"
 	"time"
 )
 
-func (n *Notifier) sendEmailSMTP(server, username, password, from, to, subject, text string) {
-	defer n.wg.Done()
-	var auth smtp.Auth
+const smtp_TIMEOUT = 60 * time.Second
+
+// SMTPConfig defines the settings of an e-mail logging output.
+type SMTPConfig struct {
+	Server   string        // host name or address followed by colon and port
+	Username string        // user name for authentication (optional)
+	Password string        // password for authentication
+	Auth     string        // "plain" (default) or "cram-md5"
+	TLS      string        // "auto", "starttls", "tls" or "none", see below
+	CAFile   string        // CA certificates for verifying the server (optional)
+	Insecure bool          // do not verify the server certificate
+	From     string        // sender address
+	To       string        // recipient addresses separated by spaces
+	Subject  string        // subject, the severity is appended to it
+	HTML     bool          // send multipart MIME with HTML and attachments
+	Throttle time.Duration // minimum time between e-mails
+	Spool    SpoolConfig   // disk spool (optional)
+	Template TemplateConfig
+}
+
+// Authentication which regards the connection as encrypted also when
+// implicit TLS is used, as the smtp package only knows about STARTTLS.
+type smtpTLSAuth struct {
+	smtp.Auth
+	tls bool
+}
+
+func (a *smtpTLSAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	si := *server
+	si.TLS = si.TLS || a.tls
+	return a.Auth.Start(&si)
+}
+
+// Make the TLS settings. The server certificate is verified against the
+// CA file or, if there is none, the system roots.
+func smtpTLSConfig(c *SMTPConfig, host string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: host, InsecureSkipVerify: c.Insecure}
+	if c.CAFile != "" {
+		var err error
+		if tlsConfig.RootCAs, err = loadCAFile(c.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	return tlsConfig, nil
+}
+
+// Send one e-mail message according to the transport settings.
+func sendMailSMTP(c *SMTPConfig, tlsConfig *tls.Config, auth smtp.Auth, msg []byte) error {
+	var conn net.Conn
+	var err error
+
+	dialer := &net.Dialer{Timeout: smtp_TIMEOUT}
+	if c.TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.Server, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", c.Server)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(smtp_TIMEOUT))
 
-	text = "From: " + from + "\r\n" +
-		"To: " + strings.Join(strings.Fields(to), ", ") + "\r\n" +
-		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
-		"Subject: " + subject + "\r\n" +
-		"\r\n" + strings.Replace(text, "\n", "\r\n", -1) + "\r\n"
+	client, err := smtp.NewClient(conn, tlsConfig.ServerName)
+	if err != nil {
+		return err
+	}
+	encrypted := c.TLS == "tls"
+	if c.TLS == "auto" || c.TLS == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err = client.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+			encrypted = true
+		} else if c.TLS == "starttls" {
+			return errors.New("server does not support STARTTLS")
+		}
+	}
+	if auth != nil {
+		if ok, _ := client.Extension("AUTH"); ok {
+			if err = client.Auth(&smtpTLSAuth{auth, encrypted}); err != nil {
+				return err
+			}
+		}
+	}
+	if err = client.Mail(c.From); err != nil {
+		return err
+	}
+	for _, addr := range strings.Fields(c.To) {
+		if err = client.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
 
-	if username != "" {
-		host, _, err := net.SplitHostPort(server)
-		checkInternalError("error parsing mail host:port", err)
-		auth = smtp.PlainAuth("", username, password, host)
+// Permanent errors (5xx replies) are not retried.
+func smtpRetryable(err error) bool {
+	if e, ok := err.(*textproto.Error); ok && e.Code >= 500 {
+		return false
 	}
+	return true
+}
+
+func (n *Notifier) sendEmailSMTP(st *outputStats, c *SMTPConfig, tlsConfig *tls.Config, auth smtp.Auth, msg []byte) {
+	defer n.wg.Done()
+
 	for retries := 0; true; retries++ {
-		err := smtp.SendMail(server, auth, from, strings.Fields(to), []byte(text))
+		err := sendMailSMTP(c, tlsConfig, auth, msg)
 		if err == nil {
+			st.success()
 			break
 		}
 		if retries < 3 {
-			checkInternalError("error sending mail (retrying)", err)
+			st.retrying("error sending mail (retrying)", err)
 			time.Sleep(retry_SLEEP * time.Millisecond)
 		} else {
-			checkInternalError("error sending mail (giving up)", err)
+			st.check("error sending mail (giving up)", err)
 			break
 		}
 	}
 }
 
-func makeEmailText(mbuf, abuf []string) (text string) {
-	if mbuf != nil {
-		text += strings.Join(mbuf, "\n")
-		text += "\n"
-		mbuf = nil
-	}
-	if abuf != nil {
-		text += strings.Join(abuf, "\n")
-		text += "\n"
-		abuf = nil
-	}
-	return text
-}
-
-func (n *Notifier) loggerEmailSMTP(ch chan *Msg, server, username, password, from, to, subject string, throttle time.Duration) {
+func (n *Notifier) loggerEmailSMTP(ch chan *Msg, st *outputStats, sp *spool, c *SMTPConfig, t *outputTemplates, tlsConfig *tls.Config, auth smtp.Auth) {
 	defer n.wg.Done()
-	var mbuf []string
-	var abuf []string
-	var lastFlush time.Time
-	var throttleTimer *time.Timer
 
-	severityTrack := DEBUG
+	host, err := os.Hostname()
+	checkInternalError("error getting host name", err)
 
-	for {
-		var throttleC <-chan time.Time
-
-		if throttleTimer != nil {
-			throttleC = throttleTimer.C
-		}
-		var m *Msg
-		var ok bool
-
-		select {
-		case m, ok = <-ch:
-			// nothing
-		case <-throttleC:
-			m = &Msg{MsgType: MSGTYPE_FLUSH}
-			ok = true
+	throttledFlushLoop(ch, c.Throttle, func(mbuf, abuf []*Msg) {
+		lines := t.formatLines(host, mbuf, (*Msg).TimeString)
+		d := t.data(host, c.Subject, mbuf, abuf, lines)
+		// the worst severity within the batch of messages:
+		subject := t.formatSubject(d, c.Subject+" ["+summarizeMsgs(mbuf).Severity.String()+"]")
+		text, templated := t.executeBody(d)
+		if !templated {
+			text = makeEmailText(lines, abuf)
 		}
-		if !ok {
-			break
+		msg, err := makeEmail(host, c.From, c.To, subject, text, templated, c.HTML, mbuf, abuf)
+		if err != nil {
+			st.check("error making mail", err)
+			return
 		}
-		switch m.MsgType {
-		case MSGTYPE_MESSAGE:
-			mbuf = append(mbuf, m.TimeString())
-			if m.Severity < severityTrack {
-				// keep track of worst severity within a batch of messages
-				severityTrack = m.Severity
-			}
-		case MSGTYPE_ATTACHMENT:
-			abuf = append(abuf, ">"+
-				strings.Replace(strings.TrimRight(m.Text, "\n"), "\n", "\n>", -1)+"\n")
-		case MSGTYPE_FLUSH:
-			if len(mbuf) == 0 && len(abuf) == 0 {
-				continue
-			}
-			text := makeEmailText(mbuf, abuf)
-			if text == "" {
-				continue
-			}
-			if throttle != 0 && time.Since(lastFlush) < throttle {
-				if throttleTimer == nil {
-					throttleTimer = time.NewTimer(throttle - time.Since(lastFlush))
-				}
-				continue
-			}
-			mbuf, abuf = nil, nil
-			sevsubject := subject + " [" + severityTrack.String() + "]"
-			severityTrack = DEBUG
-			lastFlush = time.Now()
-			if throttleTimer != nil {
-				throttleTimer.Stop()
-				throttleTimer = nil
-			}
-			n.wg.Add(1)
-			go n.sendEmailSMTP(server, username, password, from, to, sevsubject, text)
+		if sp != nil {
+			sp.add(msg)
+			return
 		}
-	}
-	// exiting
-	if throttleTimer != nil {
-		throttleTimer.Stop()
-	}
-	// send the last entries:
-	if text := makeEmailText(mbuf, abuf); text != "" {
-		sevsubject := subject + " [" + severityTrack.String() + "]"
 		n.wg.Add(1)
-		go n.sendEmailSMTP(server, username, password, from, to, sevsubject, text)
-	}
+		go n.sendEmailSMTP(st, c, tlsConfig, auth, msg)
+	})
+	sp.close()
 }
 
 // AddLoggerEmailSMTP adds an e-mail logging output. The e-mails are sent
 // with ESMTP/SMTP whenever Flush() is called.
 func (n *Notifier) AddLoggerEmailSMTP(s Severity, server, user, pass, from, to, subject string, throttle time.Duration) error {
+	return n.AddLoggerEmailSMTPConfig(s, SMTPConfig{
+		Server:   server,
+		Username: user,
+		Password: pass,
+		From:     from,
+		To:       to,
+		Subject:  subject,
+		Throttle: throttle,
+	})
+}
+
+// AddLoggerEmailSMTPConfig adds an e-mail logging output with the given
+// settings. The e-mails are sent with ESMTP/SMTP whenever Flush() is
+// called. The TLS setting "tls" connects with implicit TLS (usually port
+// 465), "starttls" requires STARTTLS, "auto" uses STARTTLS if the server
+// supports it and "none" never encrypts the connection. The default is
+// "tls" for port 465 and "auto" otherwise. The server certificate is
+// verified against CAFile or the system roots unless Insecure is set. If
+// a spool is
+// configured, the e-mails are retried until they are delivered or expire.
+func (n *Notifier) AddLoggerEmailSMTPConfig(s Severity, c SMTPConfig) error {
 	switch {
-	case s < severity_MIN || s > severity_MAX:
+	case s < severity_MIN || s > SEVERITY_NONE:
 		return errors.New(`invalid "severity"`)
-	case server == "":
+	case c.Server == "":
 		return errors.New(`"server" not defined`)
-	case from == "":
+	case c.From == "":
 		return errors.New(`"from" not defined`)
-	case to == "":
+	case c.To == "":
 		return errors.New(`"to" not defined`)
-	case subject == "":
+	case c.Subject == "":
 		return errors.New(`"subject" not defined`)
 	}
+	host, port, err := net.SplitHostPort(c.Server)
+	if err != nil {
+		return err
+	}
+	switch c.TLS {
+	case "":
+		c.TLS = "auto"
+		if port == "465" {
+			c.TLS = "tls"
+		}
+	case "auto", "starttls", "tls", "none":
+		// ok
+	default:
+		return errors.New(`invalid "tls"`)
+	}
+	tlsConfig, err := smtpTLSConfig(&c, host)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if c.Username != "" {
+		switch c.Auth {
+		case "", "plain":
+			auth = smtp.PlainAuth("", c.Username, c.Password, host)
+		case "cram-md5":
+			auth = smtp.CRAMMD5Auth(c.Username, c.Password)
+		default:
+			return errors.New(`invalid "auth"`)
+		}
+	}
+	t, err := n.newOutputTemplates(c.Template)
+	if err != nil {
+		return err
+	}
+	st := newOutputStats("smtp")
+	sp, err := n.newSpool(c.Spool, st, func(msg []byte) (bool, error) {
+		err := sendMailSMTP(&c, tlsConfig, auth, msg)
+		return smtpRetryable(err), err
+	})
+	if err != nil {
+		return err
+	}
 	ch := make(chan *Msg, chan_SIZE)
 	n.wg.Add(1)
-	go n.loggerEmailSMTP(ch, server, user, pass, from, to, subject, throttle)
-	n.out = append(n.out, notifyOutput{severity: s, ch: ch, attachment: true, flush: true})
+	go n.loggerEmailSMTP(ch, st, sp, &c, t, tlsConfig, auth)
+	n.addOutput(notifyOutput{severity: s, ch: ch, attachment: true, flush: true, stats: st, spool: sp})
 	return nil
 }
 
@@ -0,0 +1,165 @@
+//
+// logger_smtp_test.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package notifier
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Make a self-signed certificate for 127.0.0.1.
+func makeTestCert(t *testing.T) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "zfswatcher test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// A minimal SMTP server which offers STARTTLS and accepts one message.
+func fakeSMTPServer(t *testing.T, cert tls.Certificate) (string, chan bool) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivered := make(chan bool, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("220 test ESMTP\r\n"))
+		var data, tlsOn bool
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if data {
+				if line == ".\r\n" {
+					data = false
+					delivered <- true
+					conn.Write([]byte("250 ok\r\n"))
+				}
+				continue
+			}
+			switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+			case "EHLO":
+				if tlsOn {
+					conn.Write([]byte("250 test\r\n"))
+				} else {
+					conn.Write([]byte("250-test\r\n250 STARTTLS\r\n"))
+				}
+			case "STARTTLS":
+				conn.Write([]byte("220 go ahead\r\n"))
+				tc := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+				if tc.Handshake() != nil {
+					return
+				}
+				conn, r, tlsOn = tc, bufio.NewReader(tc), true
+			case "DATA":
+				data = true
+				conn.Write([]byte("354 go ahead\r\n"))
+			case "QUIT":
+				conn.Write([]byte("221 bye\r\n"))
+				return
+			default:
+				conn.Write([]byte("250 ok\r\n"))
+			}
+		}
+	}()
+	return l.Addr().String(), delivered
+}
+
+func TestSMTPAutoTLSVerify(t *testing.T) {
+	cert, certPEM := makeTestCert(t)
+	f, err := ioutil.TempFile("", "zfswatcher-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(certPEM)
+	f.Close()
+
+	for _, tt := range []struct {
+		name     string
+		cafile   string
+		insecure bool
+		ok       bool
+	}{
+		{"auto without cafile", "", false, false},
+		{"auto with cafile", f.Name(), false, true},
+		{"auto with insecureskipverify", "", true, true},
+	} {
+		addr, delivered := fakeSMTPServer(t, cert)
+		c := &SMTPConfig{Server: addr, TLS: "auto", CAFile: tt.cafile, Insecure: tt.insecure,
+			From: "zfswatcher@example.com", To: "root@example.com"}
+		tlsConfig, err := smtpTLSConfig(c, "127.0.0.1")
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		err = sendMailSMTP(c, tlsConfig, nil, []byte("Subject: test\r\n\r\ntest\r\n"))
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("%s: %s", tt.name, err)
+		case !tt.ok && err == nil:
+			t.Errorf("%s: the self-signed certificate was accepted", tt.name)
+		case !tt.ok && len(delivered) > 0:
+			t.Errorf("%s: the message was delivered", tt.name)
+		}
+	}
+}
+
+// eof
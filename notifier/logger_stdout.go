@@ -24,17 +24,25 @@ package notifier
 import (
 	"errors"
 	"fmt"
-	"strings"
+	"os"
 )
 
-func (n *Notifier) loggerStdout(ch chan *Msg) {
+// StdoutConfig defines the settings of a standard output logging output.
+type StdoutConfig struct {
+	JSON     bool // write JSON Lines instead of text
+	Template TemplateConfig
+}
+
+func (n *Notifier) loggerStdout(ch chan *Msg, c *StdoutConfig, t *outputTemplates) {
 	defer n.wg.Done()
+
+	host, err := os.Hostname()
+	checkInternalError("error getting host name", err)
+
 	for m := range ch {
 		switch m.MsgType {
-		case MSGTYPE_MESSAGE:
-			fmt.Println(m.String())
-		case MSGTYPE_ATTACHMENT:
-			fmt.Println(">" + strings.Replace(strings.TrimRight(m.Text, "\n"), "\n", "\n>", -1))
+		case MSGTYPE_MESSAGE, MSGTYPE_ATTACHMENT:
+			fmt.Print(formatLogEntry(m, c.JSON, t, host))
 		}
 	}
 }
@@ -42,14 +50,24 @@ func (n *Notifier) loggerStdout(ch chan *Msg) {
 // AddLoggerStdout adds a logger which outputs to the standard output.
 // This can be useful for running a program in debugging mode.
 func (n *Notifier) AddLoggerStdout(s Severity) error {
+	return n.AddLoggerStdoutConfig(s, StdoutConfig{})
+}
+
+// AddLoggerStdoutConfig adds a logger which outputs to the standard output
+// in text or JSON Lines format.
+func (n *Notifier) AddLoggerStdoutConfig(s Severity, c StdoutConfig) error {
 	switch {
 	case s < severity_MIN || s > severity_MAX:
 		return errors.New(`invalid "severity"`)
 	}
+	t, err := n.newOutputTemplates(c.Template)
+	if err != nil {
+		return err
+	}
 	ch := make(chan *Msg, chan_SIZE)
 	n.wg.Add(1)
-	go n.loggerStdout(ch)
-	n.out = append(n.out, notifyOutput{severity: s, ch: ch, attachment: true})
+	go n.loggerStdout(ch, &c, t)
+	n.addOutput(notifyOutput{severity: s, ch: ch, attachment: true, stats: newOutputStats("stdout")})
 	return nil
 }
 
@@ -22,119 +22,234 @@
 package notifier
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"os"
 	"path"
 	"strings"
+	"syscall"
 	"time"
 )
 
-// This implements the BSD style syslog protocol.
+// This implements the BSD style (RFC 3164) and the RFC 5424 syslog
+// protocols over UDP, TCP, TLS and local UNIX sockets.
 
-func connectSyslog(address string) (net.Conn, bool, error) {
-	conntype := "udp"
-	sep := false // this is needed later if SOCK_STREAM connections are implemented
+const (
+	syslog_QUEUE_SIZE    = 1000             // messages buffered while disconnected
+	syslog_RETRY_MAX     = time.Minute      // maximum reconnect interval
+	syslog_WRITE_TIMEOUT = 10 * time.Second // for stream sockets
+)
 
-	if strings.Index(address, "/") != -1 {
-		conntype = "unixgram" // XXX should try different types?
-	}
-	var c net.Conn
-	var err error
+// How messages are separated in the connection.
+type syslogFraming int
+
+const (
+	syslog_FRAMING_DATAGRAM syslogFraming = iota // one message per datagram
+	syslog_FRAMING_NEWLINE                       // terminated by newline
+	syslog_FRAMING_OCTET                         // RFC 6587 octet counting
+)
+
+// SyslogConfig defines the settings of a syslog logging output.
+type SyslogConfig struct {
+	// Address is a local UNIX socket path such as "/dev/log", "host:port"
+	// for UDP or "udp://host:port", "tcp://host:port" or "tls://host:port".
+	Address  string
+	Facility SyslogFacility
+	RFC5424  bool   // use RFC 5424 message format instead of the BSD format
+	CAFile   string // CA certificates for verifying a TLS server (optional)
+	Insecure bool   // do not verify the TLS server certificate
+}
 
-	for retries := 0; true; retries++ {
-		c, err = net.Dial(conntype, address)
+func connectSyslog(address string, tlsConfig *tls.Config) (net.Conn, syslogFraming, error) {
+	switch {
+	case strings.HasPrefix(address, "udp://"):
+		c, err := net.Dial("udp", address[len("udp://"):])
+		return c, syslog_FRAMING_DATAGRAM, err
+	case strings.HasPrefix(address, "tcp://"):
+		c, err := net.DialTimeout("tcp", address[len("tcp://"):], syslog_WRITE_TIMEOUT)
+		return c, syslog_FRAMING_OCTET, err
+	case strings.HasPrefix(address, "tls://"):
+		dialer := &net.Dialer{Timeout: syslog_WRITE_TIMEOUT}
+		c, err := tls.DialWithDialer(dialer, "tcp", address[len("tls://"):], tlsConfig)
+		return c, syslog_FRAMING_OCTET, err
+	case strings.Index(address, "/") != -1:
+		c, err := net.Dial("unixgram", address)
 		if err == nil {
-			break
+			return c, syslog_FRAMING_DATAGRAM, nil
 		}
-		if retries < 3 {
-			checkInternalError("error connecting syslog socket (retrying)", err)
-			time.Sleep(retry_SLEEP * time.Millisecond)
-		} else {
-			checkInternalError("error connecting syslog socket (giving up)", err)
-			break
+		// some syslog daemons listen on a stream socket:
+		if oe, ok := err.(*net.OpError); ok {
+			if se, ok := oe.Err.(*os.SyscallError); ok && se.Err == syscall.EPROTOTYPE {
+				c, err = net.Dial("unix", address)
+				return c, syslog_FRAMING_NEWLINE, err
+			}
+		}
+		return nil, syslog_FRAMING_DATAGRAM, err
+	}
+	c, err := net.Dial("udp", address)
+	return c, syslog_FRAMING_DATAGRAM, err
+}
+
+// Format a message for sending.
+func makeSyslogFrame(m *Msg, c *SyslogConfig, framing syslogFraming, hostname, tag string) []byte {
+	var str string
+	if c.RFC5424 {
+		str = m.Syslog5424String(c.Facility, hostname, path.Base(os.Args[0]), os.Getpid())
+	} else {
+		str = m.SyslogString(c.Facility, tag)
+	}
+	buf := []byte(str)
+	switch framing {
+	case syslog_FRAMING_DATAGRAM:
+		max := 1024
+		if c.RFC5424 {
+			max = 2048
+		}
+		if len(buf) > max {
+			buf = buf[:max]
 		}
+	case syslog_FRAMING_NEWLINE:
+		buf = append(buf, '\n')
+	case syslog_FRAMING_OCTET:
+		buf = append([]byte(fmt.Sprintf("%d ", len(buf))), buf...)
 	}
-	return c, sep, err
+	return buf
 }
 
-func (n *Notifier) loggerSyslog(ch chan *Msg, address string, facility SyslogFacility) {
+func (n *Notifier) loggerSyslog(ch chan *Msg, st *outputStats, c *SyslogConfig, tlsConfig *tls.Config) {
 	defer n.wg.Done()
 	tag := fmt.Sprintf("%s[%d]", path.Base(os.Args[0]), os.Getpid())
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
 
-	var c net.Conn
-	var sep bool
-	var err error
-	var connected bool = false
+	var conn net.Conn
+	var framing syslogFraming
+	var queue []*Msg // messages waiting to be sent
+	var retryTimer *time.Timer
+	retryDelay := retry_SLEEP * time.Millisecond
 
-	c, sep, err = connectSyslog(address)
-	if err == nil {
-		connected = true
+	disconnect := func() {
+		if conn != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+	// send the queued messages, returns false if there was an error:
+	send := func() bool {
+		if conn == nil && len(queue) > 0 {
+			conn, framing, err = connectSyslog(c.Address, tlsConfig)
+			if err != nil {
+				conn = nil
+				st.check("error connecting syslog socket", err)
+				return false
+			}
+		}
+		for len(queue) > 0 {
+			if framing != syslog_FRAMING_DATAGRAM {
+				conn.SetWriteDeadline(time.Now().Add(syslog_WRITE_TIMEOUT))
+			}
+			_, err = conn.Write(makeSyslogFrame(queue[0], c, framing, hostname, tag))
+			if err != nil {
+				st.check("error writing to syslog socket", err)
+				disconnect()
+				return false
+			}
+			queue = queue[1:]
+			st.success()
+		}
+		return true
 	}
 
-	for m := range ch {
-		switch m.MsgType {
-		case MSGTYPE_MESSAGE:
-			buf := []byte(m.SyslogString(facility, tag))
-
-			if sep {
-				if len(buf) > 1023 {
-					buf = buf[:1022]
-				}
-				buf = append(buf, '\n')
-			} else {
-				if len(buf) > 1024 {
-					buf = buf[:1023]
-				}
+LOOP:
+	for {
+		var retryC <-chan time.Time
+		if retryTimer != nil {
+			retryC = retryTimer.C
+		}
+		select {
+		case m, ok := <-ch:
+			if !ok {
+				break LOOP
 			}
-			for retries := 0; retries < 2; retries++ {
-				if connected {
-					_, err = c.Write(buf)
-					if err == nil {
-						break
-					}
-					checkInternalError("error writing to syslog socket", err)
-					// try to reopen the socket if there was error:
-					c.Close()
-					connected = false
-				}
-				c, sep, err = connectSyslog(address)
-				if err == nil {
-					connected = true
+			switch m.MsgType {
+			case MSGTYPE_MESSAGE:
+				if len(queue) >= syslog_QUEUE_SIZE {
+					// drop the oldest message
+					queue = queue[1:]
+					st.dropped()
 				}
+				queue = append(queue, m)
+			case MSGTYPE_REOPEN:
+				disconnect()
 			}
-		case MSGTYPE_REOPEN:
-			if connected {
-				c.Close()
-				connected = false
-			}
-			c, sep, err = connectSyslog(address)
-			if err == nil {
-				connected = true
+		case <-retryC:
+			retryTimer = nil
+		}
+		if retryTimer != nil {
+			continue // waiting before reconnecting
+		}
+		if send() {
+			retryDelay = retry_SLEEP * time.Millisecond
+		} else {
+			retryTimer = time.NewTimer(retryDelay)
+			retryDelay *= 2
+			if retryDelay > syslog_RETRY_MAX {
+				retryDelay = syslog_RETRY_MAX
 			}
 		}
 	}
-	if connected {
-		c.Close()
-		connected = false
+	// exiting, try once more to send what is left:
+	if retryTimer != nil {
+		retryTimer.Stop()
+	}
+	if !send() && len(queue) > 0 {
+		checkInternalError("error sending syslog messages",
+			fmt.Errorf("%d messages lost", len(queue)))
 	}
+	disconnect()
 }
 
-// AddLoggerSyslog adds a Unix syslog logging output.
+// AddLoggerSyslog adds a Unix syslog logging output using the BSD style
+// syslog protocol.
 func (n *Notifier) AddLoggerSyslog(s Severity, address string, facility SyslogFacility) error {
+	return n.AddLoggerSyslogConfig(s, SyslogConfig{Address: address, Facility: facility})
+}
+
+// AddLoggerSyslogConfig adds a syslog logging output. Messages are
+// buffered while the syslog server can not be reached.
+func (n *Notifier) AddLoggerSyslogConfig(s Severity, c SyslogConfig) error {
 	switch {
 	case s < severity_MIN || s > severity_MAX:
 		return errors.New(`invalid "severity"`)
-	case address == "":
+	case c.Address == "":
 		return errors.New(`"address" not defined`)
-	case facility < syslog_FACILITY_MIN || facility > syslog_FACILITY_MAX:
+	case c.Facility < syslog_FACILITY_MIN || c.Facility > syslog_FACILITY_MAX:
 		return errors.New(`invalid "facility"`)
 	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.Insecure}
+	if strings.HasPrefix(c.Address, "tls://") {
+		host, _, err := net.SplitHostPort(c.Address[len("tls://"):])
+		if err != nil {
+			return err
+		}
+		tlsConfig.ServerName = host
+	}
+	if c.CAFile != "" {
+		var err error
+		tlsConfig.RootCAs, err = loadCAFile(c.CAFile)
+		if err != nil {
+			return err
+		}
+	}
 	ch := make(chan *Msg, chan_SIZE)
+	st := newOutputStats("syslog")
 	n.wg.Add(1)
-	go n.loggerSyslog(ch, address, facility)
-	n.out = append(n.out, notifyOutput{severity: s, ch: ch})
+	go n.loggerSyslog(ch, st, &c, tlsConfig)
+	n.addOutput(notifyOutput{severity: s, ch: ch, stats: st})
 	return nil
 }
 
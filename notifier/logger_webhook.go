@@ -0,0 +1,358 @@
+//
+// logger_webhook.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package notifier
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Defaults used if zero values are given in WebhookConfig.
+const (
+	webhook_TIMEOUT = 30 * time.Second
+	webhook_RETRIES = 5
+)
+
+// WebhookConfig defines the settings of a webhook logging output.
+type WebhookConfig struct {
+	URL      string            // where the messages are POSTed
+	Batch    bool              // send all messages of a flush in one request
+	Headers  map[string]string // additional HTTP headers
+	Secret   string            // key for HMAC-SHA256 signature (optional)
+	CAFile   string            // CA certificates for verifying the server (optional)
+	CertFile string            // client certificate (optional)
+	KeyFile  string            // client certificate key (optional)
+	Insecure bool              // do not verify the server certificate
+	Timeout  time.Duration     // timeout of a single request
+	Retries  int               // number of attempts before giving up
+	Throttle time.Duration     // minimum time between flushes
+	Spool    SpoolConfig       // disk spool (optional)
+}
+
+// The JSON payload of a webhook request.
+type webhookMsg struct {
+	Time     time.Time `json:"time"`
+	Severity string    `json:"severity"`
+	Text     string    `json:"text"`
+	Fields   Fields    `json:"fields,omitempty"`
+}
+
+type webhookPayload struct {
+	Host        string       `json:"host"`
+	Time        time.Time    `json:"time"`
+	Severity    string       `json:"severity"` // the worst severity
+	Text        string       `json:"text"`     // the text of the worst message
+	Fields      Fields       `json:"fields,omitempty"`
+	Count       int          `json:"count"`
+	Messages    []webhookMsg `json:"messages"`
+	Attachments []webhookMsg `json:"attachments,omitempty"`
+}
+
+func makeWebhookMsgs(mbuf []*Msg) []webhookMsg {
+	var wms []webhookMsg
+	for _, m := range mbuf {
+		wms = append(wms, webhookMsg{
+			Time:     m.Time,
+			Severity: m.Severity.String(),
+			Text:     m.Text,
+			Fields:   m.Fields,
+		})
+	}
+	return wms
+}
+
+func makeWebhookPayload(host string, mbuf, abuf []*Msg) ([]byte, error) {
+	sum := summarizeMsgs(mbuf)
+	p := webhookPayload{
+		Host:        host,
+		Time:        sum.Time,
+		Severity:    sum.Severity.String(),
+		Text:        sum.Text,
+		Fields:      sum.Fields,
+		Count:       len(mbuf),
+		Messages:    makeWebhookMsgs(mbuf),
+		Attachments: makeWebhookMsgs(abuf),
+	}
+	return json.Marshal(&p)
+}
+
+// Make the HTTP client according to the TLS settings.
+func makeWebhookClient(c *WebhookConfig) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.Insecure}
+	if c.CAFile != "" {
+		var err error
+		tlsConfig.RootCAs, err = loadCAFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+		Timeout: c.Timeout,
+	}, nil
+}
+
+// Post the payload once. Returns true if the request may be retried.
+func postWebhook(client *http.Client, c *WebhookConfig, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+	if c.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(c.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	return false, fmt.Errorf("HTTP status %s", resp.Status)
+}
+
+func sendWebhook(st *outputStats, client *http.Client, c *WebhookConfig, body []byte) {
+	delay := retry_SLEEP * time.Millisecond
+	for retries := 1; true; retries++ {
+		retry, err := postWebhook(client, c, body)
+		if err == nil {
+			st.success()
+			break
+		}
+		if retry && retries < c.Retries {
+			st.retrying("error sending webhook (retrying)", err)
+			time.Sleep(delay)
+			delay *= 2
+		} else {
+			st.check("error sending webhook (giving up)", err)
+			break
+		}
+	}
+}
+
+// Gather messages and attachments and call send with them whenever Flush()
+// is called, but no more often than throttle allows. Returns when the
+// channel is closed.
+func throttledFlushLoop(ch chan *Msg, throttle time.Duration, send func(mbuf, abuf []*Msg)) {
+	var mbuf []*Msg
+	var abuf []*Msg
+	var lastFlush time.Time
+	var throttleTimer *time.Timer
+
+	for {
+		var throttleC <-chan time.Time
+
+		if throttleTimer != nil {
+			throttleC = throttleTimer.C
+		}
+		var m *Msg
+		var ok bool
+
+		select {
+		case m, ok = <-ch:
+			// nothing
+		case <-throttleC:
+			m = &Msg{MsgType: MSGTYPE_FLUSH}
+			ok = true
+		}
+		if !ok {
+			break
+		}
+		switch m.MsgType {
+		case MSGTYPE_MESSAGE:
+			mbuf = append(mbuf, m)
+		case MSGTYPE_ATTACHMENT:
+			abuf = append(abuf, m)
+		case MSGTYPE_FLUSH:
+			if len(mbuf) == 0 {
+				// the attachments without messages are never sent
+				abuf = nil
+				continue
+			}
+			if throttle != 0 && time.Since(lastFlush) < throttle {
+				if throttleTimer == nil {
+					throttleTimer = time.NewTimer(throttle - time.Since(lastFlush))
+				}
+				continue
+			}
+			lastFlush = time.Now()
+			if throttleTimer != nil {
+				throttleTimer.Stop()
+				throttleTimer = nil
+			}
+			send(mbuf, abuf)
+			mbuf, abuf = nil, nil
+		}
+	}
+	// exiting
+	if throttleTimer != nil {
+		throttleTimer.Stop()
+	}
+	// send the last entries:
+	if len(mbuf) != 0 {
+		send(mbuf, abuf)
+	}
+}
+
+// Send the request bodies in a goroutine of their own, in order, or add
+// them to the spool.
+func (n *Notifier) sendWebhooks(st *outputStats, sp *spool, client *http.Client, c *WebhookConfig, bodies [][]byte) {
+	if sp != nil {
+		for _, body := range bodies {
+			if body != nil {
+				sp.add(body)
+			}
+		}
+		return
+	}
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		for _, body := range bodies {
+			if body != nil {
+				sendWebhook(st, client, c, body)
+			}
+		}
+	}()
+}
+
+func (n *Notifier) loggerWebhook(ch chan *Msg, st *outputStats, sp *spool, client *http.Client, c *WebhookConfig) {
+	defer n.wg.Done()
+
+	host, err := os.Hostname()
+	checkInternalError("error getting host name", err)
+
+	throttledFlushLoop(ch, c.Throttle, func(mbuf, abuf []*Msg) {
+		var bodies [][]byte
+		if c.Batch {
+			body, err := makeWebhookPayload(host, mbuf, abuf)
+			checkInternalError("error making webhook payload", err)
+			bodies = append(bodies, body)
+		} else {
+			for _, m := range mbuf {
+				var attachments []*Msg
+				for _, a := range abuf {
+					if attachmentMatches(a, m) {
+						attachments = append(attachments, a)
+					}
+				}
+				body, err := makeWebhookPayload(host, []*Msg{m}, attachments)
+				checkInternalError("error making webhook payload", err)
+				bodies = append(bodies, body)
+			}
+		}
+		n.sendWebhooks(st, sp, client, c, bodies)
+	})
+	sp.close()
+}
+
+// Start the spool of a webhook output if it is configured.
+func (n *Notifier) newWebhookSpool(st *outputStats, client *http.Client, c *WebhookConfig) (*spool, error) {
+	return n.newSpool(c.Spool, st, func(body []byte) (bool, error) {
+		return postWebhook(client, c, body)
+	})
+}
+
+// Check the common settings and make the HTTP client.
+func checkWebhookConfig(c *WebhookConfig) (*http.Client, error) {
+	switch {
+	case c.URL == "":
+		return nil, errors.New(`"url" not defined`)
+	case c.Retries < 0:
+		return nil, errors.New(`invalid "retries"`)
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New(`invalid "url" scheme "` + u.Scheme + `"`)
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = webhook_TIMEOUT
+	}
+	if c.Retries == 0 {
+		c.Retries = webhook_RETRIES
+	}
+	return makeWebhookClient(c)
+}
+
+// AddLoggerWebhook adds a logging output which POSTs the messages as JSON
+// to a HTTP(S) URL whenever Flush() is called. Either each message is sent
+// in a request of its own or all messages since the previous flush are
+// sent in one request. If a secret is defined, the request is signed with
+// HMAC-SHA256 and the signature is sent in "X-Signature" header as
+// "sha256=" followed by the signature in hex.
+func (n *Notifier) AddLoggerWebhook(s Severity, c WebhookConfig) error {
+	if s < severity_MIN || s > SEVERITY_NONE {
+		return errors.New(`invalid "severity"`)
+	}
+	client, err := checkWebhookConfig(&c)
+	if err != nil {
+		return err
+	}
+	st := newOutputStats("webhook")
+	sp, err := n.newWebhookSpool(st, client, &c)
+	if err != nil {
+		return err
+	}
+	ch := make(chan *Msg, chan_SIZE)
+	n.wg.Add(1)
+	go n.loggerWebhook(ch, st, sp, client, &c)
+	n.addOutput(notifyOutput{severity: s, ch: ch, attachment: true, flush: true, stats: st, spool: sp})
+	return nil
+}
+
+// eof
@@ -0,0 +1,343 @@
+//
+// mail.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package notifier
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This implements composing the e-mail messages: either plain text or
+// multipart MIME with plain text and HTML alternatives and the pool status
+// as text file attachments.
+
+// Make an unique Message-ID header value.
+func makeMessageID(host string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "<" + strconv.FormatInt(time.Now().UnixNano(), 36) + "." +
+		hex.EncodeToString(b) + "@" + host + ">"
+}
+
+// Encode a header value as specified in RFC 2047 if it is not plain ASCII.
+func encodeMailHeader(s string) string {
+	return mime.QEncoding.Encode("utf-8", s)
+}
+
+func writeMailHeader(b *bytes.Buffer, header [][2]string) {
+	for _, h := range header {
+		b.WriteString(h[0] + ": " + h[1] + "\r\n")
+	}
+	b.WriteString("\r\n")
+}
+
+// Write text in quoted-printable encoding with CRLF line breaks.
+func writeQuotedPrintable(b *bytes.Buffer, text string) {
+	w := quotedprintable.NewWriter(b)
+	w.Write([]byte(text))
+	w.Close()
+}
+
+// The plain text version: the messages followed by the attachments.
+func makeEmailText(lines []string, abuf []*Msg) string {
+	var text string
+	for _, line := range lines {
+		text += line + "\n"
+	}
+	for _, a := range abuf {
+		text += ">" + strings.Replace(strings.TrimRight(a.Text, "\n"), "\n", "\n>", -1) + "\n"
+	}
+	return text
+}
+
+// Pool status formatted for the HTML version.
+type poolStatusInfo struct {
+	Key   string
+	Value string
+}
+
+type poolStatusDev struct {
+	Name   string
+	Indent int
+	State  string
+	Color  string
+	Rest   []string
+}
+
+type poolStatusHTML struct {
+	Pool   string
+	Info   []poolStatusInfo
+	Header []string
+	Devs   []poolStatusDev
+	Raw    string
+}
+
+// Colors of the device states in the pool configuration table.
+var devStateColors = map[string]string{
+	"ONLINE":   "#2e7d32",
+	"AVAIL":    "#2e7d32",
+	"INUSE":    "#2e7d32",
+	"DEGRADED": "#e8590c",
+	"FAULTED":  "#d00000",
+	"OFFLINE":  "#d00000",
+	"REMOVED":  "#d00000",
+	"UNAVAIL":  "#d00000",
+}
+
+var poolStatusKeyRegexp = regexp.MustCompile(`^ *([a-z]+): ?(.*)$`)
+
+// Parse "zpool status" output of a pool to a table. If the text can not
+// be parsed, only Raw is set and it is shown as it is.
+func parsePoolStatus(pool, text string) *poolStatusHTML {
+	ps := &poolStatusHTML{Pool: pool}
+	config := false
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		if config && strings.HasPrefix(line, "\t") {
+			line = line[1:]
+			f := strings.Fields(line)
+			if len(f) == 0 {
+				continue
+			}
+			if ps.Header == nil {
+				ps.Header = f
+				continue
+			}
+			dev := poolStatusDev{
+				Name:   f[0],
+				Indent: len(line) - len(strings.TrimLeft(line, " ")),
+			}
+			if len(f) > 1 {
+				dev.State = f[1]
+				dev.Color = devStateColors[f[1]]
+			}
+			if len(f) > 2 {
+				dev.Rest = f[2:]
+				if len(dev.Rest) > len(ps.Header)-2 {
+					// join additional information to one column:
+					n := len(ps.Header) - 2
+					if n < 0 {
+						n = 0
+					}
+					dev.Rest = append(dev.Rest[:n], strings.Join(dev.Rest[n:], " "))
+				}
+			}
+			ps.Devs = append(ps.Devs, dev)
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		if m := poolStatusKeyRegexp.FindStringSubmatch(line); m != nil {
+			config = m[1] == "config"
+			if !config {
+				ps.Info = append(ps.Info, poolStatusInfo{m[1], m[2]})
+			}
+			continue
+		}
+		if len(ps.Info) == 0 || config {
+			return &poolStatusHTML{Pool: pool, Raw: text}
+		}
+		// continuation line:
+		ps.Info[len(ps.Info)-1].Value += "\n" + strings.TrimSpace(line)
+	}
+	if ps.Header == nil {
+		return &poolStatusHTML{Pool: pool, Raw: text}
+	}
+	return ps
+}
+
+var emailHTMLTemplate = template.Must(template.New("email").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Subject}}</title>
+</head>
+<body style="font-family: sans-serif; font-size: 14px;">
+{{if .Body}}<pre>{{.Body}}</pre>
+{{else}}<table style="border-collapse: collapse;">
+{{range .Msgs}}<tr>
+<td style="padding: 2px 8px; white-space: nowrap;">{{.Time}}</td>
+<td style="padding: 2px 8px; color: #ffffff; background-color: {{.Color}};">{{.Severity}}</td>
+<td style="padding: 2px 8px;">{{.Text}}</td>
+</tr>
+{{end}}</table>
+{{range .Pools}}{{if .Pool}}<h3>Pool {{.Pool}}</h3>{{else}}<h3>Details</h3>{{end}}
+{{if .Raw}}<pre>{{.Raw}}</pre>
+{{else}}<table style="border-collapse: collapse;">
+{{range .Info}}<tr>
+<th style="padding: 2px 8px; text-align: left; vertical-align: top;">{{.Key}}</th>
+<td style="padding: 2px 8px; white-space: pre-wrap;">{{.Value}}</td>
+</tr>
+{{end}}</table>
+<table style="border-collapse: collapse; margin-top: 8px; font-family: monospace;">
+<tr>{{range .Header}}<th style="padding: 2px 8px; text-align: left; border-bottom: 1px solid #999999;">{{.}}</th>{{end}}</tr>
+{{range .Devs}}<tr>
+<td style="padding: 2px 8px; text-indent: {{.Indent}}ch;">{{.Name}}</td>
+<td style="padding: 2px 8px;{{if .Color}} color: {{.Color}}; font-weight: bold;{{end}}">{{.State}}</td>
+{{range .Rest}}<td style="padding: 2px 8px;">{{.}}</td>{{end}}
+</tr>
+{{end}}</table>
+{{end}}{{end}}{{end}}<p style="color: #999999;">{{.Host}}</p>
+</body>
+</html>
+`))
+
+type emailHTMLMsg struct {
+	Time     string
+	Severity string
+	Color    string
+	Text     string
+}
+
+func makeEmailHTML(host, subject, body string, mbuf, abuf []*Msg) (string, error) {
+	var data struct {
+		Host    string
+		Subject string
+		Body    string
+		Msgs    []emailHTMLMsg
+		Pools   []*poolStatusHTML
+	}
+	data.Host = host
+	data.Subject = subject
+	data.Body = body
+	for _, m := range mbuf {
+		data.Msgs = append(data.Msgs, emailHTMLMsg{
+			Time:     m.Time.Format(date_time_FORMAT),
+			Severity: m.Severity.String(),
+			Color:    severityColors[m.Severity],
+			Text:     m.Text,
+		})
+	}
+	for _, a := range abuf {
+		data.Pools = append(data.Pools, parsePoolStatus(a.Fields["pool"], a.Text))
+	}
+	var b bytes.Buffer
+	err := emailHTMLTemplate.Execute(&b, &data)
+	return b.String(), err
+}
+
+// The file name of an attachment.
+func attachmentFileName(a *Msg) string {
+	if pool := a.Fields["pool"]; pool != "" {
+		return "zpool-status-" + pool + ".txt"
+	}
+	return "details.txt"
+}
+
+// Make a complete e-mail message with headers. If html is false, a plain
+// text message is made. If templated is true, the text is the output of
+// the body template and the HTML version shows it instead of the messages
+// and the pool status.
+func makeEmail(host, from, to, subject, text string, templated, html bool, mbuf, abuf []*Msg) ([]byte, error) {
+	var b bytes.Buffer
+
+	header := [][2]string{
+		{"From", from},
+		{"To", strings.Join(strings.Fields(to), ", ")},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Subject", encodeMailHeader(subject)},
+		{"Message-ID", makeMessageID(host)},
+		{"MIME-Version", "1.0"},
+	}
+
+	if !html {
+		writeMailHeader(&b, append(header,
+			[2]string{"Content-Type", "text/plain; charset=utf-8"},
+			[2]string{"Content-Transfer-Encoding", "quoted-printable"}))
+		writeQuotedPrintable(&b, text)
+		return b.Bytes(), nil
+	}
+	var templtext string
+	if templated {
+		templtext = text
+	}
+	htmltext, err := makeEmailHTML(host, subject, templtext, mbuf, abuf)
+	if err != nil {
+		return nil, err
+	}
+
+	// multipart/mixed containing multipart/alternative and attachments:
+	var body bytes.Buffer
+	mixed := multipart.NewWriter(&body)
+	var alt bytes.Buffer
+	altw := multipart.NewWriter(&alt)
+	for _, p := range []struct {
+		ctype string
+		text  string
+	}{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", htmltext},
+	} {
+		var pb bytes.Buffer
+		writeQuotedPrintable(&pb, p.text)
+		w, err := altw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.ctype},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		w.Write(pb.Bytes())
+	}
+	altw.Close()
+
+	w, err := mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + altw.Boundary()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.Write(alt.Bytes())
+
+	for _, a := range abuf {
+		name := attachmentFileName(a)
+		var pb bytes.Buffer
+		writeQuotedPrintable(&pb, a.Text)
+		w, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType("text/plain", map[string]string{"charset": "utf-8", "name": name})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		w.Write(pb.Bytes())
+	}
+	mixed.Close()
+
+	writeMailHeader(&b, append(header,
+		[2]string{"Content-Type", "multipart/mixed; boundary=" + mixed.Boundary()}))
+	b.Write(body.Bytes())
+	return b.Bytes(), nil
+}
+
+// eof
@@ -22,7 +22,10 @@
 package notifier
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -36,12 +39,20 @@ const (
 	MSGTYPE_REOPEN                    // re-open output file after log rotation etc
 )
 
+// Optional structured information about a message, such as the names of
+// the related pool ("pool") and device ("device") and the kind of the
+// event ("event").
+type Fields map[string]string
+
 // A single message.
 type Msg struct {
 	Time     time.Time
 	MsgType  MsgType
 	Severity Severity
 	Text     string
+	Fields   Fields       // may be nil
+	failed   int          // 1 + index of the failed output in failure reports
+	to       map[int]bool // the outputs of messages sent with SendFieldsTo
 }
 
 // String implements the fmt.Stringer interface. It returns the message as
@@ -57,6 +68,39 @@ func (m *Msg) Strings() (date_time string, severity string, text string) {
 	return m.Time.Format(date_time_FORMAT), m.Severity.String(), m.Text
 }
 
+// A message or an attachment as a JSON object.
+type jsonMsg struct {
+	Time       time.Time `json:"time"`
+	Severity   string    `json:"severity"`
+	Text       string    `json:"text,omitempty"`
+	Attachment string    `json:"attachment,omitempty"`
+	Fields     Fields    `json:"fields,omitempty"`
+}
+
+// JSONString returns the message or attachment as a JSON object on a
+// single line. The text of an attachment is in "attachment" instead of
+// "text". The attachments are separate objects because the logs are
+// written as the messages come, their fields tell which messages they
+// belong to (see attachmentMatches).
+func (m *Msg) JSONString() string {
+	jm := jsonMsg{
+		Time:     m.Time,
+		Severity: m.Severity.String(),
+		Fields:   m.Fields,
+	}
+	if m.MsgType == MSGTYPE_ATTACHMENT {
+		jm.Attachment = m.Text
+	} else {
+		jm.Text = m.Text
+	}
+	b, err := json.Marshal(&jm)
+	if err != nil {
+		// can not happen with these types
+		return fmt.Sprintf(`{"error":%q}`, err.Error())
+	}
+	return string(b)
+}
+
 // TimeString is like String() but omits the date from the output.
 func (m *Msg) TimeString() string {
 	return m.Time.Format(time_FORMAT) +
@@ -72,4 +116,37 @@ func (m *Msg) SyslogString(facility SyslogFacility, tag string) string {
 		m.Time.Format(time.Stamp), tag, m.Text)
 }
 
+// The SD-ID of the structured data element in RFC 5424 messages. The
+// number is the example enterprise number from RFC 5612.
+const syslog_SDID = "zfs@32473"
+
+var sdParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// Syslog5424String returns the message in RFC 5424 format. The message
+// fields are included as structured data and the "event" field is used
+// as MSGID.
+func (m *Msg) Syslog5424String(facility SyslogFacility, hostname, appname string, pid int) string {
+	msgid := "-"
+	if ev := m.Fields["event"]; ev != "" {
+		msgid = ev
+	}
+	sd := "-"
+	if len(m.Fields) > 0 {
+		var keys []string
+		for k := range m.Fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		sd = "[" + syslog_SDID
+		for _, k := range keys {
+			sd += " " + k + `="` + sdParamEscaper.Replace(m.Fields[k]) + `"`
+		}
+		sd += "]"
+	}
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		uint32(m.Severity)|(uint32(facility)<<3),
+		m.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		hostname, appname, pid, msgid, sd, m.Text)
+}
+
 // eof
@@ -44,10 +44,9 @@ const (
 // private
 
 func internalError(str string) {
-	// This is an internal error in the notifier library.
-	// What should be done with these errors?
-	// Right now we just write the errors to STDERR.
-	// This is not a good solution.
+	// This is an internal error in the notifier library. The errors
+	// are written to STDERR, failed deliveries are additionally
+	// reported to the other outputs (see SetOutputErrors).
 	fmt.Fprintf(os.Stderr, "%s [NOTIFIER] %s\n",
 		time.Now().Format(date_time_FORMAT), str)
 }
@@ -58,29 +57,85 @@ func checkInternalError(str string, err error) {
 	}
 }
 
+// Forward a message to an output.
+// The dispatcher never blocks, not even for the spooled outputs: they
+// write the spool in a goroutine of their own.
+func (out *notifyOutput) forward(m *Msg) {
+	select {
+	case out.ch <- m:
+		if m.MsgType == MSGTYPE_MESSAGE {
+			out.stats.message()
+		}
+	default:
+		checkInternalError("dispatcher error", errors.New("channel full"))
+		out.stats.dropped()
+	}
+}
+
+func (n *Notifier) dispatch(m *Msg) {
+	var outputs map[int]bool
+	switch {
+	case m.failed != 0:
+		m, outputs = n.errorReport(m)
+	case m.to != nil:
+		outputs = m.to
+	default:
+		m, outputs = n.route(m)
+	}
+	silenced := m.failed == 0 && n.silenced(m)
+	// forward the message to relevant loggers
+	for i := range n.out {
+		out := &n.out[i]
+		if m.MsgType == MSGTYPE_FLUSH && out.dedup != nil {
+			out.dedup.flush()
+		}
+		switch {
+		case outputs != nil && !outputs[i]:
+			continue
+		case silenced && out.flush:
+			continue
+		case m.MsgType == MSGTYPE_ATTACHMENT && out.attachment == false:
+			continue
+		case m.MsgType == MSGTYPE_FLUSH && out.flush == false:
+			continue
+		case m.to != nil:
+			// sent to the output directly, its level does not apply
+			out.forward(m)
+		case out.severity == SEVERITY_NONE && m.MsgType != MSGTYPE_FLUSH:
+			// the output only gets the messages sent to it directly
+			continue
+		case m.Severity <= out.severity:
+			// the zero value of Severity is EMERG, thus
+			// this always forwards messages with
+			// undefined severity
+			if out.dedup != nil && !out.dedup.check(m, out.stats) {
+				continue
+			}
+			out.forward(m)
+		}
+	}
+}
+
 func (n *Notifier) dispatcher() {
 	defer n.wg.Done()
-	// read messages from the input channel:
-	for m := range n.ch {
-		// forward the message to relevant loggers
-		for _, out := range n.out {
-			switch {
-			case m.MsgType == MSGTYPE_ATTACHMENT && out.attachment == false:
-				continue
-			case m.MsgType == MSGTYPE_FLUSH && out.flush == false:
-				continue
-			case m.Severity <= out.severity:
-				// the zero value of Severity is EMERG, thus
-				// this always forwards messages with
-				// undefined severity
-				select {
-				case out.ch <- m:
-				default:
-					checkInternalError("dispatcher error", errors.New("channel full"))
-				}
+	ticker := time.NewTicker(dedup_TICK)
+	defer ticker.Stop()
+LOOP:
+	for {
+		select {
+		// read messages from the input channel:
+		case m, ok := <-n.ch:
+			if !ok {
+				break LOOP
 			}
+			n.dispatch(m)
+		case now := <-ticker.C:
+			n.sendDigests(now, false)
+			n.sendSilenceSummaries(now)
 		}
 	}
+	// send the remaining digests before exiting:
+	n.sendDigests(time.Now(), true)
 	// the input channel has been closed, so close the output channels then:
 	n.ch = nil
 	for _, out := range n.out {
@@ -92,24 +147,49 @@ func (n *Notifier) dispatcher() {
 // public API
 
 type notifyOutput struct {
+	name       string
 	severity   Severity
 	ch         chan *Msg
 	attachment bool
 	flush      bool
+	stats      *outputStats
+	spool      *spool
+	dedup      *dedupState
 }
 
 // Notifier is a logging subsystem instance which is running as a goroutine
 // and may have several different logging destinations.
 type Notifier struct {
-	ch  chan *Msg
-	out []notifyOutput
-	wg  *sync.WaitGroup
+	ch          chan *Msg
+	out         []notifyOutput
+	routes      []*route
+	routedPools map[string]map[int]bool
+	routedSev   map[string]Severity // severity overrides for the attachments
+	poolSummary func() []PoolSummary
+	silences    silenceState
+	wg          *sync.WaitGroup
+
+	// held for queuing messages, Close() takes it exclusively:
+	sendMutex sync.RWMutex
+
+	// reporting of failed deliveries:
+	mutex         sync.Mutex
+	closed        bool // set with both mutexes held
+	errorSeverity Severity
+	fallback      []int
 }
 
 // New starts a new logging subsystem as a goroutine.
 func New() *Notifier {
 	ch := make(chan *Msg, chan_SIZE)
-	n := &Notifier{ch: ch, wg: &sync.WaitGroup{}}
+	n := &Notifier{
+		ch:            ch,
+		routedPools:   make(map[string]map[int]bool),
+		routedSev:     make(map[string]Severity),
+		silences:      silenceState{pools: make(map[string]bool)},
+		wg:            &sync.WaitGroup{},
+		errorSeverity: SEVERITY_NONE,
+	}
 	n.wg.Add(1)
 	go n.dispatcher()
 	return n
@@ -120,25 +200,75 @@ func sanitizeMessageText(str string) string {
 	return strings.Replace(str, "\n", " ", -1)
 }
 
-func (n *Notifier) internal_send(msgtype MsgType, s Severity, t string) error {
+func (n *Notifier) internal_send(msgtype MsgType, s Severity, f Fields, t string, to map[int]bool) error {
 	if s == SEVERITY_NONE {
 		return nil // discard
 	}
 	if s < severity_MIN || s > severity_MAX {
 		return errors.New(`invalid "severity"`)
 	}
-	n.ch <- &Msg{
+	if msgtype == MSGTYPE_MESSAGE {
+		// attachments are multi-line by nature
+		t = sanitizeMessageText(t)
+	}
+	n.queue(&Msg{
 		Time:     time.Now(),
 		MsgType:  msgtype,
 		Severity: s,
-		Text:     sanitizeMessageText(t),
-	}
+		Text:     t,
+		Fields:   f,
+		to:       to,
+	})
 	return nil
 }
 
+// Queue a message for the dispatcher. The message is dropped if the
+// notifier has been closed, the goroutines which run independently of the
+// main program may still send messages after that.
+func (n *Notifier) queue(m *Msg) {
+	n.sendMutex.RLock()
+	defer n.sendMutex.RUnlock()
+
+	if !n.closed {
+		n.ch <- m
+	}
+}
+
 // Send sends a message for logging.
 func (n *Notifier) Send(s Severity, t string) error {
-	return n.internal_send(MSGTYPE_MESSAGE, s, t)
+	return n.internal_send(MSGTYPE_MESSAGE, s, nil, t, nil)
+}
+
+// SendFields sends a message with structured fields for logging. The
+// fields must not be modified after the call.
+func (n *Notifier) SendFields(s Severity, f Fields, t string) error {
+	return n.internal_send(MSGTYPE_MESSAGE, s, f, t, nil)
+}
+
+// SendFieldsTo sends a message with structured fields to the named
+// outputs only, bypassing the routing rules and the severity levels of the
+// outputs. The outputs with level SEVERITY_NONE only get these messages.
+func (n *Notifier) SendFieldsTo(outputs []string, s Severity, f Fields, t string) error {
+	to := make(map[int]bool)
+	for _, name := range outputs {
+		i := n.findOutput(name)
+		if i < 0 {
+			return errors.New(`unknown output "` + name + `"`)
+		}
+		to[i] = true
+	}
+	return n.internal_send(MSGTYPE_MESSAGE, s, f, t, to)
+}
+
+// CheckOutputs returns an error if any of the named outputs does not
+// exist.
+func (n *Notifier) CheckOutputs(outputs []string) error {
+	for _, name := range outputs {
+		if n.findOutput(name) < 0 {
+			return errors.New(`unknown output "` + name + `"`)
+		}
+	}
+	return nil
 }
 
 // Attach sends an attachment for logging. Attachments are usually some
@@ -148,29 +278,64 @@ func (n *Notifier) Send(s Severity, t string) error {
 // logging attachments. For others attachments can be enabled or disabled
 // when setting up the logging destination.
 func (n *Notifier) Attach(s Severity, t string) error {
-	return n.internal_send(MSGTYPE_ATTACHMENT, s, t)
+	return n.internal_send(MSGTYPE_ATTACHMENT, s, nil, t, nil)
+}
+
+// AttachFields sends an attachment with structured fields telling which
+// messages it is related to.
+func (n *Notifier) AttachFields(s Severity, f Fields, t string) error {
+	return n.internal_send(MSGTYPE_ATTACHMENT, s, f, t, nil)
+}
+
+// Returns the index of the output with the given name or -1.
+func (n *Notifier) findOutput(name string) int {
+	for i, out := range n.out {
+		if out.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// SetOutputName names the output which was added last. The name is used
+// for referring to the output in routing rules and in the statistics.
+func (n *Notifier) SetOutputName(name string) error {
+	switch {
+	case len(n.out) == 0:
+		return errors.New("no output to name")
+	case n.findOutput(name) >= 0:
+		return errors.New(`duplicate output name "` + name + `"`)
+	}
+	n.out[len(n.out)-1].name = name
+	return nil
 }
 
 // Flush all buffered logging output. This should be called when the program
 // finishes "one round". Causes for example e-mails to be sent instead of
 // waiting for more log lines.
 func (n *Notifier) Flush() {
-	n.ch <- &Msg{Time: time.Now(), MsgType: MSGTYPE_FLUSH}
+	n.queue(&Msg{Time: time.Now(), MsgType: MSGTYPE_FLUSH})
 }
 
 // Reopen log outputs. Should be called whenever log files have been rotated.
 func (n *Notifier) Reopen() {
-	n.ch <- &Msg{Time: time.Now(), MsgType: MSGTYPE_REOPEN}
+	n.queue(&Msg{Time: time.Now(), MsgType: MSGTYPE_REOPEN})
 }
 
 // Close log outputs. Causes the outputs to be flushed and stops the
 // goroutines gracefully. Returns a channel which is closed when the
 // logging subsystem has shut down. The caller may choose to wait until
 // it is closed in case something takes a long time (such as sendind
-// an e-mail message).
+// an e-mail message). The messages sent after Close are dropped.
 func (n *Notifier) Close() chan bool {
-	// close the message channel to tell the goroutines they should quit:
+	// close the message channel to tell the goroutines they should quit,
+	// the messages sent after this are dropped:
+	n.sendMutex.Lock()
+	n.mutex.Lock()
+	n.closed = true
 	close(n.ch)
+	n.mutex.Unlock()
+	n.sendMutex.Unlock()
 	// create a channel which can be used to wait for goroutines to quit:
 	closeC := make(chan bool)
 	// start a goroutine which closes the channel when all goroutines have quit:
@@ -187,6 +352,17 @@ func (n *Notifier) Printf(s Severity, format string, v ...interface{}) {
 	n.Send(s, fmt.Sprintf(format, v...))
 }
 
+// PrintfFields is like Printf but includes structured fields in the message.
+func (n *Notifier) PrintfFields(s Severity, f Fields, format string, v ...interface{}) {
+	n.SendFields(s, f, fmt.Sprintf(format, v...))
+}
+
+// PrintfFieldsTo is like PrintfFields but sends the message to the named
+// outputs only.
+func (n *Notifier) PrintfFieldsTo(outputs []string, s Severity, f Fields, format string, v ...interface{}) error {
+	return n.SendFieldsTo(outputs, s, f, fmt.Sprintf(format, v...))
+}
+
 // Print is normal fmt.Print which sends a log message.
 func (n *Notifier) Print(s Severity, v ...interface{}) { n.Send(s, fmt.Sprint(v...)) }
 
@@ -0,0 +1,213 @@
+//
+// route.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package notifier
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Route defines a routing rule. A message matches the rule if it matches
+// all conditions which are given. Pool, Device and Event are regular
+// expressions which must match the whole field of the message, Message is
+// a regular expression which must match a part of the message text and
+// Time is a time of day range such as "08:00-17:00" (the range may
+// continue over midnight).
+type Route struct {
+	Name     string
+	Pool     string
+	Device   string
+	Event    string
+	Message  string
+	Time     string
+	Outputs  []string  // names of the outputs to send the matching messages to, all if empty
+	Severity *Severity // new severity of the matching messages (optional)
+}
+
+type route struct {
+	name     string
+	fields   map[string]*regexp.Regexp
+	message  *regexp.Regexp
+	timed    bool
+	start    int // minutes from midnight
+	end      int
+	outputs  map[int]bool // nil means all outputs
+	severity *Severity
+}
+
+// Parse a time of day range "hh:mm-hh:mm" to minutes from midnight. The end
+// of the range may also be "24:00".
+func parseTimeRange(str string) (start, end int, err error) {
+	var sh, sm, eh, em int
+	_, err = fmt.Sscanf(str, "%d:%d-%d:%d", &sh, &sm, &eh, &em)
+	if err != nil || sh < 0 || sh > 23 || eh < 0 || eh > 24 ||
+		sm < 0 || sm > 59 || em < 0 || em > 59 || (eh == 24 && em != 0) {
+		return 0, 0, errors.New(`invalid "time"`)
+	}
+	return sh*60 + sm, eh*60 + em, nil
+}
+
+// Returns true if the time of day is within the "time" range of the rule.
+func (r *route) inTime(t time.Time) bool {
+	if !r.timed {
+		return true
+	}
+	min := t.Hour()*60 + t.Minute()
+	if r.start <= r.end {
+		return min >= r.start && min < r.end
+	}
+	return min >= r.start || min < r.end
+}
+
+func (r *route) matches(m *Msg) bool {
+	for k, re := range r.fields {
+		v, ok := m.Fields[k]
+		if !ok || !re.MatchString(v) {
+			return false
+		}
+	}
+	if r.message != nil && !r.message.MatchString(m.Text) {
+		return false
+	}
+	return r.inTime(m.Time)
+}
+
+// Route a message. Returns the message, possibly with a new severity, and
+// the outputs it should be sent to (nil means all outputs). The
+// attachments are sent to the outputs which got messages about the same
+// pool since the previous flush, with the most severe of the severities
+// set by the rules for those messages. Only called from the dispatcher.
+func (n *Notifier) route(m *Msg) (*Msg, map[int]bool) {
+	if len(n.routes) == 0 {
+		return m, nil
+	}
+	pool := m.Fields["pool"]
+	switch m.MsgType {
+	case MSGTYPE_MESSAGE:
+		var outputs map[int]bool
+		for _, r := range n.routes {
+			if !r.matches(m) {
+				continue
+			}
+			if r.severity != nil {
+				mc := *m
+				mc.Severity = *r.severity
+				m = &mc
+				if s, ok := n.routedSev[pool]; pool != "" && (!ok || *r.severity < s) {
+					n.routedSev[pool] = *r.severity
+				}
+			}
+			outputs = r.outputs
+			break
+		}
+		if pool != "" {
+			if n.routedPools[pool] == nil {
+				n.routedPools[pool] = make(map[int]bool)
+			}
+			for i := range n.out {
+				if outputs == nil || outputs[i] {
+					n.routedPools[pool][i] = true
+				}
+			}
+		}
+		return m, outputs
+	case MSGTYPE_ATTACHMENT:
+		if s, ok := n.routedSev[pool]; ok {
+			mc := *m
+			mc.Severity = s
+			m = &mc
+		}
+		if outputs, ok := n.routedPools[pool]; ok {
+			return m, outputs
+		}
+	case MSGTYPE_FLUSH:
+		n.routedPools = make(map[string]map[int]bool)
+		n.routedSev = make(map[string]Severity)
+	}
+	return m, nil
+}
+
+// AddRoute adds a routing rule. The rules are evaluated in the order they
+// are added and the first matching rule is applied. The messages which do
+// not match any rule are sent to all outputs. The outputs must be added and
+// named before the rules referring to them.
+func (n *Notifier) AddRoute(rt Route) error {
+	r, err := newRoute(rt)
+	if err != nil {
+		return err
+	}
+	if rt.Severity != nil && (*rt.Severity < severity_MIN || *rt.Severity > SEVERITY_NONE) {
+		return errors.New(`invalid "severity"`)
+	}
+	r.severity = rt.Severity
+	if len(rt.Outputs) > 0 {
+		r.outputs = make(map[int]bool)
+		for _, name := range rt.Outputs {
+			i := n.findOutput(name)
+			if i < 0 {
+				return errors.New(`unknown output "` + name + `"`)
+			}
+			r.outputs[i] = true
+		}
+	}
+	n.routes = append(n.routes, r)
+	return nil
+}
+
+// Compile the conditions of a rule.
+func newRoute(rt Route) (*route, error) {
+	r := &route{name: rt.Name, fields: make(map[string]*regexp.Regexp)}
+	for _, f := range []struct {
+		key     string
+		pattern string
+	}{{"pool", rt.Pool}, {"device", rt.Device}, {"event", rt.Event}} {
+		if f.pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + f.pattern + ")$")
+		if err != nil {
+			return nil, errors.New(`invalid "` + f.key + `": ` + err.Error())
+		}
+		r.fields[f.key] = re
+	}
+	if rt.Message != "" {
+		re, err := regexp.Compile(rt.Message)
+		if err != nil {
+			return nil, errors.New(`invalid "message": ` + err.Error())
+		}
+		r.message = re
+	}
+	if rt.Time != "" {
+		var err error
+		r.start, r.end, err = parseTimeRange(strings.TrimSpace(rt.Time))
+		if err != nil {
+			return nil, err
+		}
+		r.timed = true
+	}
+	return r, nil
+}
+
+// eof
@@ -0,0 +1,355 @@
+//
+// silence.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package notifier
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many suppressed messages are listed in the summary of a silence.
+const silence_MAXLINES = 100
+
+// Silence defines a maintenance window. While a silence is active, the
+// matching messages are not sent to the outputs which are flushed, such
+// as e-mail, but they are still written to the logs. A summary of the
+// suppressed messages is sent when the silence ends. Pool, Device, Event,
+// Message and Time are like in Route. A silence is active between Start
+// and End (either may be zero) and, if Days is given, only on the listed
+// days of the week such as "mon-fri" or "sat sun".
+type Silence struct {
+	ID      string    `json:"id"`
+	Pool    string    `json:"pool,omitempty"`
+	Device  string    `json:"device,omitempty"`
+	Event   string    `json:"event,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Time    string    `json:"time,omitempty"`
+	Days    string    `json:"days,omitempty"`
+	Comment string    `json:"comment,omitempty"`
+	Creator string    `json:"creator,omitempty"`
+}
+
+// SilenceStatus is the state of a silence returned by Silences.
+type SilenceStatus struct {
+	Silence
+	Active     bool
+	Suppressed int // messages suppressed during the current window
+}
+
+type silence struct {
+	Silence
+	r    *route
+	days map[time.Weekday]bool // nil means all days
+
+	active   bool
+	count    int
+	severity Severity // the worst severity of the suppressed messages
+	lines    []string
+}
+
+type silenceState struct {
+	mutex    sync.Mutex
+	silences []*silence
+	ended    []*silence      // removed silences waiting for the summary
+	pools    map[string]bool // pools with only silenced messages since the previous flush
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday,
+	"wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Parse days of the week such as "mon-fri" or "sat sun".
+func parseWeekdays(str string) (map[time.Weekday]bool, error) {
+	days := make(map[time.Weekday]bool)
+	for _, f := range strings.Fields(strings.ToLower(str)) {
+		r := strings.SplitN(f, "-", 2)
+		first, ok := weekdayNames[r[0]]
+		if !ok {
+			return nil, errors.New(`invalid "days"`)
+		}
+		last := first
+		if len(r) == 2 {
+			if last, ok = weekdayNames[r[1]]; !ok {
+				return nil, errors.New(`invalid "days"`)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	if len(days) == 0 {
+		return nil, nil
+	}
+	return days, nil
+}
+
+func newSilence(s Silence) (*silence, error) {
+	if s.ID == "" {
+		return nil, errors.New(`silence without "id"`)
+	}
+	if !s.Start.IsZero() && !s.End.IsZero() && !s.End.After(s.Start) {
+		return nil, errors.New(`"end" is not after "start"`)
+	}
+	r, err := newRoute(Route{Name: s.ID, Pool: s.Pool, Device: s.Device,
+		Event: s.Event, Message: s.Message, Time: s.Time})
+	if err != nil {
+		return nil, err
+	}
+	days, err := parseWeekdays(s.Days)
+	if err != nil {
+		return nil, err
+	}
+	return &silence{Silence: s, r: r, days: days}, nil
+}
+
+// CheckSilence returns an error if the silence is not valid.
+func CheckSilence(s Silence) error {
+	_, err := newSilence(s)
+	return err
+}
+
+func (s *silence) activeAt(t time.Time) bool {
+	switch {
+	case !s.Start.IsZero() && t.Before(s.Start):
+		return false
+	case !s.End.IsZero() && !t.Before(s.End):
+		return false
+	case s.days != nil && !s.days[t.Weekday()]:
+		return false
+	}
+	return s.r.inTime(t)
+}
+
+func (s *silence) suppress(m *Msg) {
+	s.active = true
+	if s.count == 0 || m.Severity < s.severity {
+		s.severity = m.Severity
+	}
+	s.count++
+	if len(s.lines) < silence_MAXLINES {
+		s.lines = append(s.lines, fmt.Sprintf("%s [%s] %s",
+			m.Time.Format(date_time_FORMAT), m.Severity, m.Text))
+	}
+}
+
+// Check whether the message is silenced for the flushed outputs. The
+// attachments are silenced if all messages about the same pool since the
+// previous flush were silenced. Only called from the dispatcher.
+func (n *Notifier) silenced(m *Msg) bool {
+	ss := &n.silences
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	pool := m.Fields["pool"]
+	switch m.MsgType {
+	case MSGTYPE_MESSAGE:
+		if m.Fields["alertstatus"] == "resolved" {
+			return false // the incidents must not stay open
+		}
+		var matched *silence
+		for _, s := range ss.silences {
+			if s.activeAt(m.Time) && s.r.matches(m) {
+				matched = s
+				break
+			}
+		}
+		if pool != "" {
+			if matched == nil {
+				ss.pools[pool] = false
+			} else if _, ok := ss.pools[pool]; !ok {
+				ss.pools[pool] = true
+			}
+		}
+		if matched == nil {
+			return false
+		}
+		matched.suppress(m)
+		return true
+	case MSGTYPE_ATTACHMENT:
+		return pool != "" && ss.pools[pool]
+	case MSGTYPE_FLUSH:
+		ss.pools = make(map[string]bool)
+	}
+	return false
+}
+
+// Send the summaries of the silences which have ended since the previous
+// call. Only called from the dispatcher.
+func (n *Notifier) sendSilenceSummaries(now time.Time) {
+	ss := &n.silences
+	ss.mutex.Lock()
+	ended := ss.ended
+	ss.ended = nil
+	for _, s := range ss.silences {
+		active := s.activeAt(now)
+		if s.active && !active && s.count > 0 {
+			c := *s
+			ended = append(ended, &c)
+			s.count = 0
+			s.lines = nil
+		}
+		s.active = active
+	}
+	ss.mutex.Unlock()
+
+	for _, s := range ended {
+		text := fmt.Sprintf(`silence "%s" ended, %d notifications were suppressed`, s.ID, s.count)
+		if s.Comment != "" {
+			text += " (" + s.Comment + ")"
+		}
+		m := &Msg{
+			Time:     now,
+			MsgType:  MSGTYPE_MESSAGE,
+			Severity: s.severity,
+			Text:     text,
+			Fields:   Fields{"event": "silenceended", "silence": s.ID},
+		}
+		lines := strings.Join(s.lines, "\n")
+		if s.count > len(s.lines) {
+			lines += fmt.Sprintf("\n(%d more)", s.count-len(s.lines))
+		}
+		a := &Msg{
+			Time:     now,
+			MsgType:  MSGTYPE_ATTACHMENT,
+			Severity: s.severity,
+			Text:     lines,
+			Fields:   m.Fields,
+		}
+		for i := range n.out {
+			out := &n.out[i]
+			if m.Severity > out.severity || out.severity == SEVERITY_NONE {
+				continue
+			}
+			out.forward(m)
+			if out.attachment {
+				out.forward(a)
+			}
+		}
+	}
+	if len(ended) > 0 {
+		for i := range n.out {
+			if n.out[i].flush {
+				n.out[i].forward(&Msg{Time: now, MsgType: MSGTYPE_FLUSH})
+			}
+		}
+	}
+}
+
+// AddSilence adds a silence or replaces the one with the same ID. The
+// suppressed messages of a replaced silence are kept for the summary.
+func (n *Notifier) AddSilence(s Silence) error {
+	ns, err := newSilence(s)
+	if err != nil {
+		return err
+	}
+	ss := &n.silences
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	for i, old := range ss.silences {
+		if old.ID == s.ID {
+			ns.active, ns.count, ns.severity, ns.lines =
+				old.active, old.count, old.severity, old.lines
+			ss.silences[i] = ns
+			return nil
+		}
+	}
+	ss.silences = append(ss.silences, ns)
+	return nil
+}
+
+// RemoveSilence removes a silence. The summary of the suppressed messages
+// is sent shortly.
+func (n *Notifier) RemoveSilence(id string) {
+	ss := &n.silences
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	for i, s := range ss.silences {
+		if s.ID == id {
+			ss.silences = append(ss.silences[:i], ss.silences[i+1:]...)
+			if s.count > 0 {
+				ss.ended = append(ss.ended, s)
+			}
+			return
+		}
+	}
+}
+
+// CopySilenceState copies the suppressed messages from the silences of an
+// old notifier which has been replaced by n, so that the summaries are
+// still sent. The silences which n does not have are handled as removed.
+// The old notifier must have been closed.
+func (n *Notifier) CopySilenceState(old *Notifier) {
+	oldss := &old.silences
+	oldss.mutex.Lock()
+	defer oldss.mutex.Unlock()
+	ss := &n.silences
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	ss.ended = append(ss.ended, oldss.ended...)
+	oldss.ended = nil
+OLD:
+	for _, o := range oldss.silences {
+		for _, s := range ss.silences {
+			if s.ID == o.ID {
+				s.active, s.count, s.severity, s.lines =
+					o.active, o.count, o.severity, o.lines
+				continue OLD
+			}
+		}
+		if o.count > 0 {
+			ss.ended = append(ss.ended, o)
+		}
+	}
+}
+
+// Silences returns the state of the silences.
+func (n *Notifier) Silences() []SilenceStatus {
+	ss := &n.silences
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	now := time.Now()
+	var sss []SilenceStatus
+	for _, s := range ss.silences {
+		sss = append(sss, SilenceStatus{
+			Silence:    s.Silence,
+			Active:     s.activeAt(now),
+			Suppressed: s.count,
+		})
+	}
+	return sss
+}
+
+// eof
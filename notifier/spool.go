@@ -0,0 +1,404 @@
+//
+// spool.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package notifier
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults used if zero values are given in SpoolConfig.
+const (
+	spool_EXPIRY = 24 * time.Hour
+)
+
+const (
+	spool_RETRY_MIN = 10 * time.Second
+	spool_RETRY_MAX = 10 * time.Minute
+	spool_KEEP      = 24 * time.Hour // how long finished entries are kept
+	spool_PENDING   = 1000           // entries waiting to be written
+)
+
+// Spool file name suffixes by the state of the entry.
+const (
+	spool_QUEUED  = ".queued"
+	spool_SENT    = ".sent"
+	spool_EXPIRED = ".expired"
+	spool_FAILED  = ".failed"
+	spool_TMP     = ".tmp"
+	spool_LOCK    = ".lock"
+)
+
+// SpoolConfig defines a disk spool for a logging output. Messages are
+// written to the spool before they are delivered and the delivery is
+// retried until it succeeds or the message expires. Messages which have
+// not been delivered when the program exits are delivered when it is
+// started again.
+type SpoolConfig struct {
+	Dir    string        // spool directory, spooling is disabled if empty
+	Expiry time.Duration // how long the delivery is retried
+}
+
+type spoolEntry struct {
+	name      string    // file name without suffix
+	stored    bool      // written to the spool directory
+	Created   time.Time `json:"created"`
+	Attempts  int       `json:"attempts"`
+	NextTry   time.Time `json:"next_try"`
+	LastError string    `json:"last_error,omitempty"`
+	Data      []byte    `json:"data"`
+}
+
+// Delivers the data of a spool entry. Returns true if a failed delivery
+// may be retried later.
+type spoolDeliverFunc func(data []byte) (bool, error)
+
+type spool struct {
+	dir     string
+	expiry  time.Duration
+	deliver spoolDeliverFunc
+	st      *outputStats
+	mutex   sync.Mutex
+	queue   []*spoolEntry
+	pending int // entries in the queue which are not stored yet
+	seq     int
+	wakeC   chan bool
+	stopC   chan bool
+}
+
+// Write an entry to the spool atomically with the given suffix.
+func (sp *spool) write(e *spoolEntry, suffix string) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(sp.dir, e.name+spool_TMP)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(sp.dir, e.name+suffix))
+}
+
+// Mark a queued entry finished (delivered, expired or failed) and remove
+// it from the queue. Finished entries are kept for a while.
+func (sp *spool) finish(e *spoolEntry, suffix string) {
+	err := sp.write(e, suffix)
+	if err == nil {
+		err = os.Remove(filepath.Join(sp.dir, e.name+spool_QUEUED))
+	}
+	checkInternalError("error writing spool", err)
+
+	sp.mutex.Lock()
+	for i, qe := range sp.queue {
+		if qe == e {
+			sp.queue = append(sp.queue[:i], sp.queue[i+1:]...)
+			break
+		}
+	}
+	sp.mutex.Unlock()
+}
+
+// Add data to the spool for delivery. The entry is written to the spool
+// directory by the spool goroutine, so this does not block even if the
+// file system does. The data is dropped if too many entries are waiting.
+func (sp *spool) add(data []byte) {
+	sp.mutex.Lock()
+	if sp.pending >= spool_PENDING {
+		sp.mutex.Unlock()
+		checkInternalError("error adding to spool", errors.New("too many entries waiting"))
+		sp.st.dropped()
+		return
+	}
+	sp.seq++
+	e := &spoolEntry{
+		name:    fmt.Sprintf("%016x-%04x", time.Now().UnixNano(), sp.seq&0xffff),
+		Created: time.Now(),
+		Data:    data,
+	}
+	sp.queue = append(sp.queue, e)
+	sp.pending++
+	sp.mutex.Unlock()
+
+	select {
+	case sp.wakeC <- true:
+	default:
+	}
+}
+
+// Write the new entries to the spool directory. The entries are delivered
+// even if writing them fails, they are just not persistent then.
+func (sp *spool) store() {
+	for {
+		var e *spoolEntry
+		sp.mutex.Lock()
+		for _, qe := range sp.queue {
+			if !qe.stored {
+				e = qe
+				break
+			}
+		}
+		sp.mutex.Unlock()
+		if e == nil {
+			return
+		}
+		sp.st.check("error writing spool", sp.write(e, spool_QUEUED))
+		sp.mutex.Lock()
+		e.stored = true
+		sp.pending--
+		sp.mutex.Unlock()
+	}
+}
+
+// Load the queued entries which are not in the queue already and remove
+// old finished entries.
+func (sp *spool) load() {
+	files, err := ioutil.ReadDir(sp.dir)
+	if err != nil {
+		sp.st.check("error reading spool", err)
+		return
+	}
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	inQueue := make(map[string]bool)
+	for _, e := range sp.queue {
+		inQueue[e.name] = true
+	}
+	for _, fi := range files {
+		fn := fi.Name()
+		ext := filepath.Ext(fn)
+		name := strings.TrimSuffix(fn, ext)
+		switch ext {
+		case spool_QUEUED:
+			if inQueue[name] {
+				continue
+			}
+			b, err := ioutil.ReadFile(filepath.Join(sp.dir, fn))
+			if err != nil {
+				sp.st.check("error reading spool", err)
+				continue
+			}
+			e := &spoolEntry{name: name, stored: true}
+			if err = json.Unmarshal(b, e); err != nil {
+				sp.st.check(`invalid spool file "`+fn+`"`, err)
+				os.Rename(filepath.Join(sp.dir, fn), filepath.Join(sp.dir, name+spool_FAILED))
+				continue
+			}
+			// replayed entries are tried right away:
+			e.NextTry = time.Time{}
+			sp.queue = append(sp.queue, e)
+		case spool_SENT, spool_EXPIRED, spool_FAILED, spool_TMP:
+			if time.Since(fi.ModTime()) > spool_KEEP {
+				os.Remove(filepath.Join(sp.dir, fn))
+			}
+		}
+	}
+	sort.Sort(spoolQueue(sp.queue))
+}
+
+type spoolQueue []*spoolEntry
+
+func (q spoolQueue) Len() int           { return len(q) }
+func (q spoolQueue) Less(i, j int) bool { return q[i].name < q[j].name }
+func (q spoolQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (sp *spool) head() *spoolEntry {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	if len(sp.queue) == 0 {
+		return nil
+	}
+	return sp.queue[0]
+}
+
+// Try to deliver an entry once.
+func (sp *spool) try(e *spoolEntry) {
+	if time.Since(e.Created) > sp.expiry {
+		sp.st.check("spooled message expired",
+			fmt.Errorf("not delivered in %s (%d attempts): %s", sp.expiry, e.Attempts, e.LastError))
+		sp.finish(e, spool_EXPIRED)
+		return
+	}
+	retry, err := sp.deliver(e.Data)
+	e.Attempts++
+	switch {
+	case err == nil:
+		sp.st.success()
+		sp.finish(e, spool_SENT)
+	case !retry:
+		e.LastError = err.Error()
+		sp.st.check("error delivering spooled message (giving up)", err)
+		sp.finish(e, spool_FAILED)
+	default:
+		sp.st.retrying("error delivering spooled message (retrying)", err)
+		e.LastError = err.Error()
+		delay := spool_RETRY_MAX
+		if e.Attempts < 8 {
+			delay = spool_RETRY_MIN << uint(e.Attempts-1)
+			if delay > spool_RETRY_MAX {
+				delay = spool_RETRY_MAX
+			}
+		}
+		e.NextTry = time.Now().Add(delay)
+		checkInternalError("error writing spool", sp.write(e, spool_QUEUED))
+	}
+}
+
+// Lock the spool directory. The lock is held by the previous instance for
+// a while after reconfiguration.
+func (sp *spool) lock() (*os.File, bool) {
+	f, err := os.OpenFile(filepath.Join(sp.dir, spool_LOCK), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		sp.st.check("error locking spool", err)
+		return nil, true
+	}
+	for {
+		locked, err := lockFile(f)
+		if locked {
+			checkInternalError("error locking spool", err)
+			return f, true
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-sp.stopC:
+			f.Close()
+			return nil, false
+		}
+	}
+}
+
+func (sp *spool) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	f, ok := sp.lock()
+	if !ok {
+		return
+	}
+	if f != nil {
+		defer f.Close()
+	}
+	sp.load()
+
+	stopping := false
+	for {
+		sp.store()
+		e := sp.head()
+		if e == nil {
+			if stopping {
+				return
+			}
+			select {
+			case <-sp.wakeC:
+			case <-sp.stopC:
+				stopping = true
+			}
+			continue
+		}
+		if stopping {
+			// try the messages of this session once, the rest
+			// are delivered when the program is started again:
+			if e.Attempts > 0 {
+				return
+			}
+		} else if wait := e.NextTry.Sub(time.Now()); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-sp.wakeC:
+			case <-sp.stopC:
+				stopping = true
+			}
+			continue
+		}
+		sp.try(e)
+	}
+}
+
+// Returns the number of queued messages and the creation time of the
+// oldest one.
+func (sp *spool) state() (int, time.Time) {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	if len(sp.queue) == 0 {
+		return 0, time.Time{}
+	}
+	return len(sp.queue), sp.queue[0].Created
+}
+
+// Stop the spool after the queued messages of this session have been
+// tried once. Does nothing if sp is nil.
+func (sp *spool) close() {
+	if sp != nil {
+		close(sp.stopC)
+	}
+}
+
+// Start a spool according to the configuration. Returns nil if spooling
+// is not enabled.
+func (n *Notifier) newSpool(c SpoolConfig, st *outputStats, deliver spoolDeliverFunc) (*spool, error) {
+	if c.Dir == "" {
+		return nil, nil
+	}
+	if c.Expiry < 0 {
+		return nil, errors.New(`invalid "expiry"`)
+	}
+	if c.Expiry == 0 {
+		c.Expiry = spool_EXPIRY
+	}
+	if err := os.MkdirAll(c.Dir, 0700); err != nil {
+		return nil, err
+	}
+	sp := &spool{
+		dir:     c.Dir,
+		expiry:  c.Expiry,
+		deliver: deliver,
+		st:      st,
+		wakeC:   make(chan bool, 1),
+		stopC:   make(chan bool),
+	}
+	n.wg.Add(1)
+	go sp.run(n.wg)
+	return sp, nil
+}
+
+// eof
@@ -0,0 +1,161 @@
+//
+// stats.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package notifier
+
+import (
+	"sync"
+	"time"
+)
+
+// OutputStats contains the delivery statistics of a logging output.
+type OutputStats struct {
+	Name          string // the name given with SetOutputName()
+	Type          string // such as "file", "syslog" or "smtp"
+	Messages      int64  // messages passed to the output
+	Dropped       int64  // messages dropped because the output was busy
+	Deduplicated  int64  // repeated messages folded into digests
+	Errors        int64  // failed deliveries
+	Failures      int64  // failed attempts since the last successful delivery
+	LastError     string
+	LastErrorTime time.Time
+	LastSuccess   time.Time // time of the last successful delivery
+	Spool         string    // spool directory if spooling is enabled
+	Queued        int       // messages waiting in the spool
+	OldestQueued  time.Time // creation time of the oldest queued message
+}
+
+// Healthy tells if the latest delivery attempt of the output succeeded.
+func (st *OutputStats) Healthy() bool {
+	return st.Failures == 0
+}
+
+type outputStats struct {
+	OutputStats
+	report     func(text string) bool // reports failures to the other outputs
+	lastReport time.Time
+	mutex      sync.Mutex
+}
+
+func newOutputStats(t string) *outputStats {
+	return &outputStats{OutputStats: OutputStats{Type: t}}
+}
+
+func (st *outputStats) message() {
+	st.mutex.Lock()
+	st.Messages++
+	st.mutex.Unlock()
+}
+
+func (st *outputStats) deduplicated() {
+	st.mutex.Lock()
+	st.Deduplicated++
+	st.mutex.Unlock()
+}
+
+func (st *outputStats) dropped() {
+	st.mutex.Lock()
+	st.Dropped++
+	st.mutex.Unlock()
+}
+
+func (st *outputStats) success() {
+	st.mutex.Lock()
+	st.Failures = 0
+	st.LastSuccess = time.Now()
+	st.mutex.Unlock()
+}
+
+func (st *outputStats) healthy() bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	return st.Failures == 0
+}
+
+func (st *outputStats) setReport(report func(text string) bool) {
+	st.mutex.Lock()
+	st.report = report
+	st.mutex.Unlock()
+}
+
+// Record a failed attempt which is going to be retried. The output is
+// unhealthy until the next successful delivery.
+func (st *outputStats) retrying(str string, err error) {
+	checkInternalError(str, err)
+	st.mutex.Lock()
+	st.Failures++
+	st.LastError = str + ": " + err.Error()
+	st.LastErrorTime = time.Now()
+	st.mutex.Unlock()
+}
+
+// Record a failed delivery if err is not nil. The error is also reported
+// as an internal error and, no more often than report_INTERVAL, to the
+// other outputs.
+func (st *outputStats) check(str string, err error) {
+	if err == nil {
+		return
+	}
+	checkInternalError(str, err)
+	text := str + ": " + err.Error()
+	now := time.Now()
+	st.mutex.Lock()
+	st.Errors++
+	st.Failures++
+	st.LastError = text
+	st.LastErrorTime = now
+	report := st.report
+	if now.Sub(st.lastReport) < report_INTERVAL {
+		report = nil
+	}
+	st.mutex.Unlock()
+	if report != nil && report(text) {
+		st.mutex.Lock()
+		st.lastReport = now
+		st.mutex.Unlock()
+	}
+}
+
+func (st *outputStats) get() OutputStats {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	return st.OutputStats
+}
+
+// Stats returns the delivery statistics of all logging outputs in the
+// order they were added.
+func (n *Notifier) Stats() []OutputStats {
+	var sts []OutputStats
+	for _, out := range n.out {
+		st := out.stats.get()
+		st.Name = out.name
+		if out.spool != nil {
+			st.Spool = out.spool.dir
+			st.Queued, st.OldestQueued = out.spool.state()
+		}
+		sts = append(sts, st)
+	}
+	return sts
+}
+
+// eof
@@ -0,0 +1,228 @@
+//
+// template.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package notifier
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TemplateConfig defines text/template templates which replace the
+// built-in format of an output. Empty templates use the built-in format.
+// The subject and body templates are executed with a *TemplateData and
+// the line template with a *TemplateMsg.
+type TemplateConfig struct {
+	Subject string // e-mail subject, chat message text
+	Body    string // e-mail body, program input
+	Line    string // one message, for example a line in a log file
+}
+
+// PoolSummary is the current state of a pool as given by the function set
+// with SetPoolSummary().
+type PoolSummary struct {
+	Name  string
+	State string
+	Used  int // used space in percent, -1 if not known
+}
+
+// TemplateMsg is the data of line templates.
+type TemplateMsg struct {
+	*Msg
+	Host string
+}
+
+// TemplateData is the data of subject and body templates.
+type TemplateData struct {
+	Host        string
+	Subject     string   // the subject setting of the output (e-mail)
+	Severity    Severity // the worst severity of the messages
+	Text        string   // the text of the first message with that severity
+	Count       int      // the number of messages
+	Messages    []*Msg
+	Attachments []*Msg
+	Lines       []string // the messages formatted by the line template
+	Pools       []PoolSummary
+}
+
+var templateFuncs = template.FuncMap{
+	// format a time, for example {{ time .Time "15:04" }}
+	"time": func(t time.Time, layout string) string {
+		return t.Format(layout)
+	},
+	// prefix all lines of a text, for example {{ indent "> " .Text }}
+	"indent": func(prefix, text string) string {
+		return prefix + strings.Replace(strings.TrimRight(text, "\n"), "\n", "\n"+prefix, -1)
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"join":  strings.Join,
+}
+
+type outputTemplates struct {
+	subject *template.Template
+	body    *template.Template
+	line    *template.Template
+	pools   func() []PoolSummary
+}
+
+// Sample data for checking that the templates can be executed.
+func sampleTemplateData() (*TemplateMsg, *TemplateData) {
+	f := Fields{"pool": "tank", "device": "sda", "event": "devstatechanged"}
+	m := &Msg{Time: time.Now(), MsgType: MSGTYPE_MESSAGE, Severity: ERR,
+		Text: `device "sda" in pool "tank" state changed from ONLINE to FAULTED`, Fields: f}
+	a := &Msg{Time: m.Time, MsgType: MSGTYPE_ATTACHMENT, Severity: ERR,
+		Text: "  pool: tank\n state: DEGRADED\n", Fields: Fields{"pool": "tank"}}
+	d := &TemplateData{
+		Host:        "host",
+		Subject:     "subject",
+		Severity:    ERR,
+		Text:        m.Text,
+		Count:       1,
+		Messages:    []*Msg{m},
+		Attachments: []*Msg{a},
+		Lines:       []string{m.TimeString()},
+		Pools:       []PoolSummary{{Name: "tank", State: "DEGRADED", Used: 42}},
+	}
+	return &TemplateMsg{Msg: m, Host: "host"}, d
+}
+
+// Parse the templates and check them by executing them with sample data.
+// Returns nil if no templates are defined.
+func (n *Notifier) newOutputTemplates(c TemplateConfig) (*outputTemplates, error) {
+	if c.Subject == "" && c.Body == "" && c.Line == "" {
+		return nil, nil
+	}
+	t := &outputTemplates{pools: n.poolSummary}
+	sm, sd := sampleTemplateData()
+	for _, p := range []struct {
+		name string
+		text string
+		tp   **template.Template
+		data interface{}
+	}{
+		{"subject", c.Subject, &t.subject, sd},
+		{"body", c.Body, &t.body, sd},
+		{"line", c.Line, &t.line, sm},
+	} {
+		if p.text == "" {
+			continue
+		}
+		tmpl, err := template.New(p.name).Funcs(templateFuncs).Option("missingkey=zero").Parse(p.text)
+		if err == nil {
+			err = tmpl.Execute(ioutil.Discard, p.data)
+		}
+		if err != nil {
+			return nil, errors.New(`invalid "` + p.name + `" template: ` + err.Error())
+		}
+		*p.tp = tmpl
+	}
+	return t, nil
+}
+
+func executeTemplate(tmpl *template.Template, data interface{}) (string, bool) {
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		checkInternalError("error executing "+tmpl.Name()+" template", err)
+		return "", false
+	}
+	return b.String(), true
+}
+
+// Format a message with the line template or with the default function.
+func (t *outputTemplates) formatLine(host string, m *Msg, def func(*Msg) string) string {
+	if t != nil && t.line != nil {
+		if s, ok := executeTemplate(t.line, &TemplateMsg{Msg: m, Host: host}); ok {
+			return s
+		}
+	}
+	return def(m)
+}
+
+func (t *outputTemplates) formatLines(host string, mbuf []*Msg, def func(*Msg) string) []string {
+	var lines []string
+	for _, m := range mbuf {
+		lines = append(lines, t.formatLine(host, m, def))
+	}
+	return lines
+}
+
+// Make the data of the subject and body templates. Returns nil if there
+// are no templates.
+func (t *outputTemplates) data(host, subject string, mbuf, abuf []*Msg, lines []string) *TemplateData {
+	if t == nil {
+		return nil
+	}
+	sum := summarizeMsgs(mbuf)
+	d := &TemplateData{
+		Host:        host,
+		Subject:     subject,
+		Severity:    sum.Severity,
+		Text:        sum.Text,
+		Count:       len(mbuf),
+		Messages:    mbuf,
+		Attachments: abuf,
+		Lines:       lines,
+	}
+	if t.pools != nil {
+		d.Pools = t.pools()
+	}
+	return d
+}
+
+// Format the subject with the subject template if it is defined.
+func (t *outputTemplates) formatSubject(d *TemplateData, def string) string {
+	if t != nil && t.subject != nil {
+		if s, ok := executeTemplate(t.subject, d); ok {
+			return strings.TrimSpace(s)
+		}
+	}
+	return def
+}
+
+// Format the body with the body template if it is defined.
+func (t *outputTemplates) formatBody(d *TemplateData, def func() string) string {
+	if s, ok := t.executeBody(d); ok {
+		return s
+	}
+	return def()
+}
+
+// Format the body with the body template. Returns false if the template is
+// not defined or fails.
+func (t *outputTemplates) executeBody(d *TemplateData) (string, bool) {
+	if t == nil || t.body == nil {
+		return "", false
+	}
+	return executeTemplate(t.body, d)
+}
+
+// SetPoolSummary sets the function which returns the current state of the
+// pools for the templates. It must be called before adding the outputs.
+func (n *Notifier) SetPoolSummary(f func() []PoolSummary) {
+	n.poolSummary = f
+}
+
+// eof
@@ -26,6 +26,7 @@ import "C"
 
 import (
 	"errors"
+	"os"
 	"syscall"
 	"time"
 	"unsafe"
@@ -55,9 +56,42 @@ func getSystemLoadaverage() ([3]float32, error) {
 	return [3]float32{float32(avg[0]), float32(avg[1]), float32(avg[2])}, nil
 }
 
+// Returns a 64 bit unsigned sysctl value.
+func sysctlUint64(name string) (int64, error) {
+	val, err := syscall.Sysctl(name)
+	if err != nil {
+		return 0, err
+	}
+	buf := []byte(val)
+	// syscall.Sysctl() strips a trailing zero byte:
+	for len(buf) < 8 {
+		buf = append(buf, 0)
+	}
+	return int64(*(*uint64)(unsafe.Pointer(&buf[0]))), nil
+}
+
+// Returns ZFS ARC hit and miss counters.
+func getArcStats() (hits, misses int64, err error) {
+	hits, err = sysctlUint64("kstat.zfs.misc.arcstats.hits")
+	if err != nil {
+		return 0, 0, err
+	}
+	misses, err = sysctlUint64("kstat.zfs.misc.arcstats.misses")
+	if err != nil {
+		return 0, 0, err
+	}
+	return hits, misses, nil
+}
+
 // Device lookup paths. (This list comes from lib/libzfs/libzfs_import.c)
 var deviceLookupPaths = [...]string{
 	"/dev",
 }
 
+// Lock the file exclusively, waits for the lock. The lock is released when
+// the file is closed.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
 // eof
@@ -25,6 +25,10 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -64,6 +68,36 @@ func getSystemLoadaverage() (la [3]float32, err error) {
 	return la, nil
 }
 
+// Returns ZFS ARC hit and miss counters.
+func getArcStats() (hits, misses int64, err error) {
+	buf, err := ioutil.ReadFile("/proc/spl/kstat/zfs/arcstats")
+	if err != nil {
+		return 0, 0, err
+	}
+	var found int
+	for _, line := range strings.Split(string(buf), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 3 {
+			continue
+		}
+		switch f[0] {
+		case "hits":
+			hits, err = strconv.ParseInt(f[2], 10, 64)
+			found++
+		case "misses":
+			misses, err = strconv.ParseInt(f[2], 10, 64)
+			found++
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if found != 2 {
+		return 0, 0, errors.New("failed parsing arcstats")
+	}
+	return hits, misses, nil
+}
+
 // Device lookup paths. (This list comes from lib/libzfs/libzfs_import.c)
 var deviceLookupPaths = [...]string{
 	"/dev/disk/by-vdev",
@@ -76,4 +110,10 @@ var deviceLookupPaths = [...]string{
 	"/dev",
 }
 
+// Lock the file exclusively, waits for the lock. The lock is released when
+// the file is closed.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
 // eof
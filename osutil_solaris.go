@@ -24,6 +24,9 @@
 package main
 
 import (
+	"errors"
+	"os"
+	"syscall"
 	"time"
 )
 
@@ -39,9 +42,21 @@ func getSystemLoadaverage() ([3]float32, error) {
 	return [3]float32{0, 0, 0}, nil
 }
 
+// Returns ZFS ARC hit and miss counters.
+func getArcStats() (hits, misses int64, err error) {
+	// XXX
+	return 0, 0, errors.New("ARC statistics not implemented")
+}
+
 // Device lookup paths. (This list comes from lib/libzfs/libzfs_import.c)
 var deviceLookupPaths = [...]string{
 	"/dev/dsk",
 }
 
+// Lock the file exclusively, waits for the lock. The lock is released when
+// the file is closed.
+func lockFile(f *os.File) error {
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLKW, &syscall.Flock_t{Type: syscall.F_WRLCK})
+}
+
 // eof
@@ -0,0 +1,179 @@
+//
+// outlier.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Detection of slow or otherwise abnormal disks. Each leaf device is
+// compared to its siblings within the same vdev (mirror, raidz etc.)
+// and the device is flagged if its latency or amount of operations
+// stays far outside the group for a sustained period of time.
+
+type devOutlier struct {
+	reason  string    // description of the latest deviation
+	since   time.Time // when the device started to deviate
+	alerted bool
+}
+
+var outlierState struct {
+	devs  map[statKey]*devOutlier
+	mutex sync.RWMutex
+}
+
+// Returns the median of the values.
+func median(v []float64) float64 {
+	if len(v) == 0 {
+		return 0
+	}
+	s := append([]float64(nil), v...)
+	sort.Float64s(s)
+	if len(s)%2 == 1 {
+		return s[len(s)/2]
+	}
+	return (s[len(s)/2-1] + s[len(s)/2]) / 2
+}
+
+// The operations are compared to the median of the siblings only if there
+// are at least this many siblings. Otherwise the disks of a small vdev,
+// such as a 2-disk mirror, would all deviate from each other.
+const outlier_MINSIBLINGS = 3
+
+// Compare a device to the median of its siblings. Returns a description
+// of the deviation or an empty string if the device looks normal.
+func compareToSiblings(row *ZpoolIostatRow, siblings []*ZpoolIostatRow) string {
+	var lats, ops []float64
+	for _, s := range siblings {
+		if lat := s.GetDiskWait(); lat >= 0 {
+			lats = append(lats, float64(lat))
+		}
+		ops = append(ops, float64(s.OperationsRead+s.OperationsWrite))
+	}
+
+	if lat := row.GetDiskWait(); lat >= 0 && len(lats) > 0 && cfg.Outlier.Latencyfactor > 0 {
+		med := median(lats)
+		minlat := float64(time.Duration(cfg.Outlier.Minlatency) * time.Millisecond)
+		if float64(lat) >= minlat && float64(lat) > med*cfg.Outlier.Latencyfactor {
+			return fmt.Sprintf("latency %s, siblings median %s",
+				lat, time.Duration(med))
+		}
+	}
+	if len(ops) >= outlier_MINSIBLINGS && cfg.Outlier.Opsfactor > 0 {
+		med := median(ops)
+		o := float64(row.OperationsRead + row.OperationsWrite)
+		if med >= float64(cfg.Outlier.Minops) &&
+			(o > med*cfg.Outlier.Opsfactor || o < med/cfg.Outlier.Opsfactor) {
+			return fmt.Sprintf("%.0f operations per second, siblings median %.0f",
+				o, med)
+		}
+	}
+	return ""
+}
+
+// Check iostat output for outlier devices.
+func checkIostatOutliers(now time.Time, table *ZpoolIostatTable) {
+	if !cfg.Outlier.Enable {
+		return
+	}
+	window := time.Duration(cfg.Outlier.Duration) * time.Second
+
+	outlierState.mutex.Lock()
+	defer outlierState.mutex.Unlock()
+
+	if outlierState.devs == nil {
+		outlierState.devs = make(map[statKey]*devOutlier)
+	}
+	seen := make(map[statKey]bool)
+
+	for poolname, entry := range *table {
+		pool := findPool(poolname)
+		if pool == nil {
+			continue
+		}
+		for _, vdev := range pool.devs {
+			if len(vdev.subDevs) < 2 {
+				continue // nothing to compare to
+			}
+			for _, i := range vdev.subDevs {
+				dev := pool.devs[i]
+				row, ok := entry[dev.name]
+				if !ok || len(dev.subDevs) != 0 {
+					continue
+				}
+				var siblings []*ZpoolIostatRow
+				for _, j := range vdev.subDevs {
+					if srow, ok := entry[pool.devs[j].name]; ok && j != i {
+						siblings = append(siblings, srow)
+					}
+				}
+				key := statKey{pool: poolname, dev: dev.name}
+				seen[key] = true
+				reason := compareToSiblings(row, siblings)
+
+				o, ok := outlierState.devs[key]
+				switch {
+				case reason != "" && !ok:
+					outlierState.devs[key] = &devOutlier{reason: reason, since: now}
+				case reason != "" && ok:
+					o.reason = reason
+					if !o.alerted && now.Sub(o.since) >= window {
+						notifyEvent(cfg.Severity.Devoutlier, "devoutlier", poolname, dev.name,
+							`pool "%s" device "%s" deviates from other devices in "%s" for %s: %s`,
+							poolname, dev.name, vdev.name,
+							myDurationString(now.Sub(o.since)), reason)
+						o.alerted = true
+					}
+				case reason == "" && ok:
+					if o.alerted {
+						notifyEvent(cfg.Severity.Devoutliercleared, "devoutliercleared", poolname, dev.name,
+							`pool "%s" device "%s" no longer deviates from other devices in "%s"`,
+							poolname, dev.name, vdev.name)
+					}
+					delete(outlierState.devs, key)
+				}
+			}
+		}
+	}
+	// forget devices which have disappeared from the pools:
+	for key := range outlierState.devs {
+		if _, ok := (*table)[key.pool]; ok && !seen[key] {
+			delete(outlierState.devs, key)
+		}
+	}
+}
+
+// Returns a description if the device has been flagged as an outlier.
+func getDevOutlier(pool, dev string) string {
+	outlierState.mutex.RLock()
+	defer outlierState.mutex.RUnlock()
+
+	if o, ok := outlierState.devs[statKey{pool: pool, dev: dev}]; ok && o.alerted {
+		return o.reason
+	}
+	return ""
+}
+
+// eof
@@ -27,7 +27,13 @@ import (
 	"fmt"
 	"github.com/damicon/zfswatcher/notifier"
 	"github.com/ogier/pflag"
+	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -51,7 +57,17 @@ type cfgType struct {
 		Zfslistrefresh     uint
 		Zfslistcmd         string
 		Zfslistusagecmd    string
+		Zpoolstatustimeout uint
+		Zfslisttimeout     uint
+		Commandbackoffmax  uint
+		Spooldir           string
+		Statedir           string
+		Spoolexpiry        uint
+		Notifyfallback     string
 		Zpooliostatcmd     string
+		Zpooliostathistcmd string
+		Processbackoffmax  uint
+		Processcrashlimit  int
 		Pidfile            string
 	}
 	Severity struct {
@@ -70,33 +86,188 @@ type cfgType struct {
 		Devadditionalinfochanged notifier.Severity
 		Devadditionalinfocleared notifier.Severity
 		Usedspace                percentageToSeverityMap
+		Devlatencyhigh           notifier.Severity
+		Devlatencynormal         notifier.Severity
+		Devoutlier               notifier.Severity
+		Devoutliercleared        notifier.Severity
+		Processfailed            notifier.Severity
+		Processrecovered         notifier.Severity
+		Commandhung              notifier.Severity
+		Commandrecovered         notifier.Severity
+		Outputfailed             notifier.Severity
+		Alertresolved            notifier.Severity
+	}
+	Alerts struct {
+		Enable   bool
+		Level    notifier.Severity
+		Renotify uint
+	}
+	Latency struct {
+		Enable       bool
+		Avgthreshold uint
+		P99threshold uint
+		Duration     uint
+	}
+	Outlier struct {
+		Enable        bool
+		Latencyfactor float64
+		Minlatency    uint
+		Opsfactor     float64
+		Minops        uint
+		Duration      uint
 	}
 	Leds struct {
 		Enable      bool
 		Ledctlcmd   string
 		Devstatemap devStateToIbpiMap
 	}
+	Stdout struct {
+		Enable       bool
+		Level        notifier.Severity
+		Format       string
+		Linetemplate string
+	}
 	Logfile map[string]*struct {
-		Enable bool
-		Level  notifier.Severity
-		File   string
+		Enable       bool
+		Level        notifier.Severity
+		File         string
+		Format       string
+		Linetemplate string
+		Maxsize      byteSize
+		Daily        bool
+		Keep         int
+		Compress     bool
+		Dedup        uint
 	}
 	Syslog map[string]*struct {
-		Enable   bool
-		Level    notifier.Severity
-		Server   string
-		Facility notifier.SyslogFacility
+		Enable             bool
+		Level              notifier.Severity
+		Server             string
+		Facility           notifier.SyslogFacility
+		Format             string
+		Cafile             string
+		Insecureskipverify bool
+		Dedup              uint
+	}
+	Journal map[string]*struct {
+		Enable bool
+		Level  notifier.Severity
+		Socket string
+		Dedup  uint
 	}
 	Email map[string]*struct {
+		Enable             bool
+		Level              notifier.Severity
+		Server             string
+		Username           string
+		Password           string
+		Auth               string
+		Tls                string
+		Cafile             string
+		Insecureskipverify bool
+		From               string
+		To                 string
+		Subject            string
+		Format             string
+		Subjecttemplate    string
+		Bodytemplate       string
+		Bodytemplatefile   string
+		Linetemplate       string
+		Throttle           int64
+		Spool              bool
+		Dedup              uint
+	}
+	Webhook map[string]*struct {
+		Enable             bool
+		Level              notifier.Severity
+		Url                string
+		Batch              bool
+		Headers            httpHeaderMap
+		Secret             string
+		Cafile             string
+		Certfile           string
+		Keyfile            string
+		Insecureskipverify bool
+		Timeout            uint
+		Retries            int
+		Throttle           int64
+		Spool              bool
+		Dedup              uint
+	}
+	Chat map[string]*struct {
+		Enable             bool
+		Level              notifier.Severity
+		Url                string
+		Channel            string
+		Username           string
+		Iconurl            string
+		Statusurl          string
+		Subjecttemplate    string
+		Linetemplate       string
+		Cafile             string
+		Insecureskipverify bool
+		Timeout            uint
+		Retries            int
+		Throttle           int64
+		Spool              bool
+		Dedup              uint
+	}
+	Incident map[string]*struct {
+		Enable             bool
+		Level              notifier.Severity
+		Api                string
+		Url                string
+		Routingkey         string
+		Headers            httpHeaderMap
+		Cafile             string
+		Certfile           string
+		Keyfile            string
+		Insecureskipverify bool
+		Timeout            uint
+		Retries            int
+		Resend             uint
+		Statusurl          string
+		Spool              bool
+	}
+	Program map[string]*struct {
+		Enable           bool
+		Level            notifier.Severity
+		Command          string
+		Batch            bool
+		Timeout          uint
+		Maxprocs         int
+		Bodytemplate     string
+		Bodytemplatefile string
+		Linetemplate     string
+		Dedup            uint
+	}
+	Route map[string]*struct {
 		Enable   bool
-		Level    notifier.Severity
-		Server   string
-		Username string
-		Password string
-		From     string
-		To       string
-		Subject  string
-		Throttle int64
+		Pool     string
+		Device   string
+		Event    string
+		Message  string
+		Time     string
+		Outputs  string
+		Severity string
+	}
+	Escalation map[string]*struct {
+		Enable bool
+		Level  notifier.Severity
+		Pool   poolRegexp
+		Steps  escalationSteps
+	}
+	Silence map[string]*struct {
+		Enable  bool
+		Pool    string
+		Device  string
+		Event   string
+		Message string
+		Start   string
+		End     string
+		Time    string
+		Days    string
+		Comment string
 	}
 	Www struct {
 		Enable               bool
@@ -115,7 +286,34 @@ type cfgType struct {
 	Wwwuser map[string]*struct {
 		Enable   bool
 		Password string
+		Admin    bool
+	}
+	Metrics struct {
+		Enable   bool
+		Auth     string
+		User     string
+		Password string
 	}
+	Mqtt mqttConfig
+}
+
+// The "mqtt" section, a named type because the publisher gets a copy.
+type mqttConfig struct {
+	Enable             bool
+	Level              notifier.Severity
+	Broker             string
+	Clientid           string
+	User               string
+	Password           string
+	Cafile             string
+	Certfile           string
+	Keyfile            string
+	Insecureskipverify bool
+	Topic              string
+	Qos                int
+	Keepalive          uint
+	Discovery          bool
+	Discoveryprefix    string
 }
 
 type stringToStringMap map[string]string
@@ -142,6 +340,136 @@ func (smapp *stringToStringMap) Scan(state fmt.ScanState, verb rune) error {
 	return nil
 }
 
+type httpHeaderMap map[string]string
+
+// Implement fmt.Scanner interface. The headers are separated by semicolons.
+func (hmapp *httpHeaderMap) Scan(state fmt.ScanState, verb rune) error {
+	var str []rune
+	for {
+		r, _, err := state.ReadRune()
+		if err != nil {
+			break
+		}
+		str = append(str, r)
+	}
+	hmap := make(httpHeaderMap)
+	for _, h := range strings.Split(string(str), ";") {
+		if strings.TrimSpace(h) == "" {
+			continue
+		}
+		pair := strings.SplitN(h, ":", 2)
+		if len(pair) != 2 || strings.TrimSpace(pair[0]) == "" {
+			return errors.New(`invalid header "` + strings.TrimSpace(h) + `"`)
+		}
+		hmap[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+	}
+	*hmapp = hmap
+	return nil
+}
+
+// A regular expression which must match the whole pool name, compiled
+// when the configuration is read. A nil Regexp matches all pools.
+type poolRegexp struct {
+	*regexp.Regexp
+}
+
+// Implement fmt.Scanner interface.
+func (prp *poolRegexp) Scan(state fmt.ScanState, verb rune) error {
+	var str []rune
+	for {
+		r, _, err := state.ReadRune()
+		if err != nil {
+			break
+		}
+		str = append(str, r)
+	}
+	pattern := strings.TrimSpace(string(str))
+	if pattern == "" {
+		prp.Regexp = nil
+		return nil
+	}
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return err
+	}
+	prp.Regexp = re
+	return nil
+}
+
+// Tells if the pool name matches.
+func (pr poolRegexp) matches(pool string) bool {
+	return pr.Regexp == nil || pr.MatchString(pool)
+}
+
+type escalationStep struct {
+	after   time.Duration
+	outputs []string
+}
+
+type escalationSteps []escalationStep
+
+// Implement fmt.Scanner interface. The steps are separated by semicolons,
+// each step is the delay in minutes followed by the output names.
+func (esp *escalationSteps) Scan(state fmt.ScanState, verb rune) error {
+	var str []rune
+	for {
+		r, _, err := state.ReadRune()
+		if err != nil {
+			break
+		}
+		str = append(str, r)
+	}
+	var es escalationSteps
+	for _, step := range strings.Split(string(str), ";") {
+		f := strings.Fields(step)
+		if len(f) == 0 {
+			continue
+		}
+		min, err := strconv.ParseUint(f[0], 10, 32)
+		if err != nil || len(f) < 2 {
+			return errors.New(`invalid step "` + strings.TrimSpace(step) + `"`)
+		}
+		if len(es) > 0 && time.Duration(min)*time.Minute < es[len(es)-1].after {
+			return errors.New(`steps are not in order`)
+		}
+		es = append(es, escalationStep{after: time.Duration(min) * time.Minute, outputs: f[1:]})
+	}
+	*esp = es
+	return nil
+}
+
+type byteSize int64
+
+// Implement fmt.Scanner interface. The size may have a suffix "k", "M" or
+// "G" (powers of 1024).
+func (bsp *byteSize) Scan(state fmt.ScanState, verb rune) error {
+	tok, err := state.Token(true, nil)
+	if err != nil {
+		return err
+	}
+	str := string(tok)
+	mult := int64(1)
+	if len(str) > 0 {
+		switch str[len(str)-1] {
+		case 'k', 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		}
+		if mult != 1 {
+			str = str[:len(str)-1]
+		}
+	}
+	size, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || size < 0 || size > math.MaxInt64/mult {
+		return errors.New(`invalid size "` + string(tok) + `"`)
+	}
+	*bsp = byteSize(size * mult)
+	return nil
+}
+
 type stateToSeverityMap map[string]notifier.Severity
 
 // Implement fmt.Scanner interface on top of two other fmt.Scanner interfaces.
@@ -245,6 +573,14 @@ func getCfg() *cfgType {
 	c.Main.Zfslistrefresh = 60
 	c.Main.Zfslistcmd = "zfs list -H -o name,avail,used,usedsnap,usedds,usedrefreserv,usedchild,refer,mountpoint -d 0"
 	c.Main.Zfslistusagecmd = "zfs list -H -o name,avail,used,usedsnap,usedds,usedrefreserv,usedchild,refer,mountpoint -r -t all"
+	c.Main.Zpoolstatustimeout = 60
+	c.Main.Zfslisttimeout = 120
+	c.Main.Commandbackoffmax = 600
+	c.Main.Spooldir = "/var/spool/zfswatcher"
+	c.Main.Statedir = "/var/lib/zfswatcher"
+	c.Main.Spoolexpiry = 86400
+	c.Main.Processbackoffmax = 300
+	c.Main.Processcrashlimit = 5
 	c.Leds.Ledctlcmd = "ledctl"
 	c.Severity.Pooladded = notifier.INFO
 	c.Severity.Poolremoved = notifier.INFO
@@ -258,51 +594,395 @@ func getCfg() *cfgType {
 	c.Severity.Devcksumerrorsincreased = notifier.INFO
 	c.Severity.Devadditionalinfochanged = notifier.INFO
 	c.Severity.Devadditionalinfocleared = notifier.INFO
+	c.Severity.Devlatencyhigh = notifier.INFO
+	c.Severity.Devlatencynormal = notifier.INFO
+	c.Latency.Duration = 300
+	c.Severity.Devoutlier = notifier.INFO
+	c.Severity.Devoutliercleared = notifier.INFO
+	c.Outlier.Latencyfactor = 3
+	c.Outlier.Minlatency = 20
+	c.Outlier.Opsfactor = 3
+	c.Outlier.Minops = 10
+	c.Outlier.Duration = 600
+	c.Severity.Processfailed = notifier.ERR
+	c.Severity.Processrecovered = notifier.INFO
+	c.Severity.Commandhung = notifier.CRIT
+	c.Severity.Commandrecovered = notifier.INFO
+	c.Severity.Outputfailed = notifier.ERR
+	c.Severity.Alertresolved = notifier.INFO
+	c.Alerts.Level = notifier.WARNING
+	c.Metrics.Auth = "www"
+	c.Mqtt.Level = notifier.INFO
+	c.Mqtt.Keepalive = 60
+	c.Mqtt.Discoveryprefix = "homeassistant"
+	c.Stdout.Level = notifier.DEBUG
 
 	// read configuration settings:
 	err := gcfg.ReadFileInto(&c, cfgFile)
 	checkCfgErr(cfgFile, "", "", "", err, &errorSeen)
 
+	switch c.Metrics.Auth {
+	case "www", "none":
+	case "user":
+		if c.Metrics.User == "" || c.Metrics.Password == "" {
+			checkCfgErr(cfgFile, "metrics", "", "user",
+				errors.New(`"user" and "password" must be defined`), &errorSeen)
+		}
+	default:
+		checkCfgErr(cfgFile, "metrics", "", "auth",
+			errors.New(`invalid value "`+c.Metrics.Auth+`"`), &errorSeen)
+	}
+
+	if c.Mqtt.Enable {
+		switch {
+		case c.Mqtt.Broker == "":
+			checkCfgErr(cfgFile, "mqtt", "", "broker",
+				errors.New(`"broker" not defined`), &errorSeen)
+		case c.Mqtt.Qos != 0 && c.Mqtt.Qos != 1:
+			checkCfgErr(cfgFile, "mqtt", "", "qos",
+				errors.New(`invalid value, must be 0 or 1`), &errorSeen)
+		case c.Mqtt.Keepalive == 0 || c.Mqtt.Keepalive > 65535:
+			checkCfgErr(cfgFile, "mqtt", "", "keepalive",
+				errors.New(`invalid value`), &errorSeen)
+		}
+		_, err := mqttTLSConfig(&c.Mqtt)
+		checkCfgErr(cfgFile, "mqtt", "", "", err, &errorSeen)
+	}
+
+	// read the body templates which are in files of their own:
+	for prof, s := range c.Email {
+		err := readTemplateFile(&s.Bodytemplate, s.Bodytemplatefile)
+		checkCfgErr(cfgFile, "email", prof, "bodytemplatefile", err, &errorSeen)
+	}
+	for prof, s := range c.Program {
+		err := readTemplateFile(&s.Bodytemplate, s.Bodytemplatefile)
+		checkCfgErr(cfgFile, "program", prof, "bodytemplatefile", err, &errorSeen)
+	}
+
 	if errorSeen {
 		return nil
 	}
 	return &c
 }
 
-// Setup logging.
-func setupLog(c *cfgType) *notifier.Notifier {
+// Returns the spool settings of a logging destination. Each destination
+// has a spool directory of its own.
+func spoolConfig(c *cfgType, sect, prof string, enable bool) notifier.SpoolConfig {
+	if !enable {
+		return notifier.SpoolConfig{}
+	}
+	return notifier.SpoolConfig{
+		Dir:    filepath.Join(c.Main.Spooldir, sect+"-"+strings.Replace(prof, "/", "_", -1)),
+		Expiry: time.Second * time.Duration(c.Main.Spoolexpiry),
+	}
+}
+
+// Name the logging destination which was added last and set its common
+// options.
+func setupOutput(n *notifier.Notifier, err error, sect, prof string, dedup uint) error {
+	if err != nil {
+		return err
+	}
+	if err = n.SetOutputName(sect + ":" + prof); err != nil {
+		return err
+	}
+	return n.SetOutputDedup(time.Second * time.Duration(dedup))
+}
+
+// Read a template from a file if the file name is defined.
+func readTemplateFile(tmpl *string, file string) error {
+	if file == "" {
+		return nil
+	}
+	if *tmpl != "" {
+		return errors.New(`both "bodytemplate" and "bodytemplatefile" defined`)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	*tmpl = string(b)
+	return nil
+}
+
+// Setup logging. Spooling can be disabled for test notifications and so
+// can the local outputs (stdout, log files, journal and programs) for the
+// test notifications of the web interface. Returns false if there were
+// errors in the settings of the outputs, the outputs without errors are
+// set up anyway.
+func setupLog(c *cfgType, spool, local bool) (*notifier.Notifier, bool) {
 	var errorSeen bool
 
 	n := notifier.New()
-	if optDebug {
-		n.AddLoggerStdout(notifier.DEBUG)
+	n.SetPoolSummary(getPoolSummary)
+	if local && (optDebug || c.Stdout.Enable) {
+		level := c.Stdout.Level
+		if optDebug {
+			level = notifier.DEBUG
+		}
+		var err error
+		switch c.Stdout.Format {
+		case "", "text", "json":
+			err = n.AddLoggerStdoutConfig(level, notifier.StdoutConfig{
+				JSON:     c.Stdout.Format == "json",
+				Template: notifier.TemplateConfig{Line: c.Stdout.Linetemplate},
+			})
+		default:
+			err = errors.New(`invalid "format"`)
+		}
+		if err == nil {
+			err = n.SetOutputName("stdout")
+		}
+		checkCfgErr(cfgFile, "stdout", "", "", err, &errorSeen)
 	}
 
 	for prof, s := range c.Logfile {
-		if s.Enable {
-			err := n.AddLoggerFile(s.Level, s.File)
+		if local && s.Enable {
+			var err error
+			switch s.Format {
+			case "", "text", "json":
+				err = n.AddLoggerFileConfig(s.Level, notifier.FileConfig{
+					File:     s.File,
+					MaxSize:  int64(s.Maxsize),
+					Daily:    s.Daily,
+					Keep:     s.Keep,
+					Compress: s.Compress,
+					JSON:     s.Format == "json",
+					Template: notifier.TemplateConfig{Line: s.Linetemplate},
+				})
+			default:
+				err = errors.New(`invalid "format"`)
+			}
+			err = setupOutput(n, err, "logfile", prof, s.Dedup)
 			checkCfgErr(cfgFile, "logfile", prof, "", err, &errorSeen)
 		}
 	}
 	for prof, s := range c.Syslog {
 		if s.Enable {
-			err := n.AddLoggerSyslog(s.Level, s.Server, s.Facility)
+			var err error
+			switch s.Format {
+			case "", "bsd", "rfc5424":
+				err = n.AddLoggerSyslogConfig(s.Level, notifier.SyslogConfig{
+					Address:  s.Server,
+					Facility: s.Facility,
+					RFC5424:  s.Format == "rfc5424",
+					CAFile:   s.Cafile,
+					Insecure: s.Insecureskipverify,
+				})
+			default:
+				err = errors.New(`invalid "format"`)
+			}
+			err = setupOutput(n, err, "syslog", prof, s.Dedup)
 			checkCfgErr(cfgFile, "syslog", prof, "", err, &errorSeen)
 		}
 	}
+	for prof, s := range c.Journal {
+		if local && s.Enable {
+			err := n.AddLoggerJournal(s.Level, s.Socket, "ZFS_")
+			err = setupOutput(n, err, "journal", prof, s.Dedup)
+			checkCfgErr(cfgFile, "journal", prof, "", err, &errorSeen)
+		}
+	}
 	for prof, s := range c.Email {
 		if s.Enable {
-			err := n.AddLoggerEmailSMTP(s.Level,
-				s.Server, s.Username, s.Password, s.From, s.To, s.Subject,
-				time.Second*time.Duration(s.Throttle))
+			var err error
+			switch s.Format {
+			case "", "text", "html":
+				err = n.AddLoggerEmailSMTPConfig(s.Level, notifier.SMTPConfig{
+					Server:   s.Server,
+					Username: s.Username,
+					Password: s.Password,
+					Auth:     s.Auth,
+					TLS:      s.Tls,
+					CAFile:   s.Cafile,
+					Insecure: s.Insecureskipverify,
+					From:     s.From,
+					To:       s.To,
+					Subject:  s.Subject,
+					HTML:     s.Format == "html",
+					Throttle: time.Second * time.Duration(s.Throttle),
+					Spool:    spoolConfig(c, "email", prof, s.Spool && spool),
+					Template: notifier.TemplateConfig{
+						Subject: s.Subjecttemplate,
+						Body:    s.Bodytemplate,
+						Line:    s.Linetemplate,
+					},
+				})
+			default:
+				err = errors.New(`invalid "format"`)
+			}
+			err = setupOutput(n, err, "email", prof, s.Dedup)
 			checkCfgErr(cfgFile, "email", prof, "", err, &errorSeen)
 		}
 	}
+	for prof, s := range c.Webhook {
+		if s.Enable {
+			err := n.AddLoggerWebhook(s.Level, notifier.WebhookConfig{
+				URL:      s.Url,
+				Batch:    s.Batch,
+				Headers:  s.Headers,
+				Secret:   s.Secret,
+				CAFile:   s.Cafile,
+				CertFile: s.Certfile,
+				KeyFile:  s.Keyfile,
+				Insecure: s.Insecureskipverify,
+				Timeout:  time.Second * time.Duration(s.Timeout),
+				Retries:  s.Retries,
+				Throttle: time.Second * time.Duration(s.Throttle),
+				Spool:    spoolConfig(c, "webhook", prof, s.Spool && spool),
+			})
+			err = setupOutput(n, err, "webhook", prof, s.Dedup)
+			checkCfgErr(cfgFile, "webhook", prof, "", err, &errorSeen)
+		}
+	}
+	for prof, s := range c.Chat {
+		if s.Enable {
+			err := n.AddLoggerChat(s.Level, notifier.ChatConfig{
+				WebhookConfig: notifier.WebhookConfig{
+					URL:      s.Url,
+					CAFile:   s.Cafile,
+					Insecure: s.Insecureskipverify,
+					Timeout:  time.Second * time.Duration(s.Timeout),
+					Retries:  s.Retries,
+					Throttle: time.Second * time.Duration(s.Throttle),
+					Spool:    spoolConfig(c, "chat", prof, s.Spool && spool),
+				},
+				Channel:   s.Channel,
+				Username:  s.Username,
+				IconURL:   s.Iconurl,
+				StatusURL: s.Statusurl,
+				Template: notifier.TemplateConfig{
+					Subject: s.Subjecttemplate,
+					Line:    s.Linetemplate,
+				},
+			})
+			err = setupOutput(n, err, "chat", prof, s.Dedup)
+			checkCfgErr(cfgFile, "chat", prof, "", err, &errorSeen)
+		}
+	}
+	for prof, s := range c.Incident {
+		if s.Enable {
+			err := n.AddLoggerIncident(s.Level, notifier.IncidentConfig{
+				WebhookConfig: notifier.WebhookConfig{
+					URL:      s.Url,
+					Headers:  s.Headers,
+					CAFile:   s.Cafile,
+					CertFile: s.Certfile,
+					KeyFile:  s.Keyfile,
+					Insecure: s.Insecureskipverify,
+					Timeout:  time.Second * time.Duration(s.Timeout),
+					Retries:  s.Retries,
+					Spool:    spoolConfig(c, "incident", prof, s.Spool && spool),
+				},
+				API:        s.Api,
+				RoutingKey: s.Routingkey,
+				Resend:     time.Second * time.Duration(s.Resend),
+				StatusURL:  s.Statusurl,
+			})
+			err = setupOutput(n, err, "incident", prof, 0)
+			checkCfgErr(cfgFile, "incident", prof, "", err, &errorSeen)
+		}
+	}
+	for prof, s := range c.Program {
+		if local && s.Enable {
+			err := n.AddLoggerProgramConfig(s.Level, notifier.ProgramConfig{
+				Command:  s.Command,
+				Batch:    s.Batch,
+				Timeout:  time.Second * time.Duration(s.Timeout),
+				MaxProcs: s.Maxprocs,
+				Template: notifier.TemplateConfig{
+					Body: s.Bodytemplate,
+					Line: s.Linetemplate,
+				},
+			})
+			err = setupOutput(n, err, "program", prof, s.Dedup)
+			checkCfgErr(cfgFile, "program", prof, "", err, &errorSeen)
+		}
+	}
 	if c.Www.Enable && c.Www.Logbuffer > 0 {
 		err := n.AddLoggerCallback(c.Www.Level, wwwLogReceiver)
+		if err == nil {
+			err = n.SetOutputName("www")
+		}
 		checkCfgErr(cfgFile, "www", "", "", err, &errorSeen)
 	}
-	return n
+	if c.Mqtt.Enable {
+		err := n.AddLoggerCallback(c.Mqtt.Level, mqttLogReceiver)
+		if err == nil {
+			err = n.SetOutputName("mqtt")
+		}
+		checkCfgErr(cfgFile, "mqtt", "", "", err, &errorSeen)
+	}
+	// routing rules are evaluated in the order of their names:
+	var routes []string
+	for prof := range c.Route {
+		routes = append(routes, prof)
+	}
+	sort.Strings(routes)
+	for _, prof := range routes {
+		s := c.Route[prof]
+		if !s.Enable {
+			continue
+		}
+		rt := notifier.Route{
+			Name:    prof,
+			Pool:    s.Pool,
+			Device:  s.Device,
+			Event:   s.Event,
+			Message: s.Message,
+			Time:    s.Time,
+			Outputs: strings.Fields(s.Outputs),
+		}
+		var err error
+		if s.Severity != "" {
+			var sev notifier.Severity
+			_, err = fmt.Sscan(s.Severity, &sev)
+			rt.Severity = &sev
+		}
+		if err == nil {
+			err = n.AddRoute(rt)
+		}
+		checkCfgErr(cfgFile, "route", prof, "", err, &errorSeen)
+	}
+	var silences []string
+	for prof := range c.Silence {
+		silences = append(silences, prof)
+	}
+	sort.Strings(silences)
+	for _, prof := range silences {
+		s := c.Silence[prof]
+		if !s.Enable {
+			continue
+		}
+		sl, err := configSilence(prof, s.Pool, s.Device, s.Event, s.Message,
+			s.Start, s.End, s.Time, s.Days, s.Comment)
+		if err == nil {
+			err = n.AddSilence(sl)
+		}
+		checkCfgErr(cfgFile, "silence", prof, "", err, &errorSeen)
+	}
+	for prof, s := range c.Escalation {
+		if !s.Enable {
+			continue
+		}
+		var err error
+		switch {
+		case !c.Alerts.Enable:
+			err = errors.New(`escalations require "enable" in the "alerts" section`)
+		case len(s.Steps) == 0:
+			err = errors.New(`no "steps"`)
+		default:
+			for _, step := range s.Steps {
+				if err == nil {
+					err = n.CheckOutputs(step.outputs)
+				}
+			}
+		}
+		checkCfgErr(cfgFile, "escalation", prof, "", err, &errorSeen)
+	}
+	err := n.SetOutputErrors(c.Severity.Outputfailed, strings.Fields(c.Main.Notifyfallback))
+	checkCfgErr(cfgFile, "main", "", "notifyfallback", err, &errorSeen)
+	return n, !errorSeen
 }
 
 // Initial setup when the program starts.
@@ -316,6 +996,10 @@ func setup() {
 	optHashPassword := pflag.BoolP("passwordhash", "P", false, "hash web password")
 	optTest := pflag.BoolP("test", "t", false, "test configuration and exit")
 	optVersion := pflag.BoolP("version", "v", false, "print version information and exit")
+	optTestNotify := pflag.String("test-notify", "", "send a test notification with the given severity and exit")
+	optSilence := pflag.String("silence", "", "add a silence (comma separated key=value pairs) and exit")
+	optUnsilence := pflag.String("unsilence", "", "remove the silence with the given id and exit")
+	optListSilences := pflag.Bool("list-silences", false, "list the silences and exit")
 
 	pflag.Parse()
 
@@ -342,7 +1026,20 @@ func setup() {
 	if cfg == nil {
 		os.Exit(2)
 	}
-	notify = setupLog(cfg)
+	if *optTestNotify != "" {
+		testNotifyCmd(cfg, *optTestNotify)
+	}
+	if *optSilence != "" {
+		silenceCmd(cfg, *optSilence)
+	}
+	if *optUnsilence != "" {
+		unsilenceCmd(cfg, *optUnsilence)
+	}
+	if *optListSilences {
+		listSilencesCmd(cfg)
+	}
+	var logOk bool
+	notify, logOk = setupLog(cfg, true, true)
 
 	if *optTest {
 		notifyCloseC := notify.Close()
@@ -350,6 +1047,9 @@ func setup() {
 		case <-notifyCloseC:
 		case <-time.After(time.Second):
 		}
+		if !logOk {
+			os.Exit(2)
+		}
 		os.Exit(0)
 	}
 }
@@ -361,14 +1061,28 @@ func reconfigure() {
 		notify.Send(notifier.CRIT, "invalid configuration "+cfgFile+", keeping old configuration")
 		return
 	}
+	// the MQTT publisher is only started at startup, but the level
+	// applies to its logging output right away:
+	oldMqtt, newMqtt := cfg.Mqtt, newcfg.Mqtt
+	oldMqtt.Level = newMqtt.Level
+	globalsMutex.Lock()
 	cfg = newcfg
-	newNotify := setupLog(cfg)
+	globalsMutex.Unlock()
+	newNotify, _ := setupLog(cfg, true, true)
 	if newNotify == nil {
 		notify.Send(notifier.CRIT, "error setting up logs, keeping old logging configuration")
 	}
+	globalsMutex.Lock()
 	oldnotify := notify
 	notify = newNotify
+	globalsMutex.Unlock()
 	oldnotify.Close()
+	loadSilences(notify, true)
+	notify.CopySilenceState(oldnotify) // for the summaries
+	if newMqtt != oldMqtt {
+		notify.Print(notifier.WARNING, `the changed "mqtt" settings take effect when zfswatcher is restarted`)
+	}
+	resendAlerts()
 	// XXX restart web
 }
 
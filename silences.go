@@ -0,0 +1,425 @@
+//
+// silences.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/damicon/zfswatcher/notifier"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Silences (maintenance windows) suppress the matching notifications from
+// the outputs which are flushed, such as e-mail. The silences come from
+// the "silence" sections of the configuration file and from the silence
+// file in "statedir", which is modified from the web interface and from
+// the command line. The running program reloads the silence file when it
+// has been modified. The modifications are serialized with a lock file
+// because the command line options run in separate processes.
+
+const silence_FILE = "silences.json"
+
+// The format of "start" and "end" (local time).
+const silence_TIME_FORMAT = "2006-01-02 15:04"
+
+var silenceFile struct {
+	silences []notifier.Silence // as loaded to the notifier
+	modTime  time.Time
+	mutex    sync.Mutex
+}
+
+func silenceFilePath(c *cfgType) string {
+	return filepath.Join(c.Main.Statedir, silence_FILE)
+}
+
+// Reads the silence file, a missing file has no silences.
+func readSilenceFile(fn string) ([]notifier.Silence, error) {
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ss []notifier.Silence
+	if err = json.Unmarshal(b, &ss); err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	return ss, nil
+}
+
+// Locks the silence file against the modifications by other processes.
+// The lock is released by closing the returned file.
+func lockSilenceFile(fn string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(fn+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func writeSilenceFile(fn string, ss []notifier.Silence) error {
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(ss, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := fn + ".tmp"
+	if err = ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// Makes a silence from a "silence" section of the configuration file.
+func configSilence(name string, pool, device, event, message, start, end, tod, days, comment string) (notifier.Silence, error) {
+	s := notifier.Silence{
+		ID:      name,
+		Pool:    pool,
+		Device:  device,
+		Event:   event,
+		Message: message,
+		Time:    tod,
+		Days:    days,
+		Comment: comment,
+		Creator: "configuration",
+	}
+	var err error
+	if start != "" {
+		if s.Start, err = time.ParseInLocation(silence_TIME_FORMAT, start, time.Local); err != nil {
+			return s, errors.New(`invalid "start"`)
+		}
+	}
+	if end != "" {
+		if s.End, err = time.ParseInLocation(silence_TIME_FORMAT, end, time.Local); err != nil {
+			return s, errors.New(`invalid "end"`)
+		}
+	}
+	return s, notifier.CheckSilence(s)
+}
+
+func newSilenceID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+// Makes a new silence from the values given in the web interface or on the
+// command line. The silence must end at "end" or after "duration" unless
+// it is recurring ("time" or "days").
+func newSilence(get func(key string) string, creator string, now time.Time) (notifier.Silence, error) {
+	s, err := configSilence(newSilenceID(), get("pool"), get("device"), get("event"),
+		get("message"), get("start"), get("end"), get("time"), get("days"), get("comment"))
+	if err != nil {
+		return s, err
+	}
+	s.Creator = creator
+	if d := get("duration"); d != "" {
+		dur, err := time.ParseDuration(d)
+		if err != nil || dur <= 0 {
+			return s, errors.New(`invalid "duration"`)
+		}
+		if s.Start.IsZero() {
+			s.End = now.Add(dur)
+		} else {
+			s.End = s.Start.Add(dur)
+		}
+	}
+	if s.End.IsZero() && s.Time == "" && s.Days == "" {
+		return s, errors.New(`"duration" or "end" is required`)
+	}
+	if !s.End.IsZero() && !s.End.After(now) {
+		return s, errors.New(`"end" is in the past`)
+	}
+	return s, notifier.CheckSilence(s)
+}
+
+// Loads the silence file to the notifier if it has been modified since
+// the previous call or if force is true. The silences which have ended
+// are removed from the file.
+func loadSilences(n *notifier.Notifier, force bool) {
+	silenceFile.mutex.Lock()
+	defer silenceFile.mutex.Unlock()
+
+	fn := silenceFilePath(cfg)
+	var modTime time.Time
+	if fi, err := os.Stat(fn); err == nil {
+		modTime = fi.ModTime()
+	}
+	if !force && modTime.Equal(silenceFile.modTime) && !silencesExpired(silenceFile.silences) {
+		return
+	}
+	lf, err := lockSilenceFile(fn)
+	if err != nil {
+		notify.Printf(notifier.ERR, "error locking silences: %s", err)
+		return
+	}
+	defer lf.Close()
+	ss, err := readSilenceFile(fn)
+	if err != nil {
+		notify.Printf(notifier.ERR, "error reading silences: %s", err)
+		return
+	}
+	var kept, valid []notifier.Silence
+	for _, s := range ss {
+		if silencesExpired([]notifier.Silence{s}) {
+			continue
+		}
+		kept = append(kept, s)
+		if err := n.AddSilence(s); err != nil {
+			notify.Printf(notifier.ERR, `invalid silence "%s" in %s: %s`, s.ID, fn, err)
+			continue
+		}
+		valid = append(valid, s)
+	}
+	for _, old := range silenceFile.silences {
+		if findSilence(valid, old.ID) < 0 {
+			n.RemoveSilence(old.ID)
+		}
+	}
+	if len(kept) < len(ss) {
+		if err = writeSilenceFile(fn, kept); err != nil {
+			notify.Printf(notifier.ERR, "error writing silences: %s", err)
+		} else if fi, err := os.Stat(fn); err == nil {
+			modTime = fi.ModTime()
+		}
+	}
+	silenceFile.silences = valid
+	silenceFile.modTime = modTime
+}
+
+// Returns true if any of the silences has ended.
+func silencesExpired(ss []notifier.Silence) bool {
+	now := time.Now()
+	for _, s := range ss {
+		if !s.End.IsZero() && !now.Before(s.End) {
+			return true
+		}
+	}
+	return false
+}
+
+func findSilence(ss []notifier.Silence, id string) int {
+	for i, s := range ss {
+		if s.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Reads the silence file, modifies the silences with f and writes the
+// file while holding the lock.
+func modifySilenceFile(fn string, f func([]notifier.Silence) ([]notifier.Silence, error)) error {
+	lf, err := lockSilenceFile(fn)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+	ss, err := readSilenceFile(fn)
+	if err == nil {
+		ss, err = f(ss)
+	}
+	if err == nil {
+		err = writeSilenceFile(fn, ss)
+	}
+	return err
+}
+
+func appendSilence(s notifier.Silence) func([]notifier.Silence) ([]notifier.Silence, error) {
+	return func(ss []notifier.Silence) ([]notifier.Silence, error) {
+		return append(ss, s), nil
+	}
+}
+
+func deleteSilence(id string) func([]notifier.Silence) ([]notifier.Silence, error) {
+	return func(ss []notifier.Silence) ([]notifier.Silence, error) {
+		i := findSilence(ss, id)
+		if i < 0 {
+			return nil, errors.New(`no silence "` + id + `"`)
+		}
+		return append(ss[:i], ss[i+1:]...), nil
+	}
+}
+
+// Adds a silence to the silence file and loads it to the notifier.
+func addSilence(s notifier.Silence) error {
+	silenceFile.mutex.Lock()
+	err := modifySilenceFile(silenceFilePath(cfg), appendSilence(s))
+	silenceFile.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	loadSilences(notify, true)
+	return nil
+}
+
+// Removes a silence from the silence file and from the notifier.
+func removeSilence(id string) error {
+	silenceFile.mutex.Lock()
+	err := modifySilenceFile(silenceFilePath(cfg), deleteSilence(id))
+	silenceFile.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	loadSilences(notify, true)
+	return nil
+}
+
+// Describes the conditions of a silence.
+func silenceConditions(s notifier.Silence) string {
+	var conds []string
+	for _, c := range []struct{ key, value string }{
+		{"pool", s.Pool}, {"device", s.Device}, {"event", s.Event},
+		{"message", s.Message}, {"time", s.Time}, {"days", s.Days},
+	} {
+		if c.value != "" {
+			conds = append(conds, c.key+"="+c.value)
+		}
+	}
+	if len(conds) == 0 {
+		return "everything"
+	}
+	return strings.Join(conds, " ")
+}
+
+// Describes the time window of a silence.
+func silenceWindow(s notifier.Silence) string {
+	var from, until string
+	if !s.Start.IsZero() {
+		from = s.Start.Format(silence_TIME_FORMAT)
+	}
+	if !s.End.IsZero() {
+		until = s.End.Format(silence_TIME_FORMAT)
+	}
+	switch {
+	case from == "" && until == "":
+		return "always"
+	case from == "":
+		return "until " + until
+	case until == "":
+		return "from " + from
+	}
+	return from + " - " + until
+}
+
+// Implements the --silence command line option. The specification is a
+// comma separated list of key=value pairs.
+func silenceCmd(c *cfgType, spec string) {
+	values := make(map[string]string)
+	for _, kv := range strings.Split(spec, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			fmt.Fprintf(os.Stderr, "%s: invalid silence \"%s\": missing \"=\"\n", os.Args[0], kv)
+			os.Exit(2)
+		}
+		values[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+	}
+	for k := range values {
+		switch k {
+		case "pool", "device", "event", "message", "start", "end",
+			"duration", "time", "days", "comment":
+		default:
+			fmt.Fprintf(os.Stderr, "%s: invalid silence key \"%s\"\n", os.Args[0], k)
+			os.Exit(2)
+		}
+	}
+	creator := "command line"
+	if user := os.Getenv("USER"); user != "" {
+		creator = user + " (command line)"
+	}
+	s, err := newSilence(func(k string) string { return values[k] }, creator, time.Now())
+	if err == nil {
+		err = modifySilenceFile(silenceFilePath(c), appendSilence(s))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+		os.Exit(1)
+	}
+	fmt.Printf("added silence %s: %s, %s\n", s.ID, silenceConditions(s), silenceWindow(s))
+	os.Exit(0)
+}
+
+// Implements the --unsilence command line option.
+func unsilenceCmd(c *cfgType, id string) {
+	err := modifySilenceFile(silenceFilePath(c), deleteSilence(id))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+		os.Exit(1)
+	}
+	fmt.Printf("removed silence %s\n", id)
+	os.Exit(0)
+}
+
+// Implements the --list-silences command line option.
+func listSilencesCmd(c *cfgType) {
+	var names []string
+	for name, s := range c.Silence {
+		if s.Enable {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var ss []notifier.Silence
+	for _, name := range names {
+		s := c.Silence[name]
+		sl, _ := configSilence(name, s.Pool, s.Device, s.Event, s.Message,
+			s.Start, s.End, s.Time, s.Days, s.Comment)
+		ss = append(ss, sl)
+	}
+	fs, err := readSilenceFile(silenceFilePath(c))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+		os.Exit(1)
+	}
+	for _, s := range append(ss, fs...) {
+		line := fmt.Sprintf("%-10s %s, %s, by %s", s.ID, silenceConditions(s), silenceWindow(s), s.Creator)
+		if s.Comment != "" {
+			line += ": " + s.Comment
+		}
+		fmt.Println(line)
+	}
+	os.Exit(0)
+}
+
+// eof
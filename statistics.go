@@ -0,0 +1,436 @@
+//
+// statistics.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Statistics history. The samples are stored in round robin archives
+// similar to rrdtool: each selectable time range has its own archive with
+// a fixed number of consolidated (averaged) data points.
+
+type statRange struct {
+	Name     string
+	Duration time.Duration
+	Step     time.Duration
+}
+
+var statRanges = []statRange{
+	{"1h", time.Hour, 10 * time.Second},
+	{"24h", 24 * time.Hour, 5 * time.Minute},
+	{"7d", 7 * 24 * time.Hour, 30 * time.Minute},
+	{"30d", 30 * 24 * time.Hour, 2 * time.Hour},
+}
+
+// Find a time range by name, returns the first (shortest) range as default.
+func getStatRange(name string) (int, statRange) {
+	for n, r := range statRanges {
+		if r.Name == name {
+			return n, r
+		}
+	}
+	return 0, statRanges[0]
+}
+
+// Names of the collected metrics.
+const (
+	smOPSREAD  = "opsread"
+	smOPSWRITE = "opswrite"
+	smBWREAD   = "bwread"
+	smBWWRITE  = "bwwrite"
+	smALLOC    = "alloc"
+	smUSED     = "used"
+	smARCHIT   = "archit"
+	// latencies in milliseconds:
+	smTOTALWAITREAD  = "totalwaitread"
+	smTOTALWAITWRITE = "totalwaitwrite"
+	smDISKWAITREAD   = "diskwaitread"
+	smDISKWAITWRITE  = "diskwaitwrite"
+	smDISKWAITP99    = "diskwaitp99"
+)
+
+type statPoint struct {
+	Time  time.Time
+	Value float64
+}
+
+// A single round robin archive.
+type statArchive struct {
+	step   time.Duration
+	points []statPoint
+	next   int
+	full   bool
+	// consolidation of the current step:
+	cur   time.Time
+	sum   float64
+	count int
+}
+
+func newStatArchive(r statRange) *statArchive {
+	return &statArchive{
+		step:   r.Step,
+		points: make([]statPoint, int(r.Duration/r.Step)),
+	}
+}
+
+func (a *statArchive) add(t time.Time, v float64) {
+	slot := t.Truncate(a.step)
+	if a.count > 0 && !slot.Equal(a.cur) {
+		a.points[a.next] = statPoint{Time: a.cur, Value: a.sum / float64(a.count)}
+		a.next++
+		if a.next == len(a.points) {
+			a.next = 0
+			a.full = true
+		}
+		a.sum, a.count = 0, 0
+	}
+	a.cur = slot
+	a.sum += v
+	a.count++
+}
+
+// Return the data points in chronological order including the
+// currently consolidated step.
+func (a *statArchive) get() []statPoint {
+	var pts []statPoint
+	if a.full {
+		pts = append(pts, a.points[a.next:]...)
+	}
+	pts = append(pts, a.points[:a.next]...)
+	if a.count > 0 {
+		pts = append(pts, statPoint{Time: a.cur, Value: a.sum / float64(a.count)})
+	}
+	return pts
+}
+
+// A time series has one archive for each time range.
+type statSeries []*statArchive
+
+func newStatSeries() statSeries {
+	s := make(statSeries, len(statRanges))
+	for n, r := range statRanges {
+		s[n] = newStatArchive(r)
+	}
+	return s
+}
+
+func (s statSeries) add(t time.Time, v float64) {
+	for _, a := range s {
+		a.add(t, v)
+	}
+}
+
+type statKey struct {
+	pool   string
+	dev    string
+	metric string
+}
+
+var statistics struct {
+	series map[statKey]statSeries
+	mutex  sync.RWMutex
+	// previous ARC counters for calculating the hit rate:
+	arcHits   int64
+	arcMisses int64
+	// latest iostat report for the metrics page:
+	lastIostat     *ZpoolIostatTable
+	lastIostatTime time.Time
+}
+
+// Must be called when statistics.mutex is locked!
+func statAdd(t time.Time, pool, dev, metric string, v float64) {
+	if v < 0 {
+		return // not available
+	}
+	if statistics.series == nil {
+		statistics.series = make(map[statKey]statSeries)
+	}
+	key := statKey{pool, dev, metric}
+	s, ok := statistics.series[key]
+	if !ok {
+		s = newStatSeries()
+		statistics.series[key] = s
+	}
+	s.add(t, v)
+}
+
+// Get data points of a series for the given range.
+func statGet(rangeidx int, pool, dev, metric string) []statPoint {
+	statistics.mutex.RLock()
+	defer statistics.mutex.RUnlock()
+
+	s, ok := statistics.series[statKey{pool, dev, metric}]
+	if !ok {
+		return nil
+	}
+	return s[rangeidx].get()
+}
+
+// Record "zpool iostat" output.
+func statAddIostat(t time.Time, table *ZpoolIostatTable) {
+	statistics.mutex.Lock()
+	defer statistics.mutex.Unlock()
+
+	statistics.lastIostat = table
+	statistics.lastIostatTime = t
+
+	for pool, entry := range *table {
+		for dev, row := range entry {
+			statAdd(t, pool, dev, smOPSREAD, float64(row.OperationsRead))
+			statAdd(t, pool, dev, smOPSWRITE, float64(row.OperationsWrite))
+			statAdd(t, pool, dev, smBWREAD, float64(row.BandwidthRead))
+			statAdd(t, pool, dev, smBWWRITE, float64(row.BandwidthWrite))
+			statAdd(t, pool, dev, smALLOC, float64(row.CapacityAlloc))
+			statAdd(t, pool, dev, smTOTALWAITREAD, durationToMs(row.TotalWaitRead))
+			statAdd(t, pool, dev, smTOTALWAITWRITE, durationToMs(row.TotalWaitWrite))
+			statAdd(t, pool, dev, smDISKWAITREAD, durationToMs(row.DiskWaitRead))
+			statAdd(t, pool, dev, smDISKWAITWRITE, durationToMs(row.DiskWaitWrite))
+		}
+	}
+}
+
+// Record the 99th percentile disk latency calculated from a histogram.
+func statAddIostatHist(t time.Time, pool string, hist *ZpoolIostatHist) {
+	statistics.mutex.Lock()
+	defer statistics.mutex.Unlock()
+
+	statAdd(t, pool, hist.Dev, smDISKWAITP99, durationToMs(hist.GetDiskWaitPercentile(99)))
+}
+
+// Convert latency to milliseconds, keeps -1 as "not available".
+func durationToMs(d time.Duration) float64 {
+	if d < 0 {
+		return -1
+	}
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Record "zfs list" output.
+func statAddUsage(t time.Time, usage map[string]*PoolUsageType) {
+	statistics.mutex.Lock()
+	defer statistics.mutex.Unlock()
+
+	for pool, u := range usage {
+		statAdd(t, pool, pool, smUSED, float64(u.Used))
+	}
+}
+
+// Record ARC hit rate since the previous call.
+func statAddArc(t time.Time) error {
+	hits, misses, err := getArcStats()
+	if err != nil {
+		return err
+	}
+	statistics.mutex.Lock()
+	defer statistics.mutex.Unlock()
+
+	dh := hits - statistics.arcHits
+	dm := misses - statistics.arcMisses
+	if statistics.arcHits != 0 && dh >= 0 && dm >= 0 && dh+dm > 0 {
+		statAdd(t, "", "", smARCHIT, float64(dh)*100/float64(dh+dm))
+	}
+	statistics.arcHits, statistics.arcMisses = hits, misses
+	return nil
+}
+
+// Receive iostat output from the background process.
+func iostatReceiver(ch chan *ZpoolIostatTable) {
+	for table := range ch {
+		if table == nil {
+			continue // parse error
+		}
+		now := time.Now()
+		statAddIostat(now, table)
+		checkIostatLatency(now, table)
+		checkIostatOutliers(now, table)
+	}
+}
+
+// Receive latency histograms from the background process.
+func iostatHistReceiver(ch chan []*ZpoolIostatHist) {
+	var pool string
+	for hists := range ch {
+		if hists == nil {
+			continue // parse error
+		}
+		now := time.Now()
+		for _, hist := range hists {
+			// the first block of each pool has the pool name:
+			if findPool(hist.Dev) != nil {
+				pool = hist.Dev
+			}
+			if pool == "" {
+				continue
+			}
+			statAddIostatHist(now, pool, hist)
+			checkIostatHistLatency(now, pool, hist)
+		}
+	}
+}
+
+// SVG graph rendering.
+
+type statLine struct {
+	Label  string
+	Points []statPoint
+}
+
+var statLineColors = []string{"#0088cc", "#f89406", "#51a351", "#bd362f"}
+
+const (
+	svg_WIDTH  = 720
+	svg_HEIGHT = 200
+	svg_LEFT   = 60
+	svg_RIGHT  = 10
+	svg_TOP    = 10
+	svg_BOTTOM = 45
+)
+
+// Functions for formatting the Y axis labels.
+
+func fmtStatBytes(v float64) string {
+	return niceNumber(int64(v))
+}
+
+func fmtStatNumber(v float64) string {
+	if v < 1024 {
+		return fmt.Sprintf("%.3g", v)
+	}
+	return niceNumber(int64(v))
+}
+
+func fmtStatPercent(v float64) string {
+	return fmt.Sprintf("%.0f%%", v)
+}
+
+func fmtStatMs(v float64) string {
+	return fmt.Sprintf("%.3gms", v)
+}
+
+// Round up to 1, 2 or 5 times a power of ten (or 1024 for bytes).
+func statNiceMax(v float64, base float64) float64 {
+	if v <= 0 {
+		return 1
+	}
+	p := math.Pow(base, math.Floor(math.Log(v)/math.Log(base)))
+	for _, m := range []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, base} {
+		if p*m >= v {
+			return p * m
+		}
+	}
+	return p * base
+}
+
+// Render an inline SVG line graph of the given series.
+func makeSvgGraph(r statRange, lines []statLine, format func(float64) string, base float64, maxv float64) template.HTML {
+	now := time.Now()
+	start := now.Add(-r.Duration)
+
+	for _, l := range lines {
+		for _, p := range l.Points {
+			if p.Value > maxv {
+				maxv = p.Value
+			}
+		}
+	}
+	maxv = statNiceMax(maxv, base)
+
+	pw := float64(svg_WIDTH - svg_LEFT - svg_RIGHT)
+	ph := float64(svg_HEIGHT - svg_TOP - svg_BOTTOM)
+	xpos := func(t time.Time) float64 {
+		return svg_LEFT + pw*float64(t.Sub(start))/float64(r.Duration)
+	}
+	ypos := func(v float64) float64 {
+		return svg_TOP + ph - ph*v/maxv
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" class="zfswatcher-graph" `+
+		`viewBox="0 0 %d %d" width="100%%" preserveAspectRatio="xMinYMin meet" `+
+		`font-family="sans-serif" font-size="11">`, svg_WIDTH, svg_HEIGHT)
+
+	// horizontal grid lines and Y axis labels:
+	for i := 0; i <= 4; i++ {
+		v := maxv * float64(i) / 4
+		y := ypos(v)
+		fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#dddddd"/>`,
+			svg_LEFT, y, svg_WIDTH-svg_RIGHT, y)
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" text-anchor="end">%s</text>`,
+			svg_LEFT-5, y+4, template.HTMLEscapeString(format(v)))
+	}
+	// vertical grid lines and X axis labels:
+	tfmt := "15:04"
+	if r.Duration > 24*time.Hour {
+		tfmt = "01-02"
+	}
+	for i := 0; i <= 6; i++ {
+		t := start.Add(r.Duration * time.Duration(i) / 6)
+		x := xpos(t)
+		fmt.Fprintf(&b, `<line x1="%.1f" y1="%d" x2="%.1f" y2="%.1f" stroke="#eeeeee"/>`,
+			x, svg_TOP, x, float64(svg_TOP)+ph)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" text-anchor="middle">%s</text>`,
+			x, float64(svg_TOP)+ph+14, t.Format(tfmt))
+	}
+	// the data, the line is broken where there are gaps in the data:
+	for n, l := range lines {
+		color := statLineColors[n%len(statLineColors)]
+		var path strings.Builder
+		var prev time.Time
+		for _, p := range l.Points {
+			if p.Time.Before(start) {
+				continue
+			}
+			cmd := "L"
+			if prev.IsZero() || p.Time.Sub(prev) > 2*r.Step {
+				cmd = "M"
+			}
+			fmt.Fprintf(&path, "%s%.1f %.1f ", cmd, xpos(p.Time), ypos(p.Value))
+			prev = p.Time
+		}
+		if path.Len() > 0 {
+			fmt.Fprintf(&b, `<path d="%s" fill="none" stroke="%s" stroke-width="1.5"/>`,
+				strings.TrimSpace(path.String()), color)
+		}
+		// legend:
+		lx := svg_LEFT + n*150
+		ly := svg_HEIGHT - 10
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="10" height="10" fill="%s"/>`,
+			lx, ly-9, color)
+		fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`,
+			lx+14, ly, template.HTMLEscapeString(l.Label))
+	}
+	// frame:
+	fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%.1f" height="%.1f" fill="none" stroke="#999999"/>`,
+		svg_LEFT, svg_TOP, pw, ph)
+	b.WriteString(`</svg>`)
+
+	return template.HTML(b.String())
+}
+
+// eof
@@ -0,0 +1,296 @@
+//
+// supervisor.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"github.com/damicon/zfswatcher/notifier"
+	"io"
+	"sync"
+	"time"
+)
+
+// Supervised background processes are restarted automatically with
+// exponential backoff if they exit. A process which has crashed
+// "processcrashlimit" times in a row is failing until it has been running
+// for supervisor_STABLE again. It is still restarted meanwhile and its
+// state is "failed" while it waits for the restart. The supervisor runs
+// independently of the main loop, so it uses currentGlobals().
+
+// A process is considered stable after it has been running this long.
+const supervisor_STABLE = 5 * time.Minute
+
+// The initial delay before restarting a process.
+const supervisor_BACKOFF_MIN = time.Second
+
+type processState int
+
+const (
+	psSTARTING processState = iota
+	psRUNNING
+	psRESTARTING
+	psFAILED
+	psSTOPPED
+)
+
+var processStateStrings = []string{
+	psSTARTING:   "starting",
+	psRUNNING:    "running",
+	psRESTARTING: "restarting",
+	psFAILED:     "failed",
+	psSTOPPED:    "stopped",
+}
+
+func (s processState) String() string {
+	return processStateStrings[s]
+}
+
+type SupervisedProcess struct {
+	Name   string
+	Cmdstr string
+	reader func(io.Reader) // reads the output until the end
+	stopC  chan bool
+	doneC  chan bool
+	mutex  sync.Mutex
+	// the following are protected by the mutex:
+	process   *BackgroundProcess
+	state     processState
+	started   time.Time
+	restarts  int
+	crashes   int  // consecutive crashes
+	failing   bool // crash limit reached, until the process is stable again
+	lastError string
+	nextStart time.Time
+}
+
+// List of all supervised processes for the web interface.
+var supervisedProcesses struct {
+	list  []*SupervisedProcess
+	mutex sync.RWMutex
+}
+
+// Start a supervised background process. The reader function is called
+// with the standard output of the process every time it is (re)started.
+func NewSupervisedProcess(name, cmdstr string, reader func(io.Reader)) *SupervisedProcess {
+	p := &SupervisedProcess{
+		Name:   name,
+		Cmdstr: cmdstr,
+		reader: reader,
+		stopC:  make(chan bool),
+		doneC:  make(chan bool),
+	}
+	supervisedProcesses.mutex.Lock()
+	supervisedProcesses.list = append(supervisedProcesses.list, p)
+	supervisedProcesses.mutex.Unlock()
+
+	go p.supervise()
+	return p
+}
+
+func (p *SupervisedProcess) supervise() {
+	defer close(p.doneC)
+
+	c, _ := currentGlobals()
+	backoff := supervisor_BACKOFF_MIN
+	maxBackoff := time.Duration(c.Main.Processbackoffmax) * time.Second
+	if maxBackoff < backoff {
+		maxBackoff = backoff
+	}
+
+	for {
+		bp, err := NewBackgroundProcess(p.Cmdstr)
+
+		p.mutex.Lock()
+		if err == nil {
+			p.process = bp
+			p.state = psRUNNING
+			p.started = time.Now()
+			select {
+			case <-p.stopC:
+				// Stop() was called while we were starting
+				bp.Kill()
+			default:
+			}
+		} else {
+			p.lastError = err.Error()
+		}
+		p.mutex.Unlock()
+
+		if err == nil {
+			stableTimer := time.AfterFunc(supervisor_STABLE, p.recovered)
+			p.reader(bp.Out)
+			err = bp.Wait()
+			stableTimer.Stop()
+
+			select {
+			case <-p.stopC:
+				p.mutex.Lock()
+				p.process = nil
+				p.state = psSTOPPED
+				p.mutex.Unlock()
+				return
+			default:
+			}
+
+			p.mutex.Lock()
+			uptime := time.Since(p.started)
+			p.process = nil
+			if err != nil {
+				p.lastError = err.Error()
+			} else {
+				p.lastError = "exited"
+			}
+			if last := bp.LastError(); last != "" {
+				p.lastError += ": " + last
+			}
+			p.mutex.Unlock()
+			if uptime >= supervisor_STABLE {
+				// it was running fine for a while, start from scratch:
+				backoff = supervisor_BACKOFF_MIN
+			}
+			_, n := currentGlobals()
+			n.Printf(notifier.ERR, `"%s" exited after %s: %s`,
+				p.Cmdstr, myDurationString(uptime), p.getLastError())
+		}
+
+		c, _ = currentGlobals()
+		p.mutex.Lock()
+		p.crashes++
+		p.restarts++
+		crashes := p.crashes
+		p.state = psRESTARTING
+		p.nextStart = time.Now().Add(backoff)
+		if crashes >= c.Main.Processcrashlimit && c.Main.Processcrashlimit > 0 {
+			p.failing = true
+		}
+		if p.failing {
+			p.state = psFAILED
+		}
+		p.mutex.Unlock()
+
+		if crashes == c.Main.Processcrashlimit {
+			notifyEvent(c.Severity.Processfailed, "processfailed", "", "",
+				`%s process "%s" has failed %d times in a row, last error: %s`,
+				p.Name, p.Cmdstr, crashes, p.getLastError())
+		}
+
+		select {
+		case <-p.stopC:
+			p.setState(psSTOPPED)
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Called when the process has been running long enough to be considered
+// stable. Resets the crash counter and notifies if the process had been
+// failing.
+func (p *SupervisedProcess) recovered() {
+	p.mutex.Lock()
+	failing := p.failing
+	p.crashes = 0
+	p.failing = false
+	p.mutex.Unlock()
+
+	if failing {
+		c, _ := currentGlobals()
+		notifyEvent(c.Severity.Processrecovered, "processrecovered", "", "",
+			`%s process "%s" has recovered`, p.Name, p.Cmdstr)
+	}
+}
+
+func (p *SupervisedProcess) setState(s processState) {
+	p.mutex.Lock()
+	p.state = s
+	p.mutex.Unlock()
+}
+
+func (p *SupervisedProcess) getLastError() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.lastError
+}
+
+// Stop the process and the supervisor.
+func (p *SupervisedProcess) Stop() {
+	close(p.stopC)
+	p.mutex.Lock()
+	if p.process != nil {
+		p.process.Kill()
+	}
+	p.mutex.Unlock()
+	<-p.doneC
+}
+
+// Current status of a supervised process.
+type ProcessStatus struct {
+	Name      string
+	Cmdstr    string
+	State     processState
+	Pid       int
+	Uptime    time.Duration
+	Restarts  int
+	Crashes   int
+	Failing   bool
+	LastError string
+	NextStart time.Time
+}
+
+func (p *SupervisedProcess) Status() ProcessStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	st := ProcessStatus{
+		Name:      p.Name,
+		Cmdstr:    p.Cmdstr,
+		State:     p.state,
+		Restarts:  p.restarts,
+		Crashes:   p.crashes,
+		Failing:   p.failing,
+		LastError: p.lastError,
+		NextStart: p.nextStart,
+	}
+	if p.process != nil {
+		st.Pid = p.process.Cmd.Process.Pid
+		st.Uptime = time.Since(p.started)
+	}
+	return st
+}
+
+// Returns the status of all supervised processes.
+func getProcessStatuses() []ProcessStatus {
+	supervisedProcesses.mutex.RLock()
+	defer supervisedProcesses.mutex.RUnlock()
+
+	var sts []ProcessStatus
+	for _, p := range supervisedProcesses.list {
+		sts = append(sts, p.Status())
+	}
+	return sts
+}
+
+// eof
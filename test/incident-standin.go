@@ -0,0 +1,107 @@
+// +build ignore
+
+//
+// incident-standin.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+// A stand-in for the incident management APIs for testing the "incident"
+// outputs of zfswatcher without a real Alertmanager or PagerDuty account.
+// It prints the received requests and answers like the real services:
+//
+//	go run test/incident-standin.go -listen localhost:9093
+//
+// and use url = http://localhost:9093/api/v2/alerts (api = alertmanager)
+// or url = http://localhost:9093/v2/enqueue (api = events).
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+func dump(r *http.Request) ([]byte, bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("error reading request: %s", err)
+		return nil, false
+	}
+	var out bytes.Buffer
+	if err = json.Indent(&out, body, "", "  "); err != nil {
+		log.Printf("%s %s: invalid JSON: %s\n%s", r.Method, r.URL.Path, err, body)
+		return nil, false
+	}
+	fmt.Printf("%s %s %s\n%s\n\n", time.Now().Format(time.RFC3339), r.Method, r.URL.Path, out.Bytes())
+	return body, true
+}
+
+func alertmanagerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, ok := dump(r)
+	var alerts []map[string]interface{}
+	if !ok || json.Unmarshal(body, &alerts) != nil {
+		http.Error(w, "invalid alerts", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, ok := dump(r)
+	var ev struct {
+		RoutingKey  string `json:"routing_key"`
+		EventAction string `json:"event_action"`
+		DedupKey    string `json:"dedup_key"`
+	}
+	if !ok || json.Unmarshal(body, &ev) != nil || ev.RoutingKey == "" || ev.EventAction == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"status":"invalid event","message":"Event object is invalid"}`)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, `{"status":"success","message":"Event processed","dedup_key":%q}`, ev.DedupKey)
+}
+
+func main() {
+	listen := flag.String("listen", "localhost:9093", "address to listen")
+	flag.Parse()
+
+	http.HandleFunc("/api/v2/alerts", alertmanagerHandler)
+	http.HandleFunc("/v2/enqueue", eventsHandler)
+	log.Printf("listening on %s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
+
+// eof
@@ -0,0 +1,222 @@
+//
+// testnotify.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"fmt"
+	"github.com/damicon/zfswatcher/notifier"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Test notifications: the logging outputs are set up from the current
+// configuration, a test message is sent through them and the delivery
+// results are collected from the output statistics.
+
+// How long to wait for the outputs to deliver the test notification.
+const (
+	testNotifyWebTimeout = 60 * time.Second
+	testNotifyCmdTimeout = 5 * time.Minute
+)
+
+// Only one test at a time.
+var testNotifyMutex sync.Mutex
+
+type testNotifyResult struct {
+	Name   string
+	Type   string
+	Result string // "ok", "failed", "pending", "not sent" or "sent"
+	Class  string // CSS class for the web interface
+	Detail string
+}
+
+// Make the result of an output from its statistics.
+func makeTestNotifyResult(st notifier.OutputStats, finished bool) testNotifyResult {
+	r := testNotifyResult{Name: st.Name, Type: st.Type}
+	switch {
+	case st.Messages == 0 && st.Dropped == 0:
+		r.Result = "not sent"
+		r.Detail = "filtered by level or routing"
+		r.Class = "muted"
+	case st.Dropped > 0:
+		r.Result = "failed"
+		r.Detail = "dropped because the output was busy"
+		r.Class = "text-error"
+	case st.Errors > 0 || st.Failures > 0:
+		r.Result = "failed"
+		r.Detail = st.LastError
+		r.Class = "text-error"
+	case !st.LastSuccess.IsZero():
+		r.Result = "ok"
+		r.Class = "text-success"
+	case !finished:
+		r.Result = "pending"
+		r.Detail = "no result before timeout"
+		r.Class = "text-warning"
+	default:
+		// outputs such as stdout do not confirm delivery
+		r.Result = "sent"
+		r.Class = "text-success"
+	}
+	return r
+}
+
+// The local outputs which are not tested from the web interface because
+// the running program has them open already.
+func skippedTestOutputs(c *cfgType) []testNotifyResult {
+	var names, types []string
+	if optDebug || c.Stdout.Enable {
+		names, types = append(names, "stdout"), append(types, "stdout")
+	}
+	var profs []string
+	for prof, s := range c.Logfile {
+		if s.Enable {
+			profs = append(profs, prof)
+		}
+	}
+	sort.Strings(profs)
+	for _, prof := range profs {
+		names, types = append(names, "logfile:"+prof), append(types, "file")
+	}
+	profs = nil
+	for prof, s := range c.Journal {
+		if s.Enable {
+			profs = append(profs, prof)
+		}
+	}
+	sort.Strings(profs)
+	for _, prof := range profs {
+		names, types = append(names, "journal:"+prof), append(types, "journal")
+	}
+	profs = nil
+	for prof, s := range c.Program {
+		if s.Enable {
+			profs = append(profs, prof)
+		}
+	}
+	sort.Strings(profs)
+	for _, prof := range profs {
+		names, types = append(names, "program:"+prof), append(types, "program")
+	}
+
+	var rs []testNotifyResult
+	for i, name := range names {
+		rs = append(rs, testNotifyResult{
+			Name:   name,
+			Type:   types[i],
+			Result: "not sent",
+			Class:  "muted",
+			Detail: "local output, test it from the command line",
+		})
+	}
+	return rs
+}
+
+// Send a test notification with the given severity through all logging
+// outputs of the configuration and wait for the results. Spooling is
+// disabled so that each delivery is tried right away. If local is false,
+// the local outputs (see setupLog) are not tested.
+func sendTestNotification(c *cfgType, s notifier.Severity, requester string, local bool, timeout time.Duration) ([]testNotifyResult, error) {
+	testNotifyMutex.Lock()
+	defer testNotifyMutex.Unlock()
+
+	n, ok := setupLog(c, false, local)
+	host, _ := os.Hostname()
+	// the alert fields make the incident outputs open a test incident,
+	// which is resolved right away:
+	f := notifier.Fields{
+		"event":         "test",
+		"alert":         "test",
+		"alertname":     "ZfswatcherTest",
+		"alertseverity": s.String(),
+		"alertstatus":   "firing",
+	}
+	n.SendFields(s, f, fmt.Sprintf("TEST notification from zfswatcher on %s requested by %s, please ignore", host, requester))
+	n.AttachFields(s, f, "This is a test attachment of zfswatcher.\nIt only verifies that the notifications are delivered.\n")
+	var incidents []string
+	for prof, ic := range c.Incident {
+		if ic.Enable && s <= ic.Level {
+			incidents = append(incidents, "incident:"+prof)
+		}
+	}
+	if len(incidents) > 0 && n.CheckOutputs(incidents) == nil {
+		f = notifier.Fields{
+			"event":         "test",
+			"alert":         "test",
+			"alertname":     "ZfswatcherTest",
+			"alertseverity": s.String(),
+			"alertstatus":   "resolved",
+		}
+		n.SendFieldsTo(incidents, s, f, "TEST notification resolved")
+	}
+	n.Flush()
+
+	var finished bool
+	select {
+	case <-n.Close():
+		finished = true
+	case <-time.After(timeout):
+	}
+	var results []testNotifyResult
+	for _, st := range n.Stats() {
+		results = append(results, makeTestNotifyResult(st, finished))
+	}
+	if !local {
+		results = append(results, skippedTestOutputs(c)...)
+	}
+	if !ok {
+		return results, fmt.Errorf("errors in the logging settings of %s", cfgFile)
+	}
+	return results, nil
+}
+
+// Implements the --test-notify command line option.
+func testNotifyCmd(c *cfgType, severity string) {
+	var s notifier.Severity
+	if _, err := fmt.Sscan(severity, &s); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid severity \"%s\": %s\n", os.Args[0], severity, err)
+		os.Exit(2)
+	}
+	results, err := sendTestNotification(c, s, "command line", true, testNotifyCmdTimeout)
+	status := 0
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[0], err)
+		status = 1
+	}
+	for _, r := range results {
+		name := r.Name
+		if name == "" {
+			name = r.Type
+		}
+		line := fmt.Sprintf("%-24s %-10s %s", name, r.Result, r.Detail)
+		fmt.Println(strings.TrimSpace(line))
+		if r.Result == "failed" || r.Result == "pending" {
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
+
+// eof
@@ -22,6 +22,7 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/damicon/zfswatcher/notifier"
@@ -32,22 +33,202 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-// Run external command and capture output.
-func getCommandOutput(cmdstr string) (string, error) {
-	cmd := strings.Fields(cmdstr)
-	out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput()
+// Returned by getCommandOutputTimeout() if the command did not finish in
+// time or if it was not run because an earlier run has not finished yet.
+var errCommandTimeout = errors.New("command timed out")
+var errCommandSkipped = errors.New("command skipped because of an earlier timeout")
+
+// The messages about the hung commands which have finished. They are
+// notified from the main loop because the notifier may have been replaced
+// by the time the command finishes.
+var commandRecoveredC = make(chan string, 100)
+
+// Commands which have timed out. The entry is kept after the command has
+// finished until the backoff period is over.
+type hungCommand struct {
+	name     string
+	cmdstr   string
+	pid      int
+	started  time.Time
+	finished bool
+	timeouts int       // consecutive timeouts
+	nextTry  time.Time // backoff
+}
+
+var hungCommands struct {
+	cmds  map[string]*hungCommand
+	mutex sync.Mutex
+}
+
+// Statistics of the commands run by getCommandOutputTimeout(), keyed by
+// the command name.
+type commandStat struct {
+	runs         int64
+	failures     int64
+	timeouts     int64
+	skipped      int64
+	lastDuration time.Duration
+	lastSuccess  time.Time
+}
+
+var commandStats struct {
+	cmds  map[string]*commandStat
+	mutex sync.Mutex
+}
+
+func recordCommandStat(name string, start time.Time, err error) {
+	commandStats.mutex.Lock()
+	defer commandStats.mutex.Unlock()
+
+	if commandStats.cmds == nil {
+		commandStats.cmds = make(map[string]*commandStat)
+	}
+	cs, ok := commandStats.cmds[name]
+	if !ok {
+		cs = &commandStat{}
+		commandStats.cmds[name] = cs
+	}
+	switch err {
+	case nil:
+		cs.runs++
+		cs.lastDuration = time.Since(start)
+		cs.lastSuccess = time.Now()
+	case errCommandSkipped:
+		cs.skipped++
+	case errCommandTimeout:
+		cs.runs++
+		cs.timeouts++
+		cs.lastDuration = time.Since(start)
+	default:
+		cs.runs++
+		cs.failures++
+		cs.lastDuration = time.Since(start)
+	}
+}
+
+// Returns a copy of the command statistics.
+func getCommandStats() map[string]commandStat {
+	commandStats.mutex.Lock()
+	defer commandStats.mutex.Unlock()
+
+	css := make(map[string]commandStat)
+	for name, cs := range commandStats.cmds {
+		css[name] = *cs
+	}
+	return css
+}
+
+// Run external command and capture output. If the command does not finish
+// within the timeout, a notification is sent and errCommandTimeout is
+// returned. The command is killed if possible but if it is stuck in the
+// kernel (for example because pool I/O is suspended) it is tracked until
+// it exits. Meanwhile and during an exponentially growing backoff period
+// after it, the command is not run again and errCommandSkipped is returned.
+// A zero timeout means no timeout.
+func getCommandOutputTimeout(name, cmdstr string, timeout time.Duration) (out string, err error) {
+	now := time.Now()
+	defer func() { recordCommandStat(name, now, err) }()
+
+	hungCommands.mutex.Lock()
+	if hungCommands.cmds == nil {
+		hungCommands.cmds = make(map[string]*hungCommand)
+	}
+	hc := hungCommands.cmds[cmdstr]
+	if hc != nil && (!hc.finished || now.Before(hc.nextTry)) {
+		hungCommands.mutex.Unlock()
+		return "", errCommandSkipped
+	}
+	hungCommands.mutex.Unlock()
+
+	var buf bytes.Buffer
+	cmdf := strings.Fields(cmdstr)
+	cmd := exec.Command(cmdf[0], cmdf[1:]...)
+	cmd.Stdout = &buf
+	cmd.Stderr = &buf
+	err = cmd.Start()
 	if err != nil {
 		notify.Print(notifier.CRIT,
 			`running "`, cmdstr, `" failed: `, err)
-		if len(out) != 0 {
-			notify.Attach(notifier.CRIT, string(out))
-		}
 		return "", err
 	}
-	return string(out), err
+	doneC := make(chan error, 1)
+	go func() {
+		doneC <- cmd.Wait()
+	}()
+	var timeoutC <-chan time.Time // nil channel blocks forever
+	if timeout > 0 {
+		timeoutC = time.After(timeout)
+	}
+
+	select {
+	case err = <-doneC:
+		hungCommands.mutex.Lock()
+		delete(hungCommands.cmds, cmdstr)
+		hungCommands.mutex.Unlock()
+		if err != nil {
+			notify.Print(notifier.CRIT,
+				`running "`, cmdstr, `" failed: `, err)
+			if buf.Len() != 0 {
+				notify.Attach(notifier.CRIT, buf.String())
+			}
+			return "", err
+		}
+		return buf.String(), nil
+	case <-timeoutC:
+	}
+
+	// the command has hung
+	notifyEvent(cfg.Severity.Commandhung, "commandhung", "", "",
+		`%s command hung for %d seconds: "%s"`, name, int(timeout.Seconds()), cmdstr)
+	cmd.Process.Kill()
+
+	hungCommands.mutex.Lock()
+	if hc == nil {
+		hc = &hungCommand{name: name, cmdstr: cmdstr}
+		hungCommands.cmds[cmdstr] = hc
+	}
+	hc.pid = cmd.Process.Pid
+	hc.started = now
+	hc.finished = false
+	hc.timeouts++
+	hungCommands.mutex.Unlock()
+
+	maxBackoff := time.Duration(cfg.Main.Commandbackoffmax) * time.Second
+	go func() {
+		<-doneC
+		hungCommands.mutex.Lock()
+		hc.finished = true
+		backoff := timeout << uint(hc.timeouts)
+		if backoff > maxBackoff || backoff <= 0 {
+			backoff = maxBackoff
+		}
+		hc.nextTry = time.Now().Add(backoff)
+		hungCommands.mutex.Unlock()
+		select {
+		case commandRecoveredC <- fmt.Sprintf(`%s command finished after hanging for %s, retrying in %s: "%s"`,
+			name, myDurationString(time.Since(now)), myDurationString(backoff), cmdstr):
+		default:
+			// the main loop is not running
+		}
+	}()
+	return "", errCommandTimeout
+}
+
+// Returns a copy of the list of hung commands.
+func getHungCommands() []hungCommand {
+	hungCommands.mutex.Lock()
+	defer hungCommands.mutex.Unlock()
+
+	var hcs []hungCommand
+	for _, hc := range hungCommands.cmds {
+		hcs = append(hcs, *hc)
+	}
+	return hcs
 }
 
 // A process which is run in the background with output available to us.
@@ -55,22 +236,60 @@ type BackgroundProcess struct {
 	Cmdstr string
 	Cmd    *exec.Cmd
 	Out    io.ReadCloser
+	stderr *stderrLogger
+}
+
+// Writer which sends the standard error output of a background process
+// to the notifier line by line.
+type stderrLogger struct {
+	cmdstr string
+	buf    string
+	mutex  sync.Mutex
+	last   string // the last line
+}
+
+func (l *stderrLogger) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.buf += string(p)
+	for pos := strings.Index(l.buf, "\n"); pos != -1; pos = strings.Index(l.buf, "\n") {
+		line := strings.TrimSpace(l.buf[:pos])
+		l.buf = l.buf[pos+1:]
+		if line == "" {
+			continue
+		}
+		l.last = line
+		_, n := currentGlobals()
+		n.Printf(notifier.ERR, `"%s" error output: %s`, l.cmdstr, line)
+	}
+	return len(p), nil
+}
+
+// Returns the last line of standard error output.
+func (l *stderrLogger) Last() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.last
 }
 
 // Run external command in background.
 func NewBackgroundProcess(cmdstr string) (*BackgroundProcess, error) {
 	cmdf := strings.Fields(cmdstr)
 	cmd := exec.Command(cmdf[0], cmdf[1:]...)
+	_, n := currentGlobals()
 	cmdout, err := cmd.StdoutPipe()
 	if err != nil {
-		notify.Print(notifier.ERR,
+		n.Print(notifier.ERR,
 			`opening stdout pipe for "`, cmdstr, `" failed: `, err)
 		return nil, err
 	}
-	// XXX how about stderr?
+	stderr := &stderrLogger{cmdstr: cmdstr}
+	cmd.Stderr = stderr
 	err = cmd.Start()
 	if err != nil {
-		notify.Print(notifier.ERR,
+		n.Print(notifier.ERR,
 			`starting "`, cmdstr, `" failed: `, err)
 		return nil, err
 	}
@@ -78,17 +297,42 @@ func NewBackgroundProcess(cmdstr string) (*BackgroundProcess, error) {
 		Cmdstr: cmdstr,
 		Cmd:    cmd,
 		Out:    cmdout,
+		stderr: stderr,
 	}, nil
 }
 
+// Wait for a background process to exit. The output must have been read
+// until the end before calling this.
+func (p *BackgroundProcess) Wait() error {
+	return p.Cmd.Wait()
+}
+
+// Returns the last line the process wrote to standard error.
+func (p *BackgroundProcess) LastError() string {
+	return p.stderr.Last()
+}
+
+// Kill a background process without waiting for it.
+func (p *BackgroundProcess) Kill() error {
+	return p.Cmd.Process.Kill()
+}
+
 // Stop a running background process.
 func (p *BackgroundProcess) Stop() error {
-	p.Cmd.Process.Kill()
+	err := p.Cmd.Process.Kill()
+	if err != nil {
+		return err
+	}
 	// We assume that the background process is behaving nicely and is
 	// not blocking signals etc.
-	err := p.Cmd.Wait()
-	// The error should always indicate that the process was killed.
-	// XXX We return error on success.
+	err = p.Cmd.Wait()
+	// Being killed by us is the expected outcome.
+	if ee, ok := err.(*exec.ExitError); ok {
+		if ws, ok := ee.Sys().(syscall.WaitStatus); ok &&
+			ws.Signaled() && ws.Signal() == syscall.SIGKILL {
+			return nil
+		}
+	}
 	return err
 }
 
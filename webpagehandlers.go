@@ -27,6 +27,8 @@ import (
 	"github.com/damicon/zfswatcher/notifier"
 	"html/template"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -60,6 +62,8 @@ type webNav struct {
 	PoolStatus bool
 	Statistics bool
 	Logs       bool
+	Alerts     bool
+	Silences   bool
 	About      bool
 }
 
@@ -85,6 +89,7 @@ type devStatusWeb struct {
 	Write      int64
 	Cksum      int64
 	Rest       string
+	Outlier    string
 }
 
 type poolStatusWeb struct {
@@ -190,6 +195,7 @@ func makePoolStatusWeb(pool *PoolType, usage map[string]*PoolUsageType) *poolSta
 			Write:      dev.write,
 			Cksum:      dev.cksum,
 			Rest:       dev.rest,
+			Outlier:    getDevOutlier(pool.name, dev.name),
 		}
 		devw.Indent = 1
 		for d := n; pool.devs[d].parentDev != -1; d = pool.devs[d].parentDev {
@@ -280,7 +286,13 @@ func usageHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 		return
 	}
 
-	zfsListOutput, err := getCommandOutput(cfg.Main.Zfslistusagecmd + " " + pool)
+	zfsListOutput, err := getCommandOutputTimeout("ZFS usage",
+		cfg.Main.Zfslistusagecmd+" "+pool, time.Duration(cfg.Main.Zfslisttimeout)*time.Second)
+	if err == errCommandSkipped || err == errCommandTimeout {
+		// hung (already notified) or backing off
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		notify.Print(notifier.ERR, "getting ZFS disk usage failed")
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -337,9 +349,162 @@ func dashboardHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 	}
 }
 
+type statGraphWeb struct {
+	Title string
+	Graph template.HTML
+}
+
+type statDevWeb struct {
+	Indent int
+	Name   string
+	Graphs [][]statGraphWeb // rows of graphs
+}
+
+type statisticsWeb struct {
+	Enabled bool
+	Stalled []processStatusWeb // background processes which are not running
+	Pool    string
+	Range   string
+	Ranges  []webSubNav
+	Graphs  [][]statGraphWeb // rows of graphs
+	Devs    []statDevWeb
+}
+
+// Make the operations, bandwidth and latency graphs of a pool or a device.
+func makeIostatGraphs(rangeidx int, pool, dev string) [][]statGraphWeb {
+	r := statRanges[rangeidx]
+	rows := [][]statGraphWeb{{
+		{
+			Title: "Operations per second",
+			Graph: makeSvgGraph(r, []statLine{
+				{"read", statGet(rangeidx, pool, dev, smOPSREAD)},
+				{"write", statGet(rangeidx, pool, dev, smOPSWRITE)},
+			}, fmtStatNumber, 10, 0),
+		},
+		{
+			Title: "Bandwidth (bytes per second)",
+			Graph: makeSvgGraph(r, []statLine{
+				{"read", statGet(rangeidx, pool, dev, smBWREAD)},
+				{"write", statGet(rangeidx, pool, dev, smBWWRITE)},
+			}, fmtStatBytes, 1024, 0),
+		},
+	}}
+	diskp99 := statGet(rangeidx, pool, dev, smDISKWAITP99)
+	if statGet(rangeidx, pool, dev, smDISKWAITREAD) == nil && diskp99 == nil {
+		return rows // latency statistics not available
+	}
+	rows = append(rows, []statGraphWeb{
+		{
+			Title: "Average latency",
+			Graph: makeSvgGraph(r, []statLine{
+				{"total read", statGet(rangeidx, pool, dev, smTOTALWAITREAD)},
+				{"total write", statGet(rangeidx, pool, dev, smTOTALWAITWRITE)},
+				{"disk read", statGet(rangeidx, pool, dev, smDISKWAITREAD)},
+				{"disk write", statGet(rangeidx, pool, dev, smDISKWAITWRITE)},
+			}, fmtStatMs, 10, 0),
+		},
+		{
+			Title: "99th percentile disk latency",
+			Graph: makeSvgGraph(r, []statLine{
+				{"p99", diskp99},
+			}, fmtStatMs, 10, 0),
+		},
+	})
+	return rows
+}
+
 func statisticsHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 	wn := webNav{Statistics: true}
-	err := templates.ExecuteTemplate(w, "statistics.html", &webData{Nav: wn})
+
+	pool := r.URL.Path[len("/statistics/"):]
+
+	if !legalPoolName(pool) && !(pool == "") {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	currentState.mutex.RLock()
+	state := currentState.state
+	currentState.mutex.RUnlock()
+
+	if len(state) == 0 {
+		err := templates.ExecuteTemplate(w, "status-none.html", &webData{Nav: wn})
+		if err != nil {
+			notify.Printf(notifier.ERR, "error executing template: %s", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	subnav := make([]webSubNav, 0, len(state))
+	match := -1
+
+	for n, s := range state {
+		active := s.name == pool
+		subnav = append(subnav, webSubNav{Name: s.name, Active: active})
+		if active {
+			match = n
+		}
+	}
+	if pool == "" {
+		http.Redirect(w, &r.Request, "/statistics/"+subnav[0].Name, http.StatusSeeOther)
+		return
+	}
+	if match == -1 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	rangeidx, srange := getStatRange(r.FormValue("range"))
+
+	ws := &statisticsWeb{
+		Enabled: cfg.Main.Zpooliostatcmd != "",
+		Pool:    pool,
+		Range:   srange.Name,
+	}
+	for _, p := range makeProcessStatusWeb() {
+		if p.State != psRUNNING.String() {
+			ws.Stalled = append(ws.Stalled, p)
+		}
+	}
+	for _, sr := range statRanges {
+		ws.Ranges = append(ws.Ranges, webSubNav{Name: sr.Name, Active: sr.Name == srange.Name})
+	}
+
+	ws.Graphs = append(makeIostatGraphs(rangeidx, pool, pool), []statGraphWeb{
+		{
+			Title: "Capacity (bytes)",
+			Graph: makeSvgGraph(srange, []statLine{
+				{"allocated", statGet(rangeidx, pool, pool, smALLOC)},
+				{"used by datasets", statGet(rangeidx, pool, pool, smUSED)},
+			}, fmtStatBytes, 1024, 0),
+		},
+		{
+			Title: "ARC hit rate (all pools)",
+			Graph: makeSvgGraph(srange, []statLine{
+				{"hit rate", statGet(rangeidx, "", "", smARCHIT)},
+			}, fmtStatPercent, 10, 100),
+		},
+	})
+
+	devs := state[match].devs
+	for n, dev := range devs {
+		if dev.name == pool || statGet(rangeidx, pool, dev.name, smOPSREAD) == nil {
+			continue // the pool itself or no statistics available
+		}
+		devw := statDevWeb{
+			Name:   dev.name,
+			Indent: 1,
+			Graphs: makeIostatGraphs(rangeidx, pool, dev.name),
+		}
+		for d := n; devs[d].parentDev != -1; d = devs[d].parentDev {
+			devw.Indent += 2
+		}
+		ws.Devs = append(ws.Devs, devw)
+	}
+
+	err := templates.ExecuteTemplate(w, "statistics.html",
+		&webData{Nav: wn, SubNav: subnav, Data: ws})
 	if err != nil {
 		notify.Printf(notifier.ERR, "error executing template: %s", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -348,8 +513,19 @@ func statisticsHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 
 func logsHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 	wn := webNav{Logs: true}
+	var failing []outputStatusWeb
+	for _, o := range makeOutputStatusWeb() {
+		if !o.Healthy {
+			failing = append(failing, o)
+		}
+	}
 	wwwLogMutex.RLock()
-	err := templates.ExecuteTemplate(w, "logs.html", &webData{Nav: wn, Data: wwwLogBuffer})
+	err := templates.ExecuteTemplate(w, "logs.html",
+		&webData{Nav: wn,
+			Data: map[string]interface{}{
+				"Logs":    wwwLogBuffer,
+				"Failing": failing,
+			}})
 	wwwLogMutex.RUnlock()
 	if err != nil {
 		notify.Printf(notifier.ERR, "error executing template: %s", err)
@@ -357,13 +533,368 @@ func logsHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 	}
 }
 
+type alertWeb struct {
+	Key        string
+	Severity   string
+	Class      string
+	Started    string
+	Duration   string
+	Text       string
+	AckedBy    string
+	Acked      string
+	Escalation string
+}
+
+func makeAlertWeb(as []alert, now time.Time) []alertWeb {
+	var aw []alertWeb
+	for _, a := range as {
+		w := alertWeb{
+			Key:      a.Key,
+			Severity: a.Severity.String(),
+			Class:    cfg.Www.Severitycssclassmap[a.Severity],
+			Started:  a.Started.Format("2006-01-02 15:04:05"),
+			Text:     a.Text,
+			AckedBy:  a.AckedBy,
+		}
+		if a.Resolved.IsZero() {
+			w.Duration = myDurationString(now.Sub(a.Started))
+		} else {
+			w.Duration = myDurationString(a.Resolved.Sub(a.Started))
+		}
+		if !a.AckedTime.IsZero() {
+			w.Acked = a.AckedTime.Format("2006-01-02 15:04:05")
+		}
+		var names []string
+		for name := range a.Escalated {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if w.Escalation != "" {
+				w.Escalation += ", "
+			}
+			w.Escalation += fmt.Sprintf("%s step %d", name, a.Escalated[name])
+			if e, ok := cfg.Escalation[name]; ok {
+				w.Escalation += fmt.Sprintf("/%d", len(e.Steps))
+			}
+		}
+		aw = append(aw, w)
+	}
+	return aw
+}
+
+func alertsHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	wn := webNav{Alerts: true}
+	active, resolved := getAlerts()
+	now := time.Now()
+	err := templates.ExecuteTemplate(w, "alerts.html",
+		&webData{Nav: wn,
+			Data: map[string]interface{}{
+				"Enabled":  cfg.Alerts.Enable,
+				"Active":   makeAlertWeb(active, now),
+				"Resolved": makeAlertWeb(resolved, now),
+			}})
+	if err != nil {
+		notify.Printf(notifier.ERR, "error executing template: %s", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func alertAckHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(&r.Request) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var ack bool
+	switch r.FormValue("action") {
+	case "ack":
+		ack = true
+	case "unack":
+		ack = false
+	default:
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !ackAlert(r.FormValue("key"), r.Username, ack) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, &r.Request, "/alerts/", http.StatusSeeOther)
+}
+
+type silenceWeb struct {
+	ID         string
+	Conditions string
+	Window     string
+	Comment    string
+	Creator    string
+	Active     bool
+	Suppressed int
+	Removable  bool
+}
+
+func makeSilenceWeb() []silenceWeb {
+	silenceFile.mutex.Lock()
+	loaded := silenceFile.silences
+	silenceFile.mutex.Unlock()
+
+	var sw []silenceWeb
+	for _, st := range notify.Silences() {
+		sw = append(sw, silenceWeb{
+			ID:         st.ID,
+			Conditions: silenceConditions(st.Silence),
+			Window:     silenceWindow(st.Silence),
+			Comment:    st.Comment,
+			Creator:    st.Creator,
+			Active:     st.Active,
+			Suppressed: st.Suppressed,
+			Removable:  findSilence(loaded, st.ID) >= 0,
+		})
+	}
+	return sw
+}
+
+func executeSilencesTemplate(w http.ResponseWriter, r *auth.AuthenticatedRequest, errstr string) {
+	wn := webNav{Silences: true}
+	err := templates.ExecuteTemplate(w, "silences.html",
+		&webData{Nav: wn,
+			Data: map[string]interface{}{
+				"Silences": makeSilenceWeb(),
+				"Admin":    isAdminUser(r.Username),
+				"Error":    errstr,
+			}})
+	if err != nil {
+		notify.Printf(notifier.ERR, "error executing template: %s", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func silencesHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	executeSilencesTemplate(w, r, "")
+}
+
+func silenceAddHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(&r.Request) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !isAdminUser(r.Username) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	s, err := newSilence(func(k string) string { return strings.TrimSpace(r.FormValue(k)) },
+		r.Username+" (web)", time.Now())
+	if err == nil {
+		err = addSilence(s)
+	}
+	if err != nil {
+		executeSilencesTemplate(w, r, err.Error())
+		return
+	}
+	notify.Printf(notifier.INFO, `user "%s" added silence %s: %s, %s`,
+		r.Username, s.ID, silenceConditions(s), silenceWindow(s))
+	http.Redirect(w, &r.Request, "/silences/", http.StatusSeeOther)
+}
+
+func silenceRemoveHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(&r.Request) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !isAdminUser(r.Username) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	id := r.FormValue("id")
+	if err := removeSilence(id); err != nil {
+		executeSilencesTemplate(w, r, err.Error())
+		return
+	}
+	notify.Printf(notifier.INFO, `user "%s" removed silence %s`, r.Username, id)
+	http.Redirect(w, &r.Request, "/silences/", http.StatusSeeOther)
+}
+
+type processStatusWeb struct {
+	Name       string
+	Cmdstr     string
+	State      string
+	StateClass string
+	Pid        int
+	Uptime     string
+	Restarts   int
+	LastError  string
+}
+
+func makeProcessStatusWeb() []processStatusWeb {
+	var psw []processStatusWeb
+	for _, st := range getProcessStatuses() {
+		p := processStatusWeb{
+			Name:      st.Name,
+			Cmdstr:    st.Cmdstr,
+			State:     st.State.String(),
+			Pid:       st.Pid,
+			Restarts:  st.Restarts,
+			LastError: st.LastError,
+		}
+		switch st.State {
+		case psRUNNING:
+			p.StateClass = "text-success"
+			p.Uptime = myDurationString(st.Uptime)
+			if st.Failing {
+				// restarted but not stable yet
+				p.State += " (failing)"
+				p.StateClass = "text-warning"
+			}
+		case psRESTARTING:
+			p.StateClass = "text-warning"
+		case psFAILED:
+			p.StateClass = "text-error"
+		}
+		psw = append(psw, p)
+	}
+	for _, hc := range getHungCommands() {
+		p := processStatusWeb{
+			Name:      hc.name,
+			Cmdstr:    hc.cmdstr,
+			Restarts:  hc.timeouts,
+			LastError: "timed out",
+		}
+		if hc.finished {
+			p.State = "backing off"
+			p.StateClass = "text-warning"
+		} else {
+			p.State = "hung"
+			p.StateClass = "text-error"
+			p.Pid = hc.pid
+			p.Uptime = myDurationString(time.Since(hc.started))
+		}
+		psw = append(psw, p)
+	}
+	return psw
+}
+
+type outputStatusWeb struct {
+	Name          string
+	Type          string
+	Messages      int64
+	Dropped       int64
+	Errors        int64
+	Spool         string
+	Queued        int
+	OldestQueued  string
+	LastError     string
+	LastErrorTime string
+	LastSuccess   string
+	QueueClass    string
+	Healthy       bool
+	Health        string
+	HealthClass   string
+}
+
+func makeOutputStatusWeb() []outputStatusWeb {
+	var osw []outputStatusWeb
+	for _, st := range notify.Stats() {
+		o := outputStatusWeb{
+			Name:      st.Name,
+			Type:      st.Type,
+			Messages:  st.Messages,
+			Dropped:   st.Dropped,
+			Errors:    st.Errors,
+			Spool:     st.Spool,
+			Queued:    st.Queued,
+			LastError: st.LastError,
+			Healthy:   st.Healthy(),
+		}
+		if !st.LastErrorTime.IsZero() {
+			o.LastErrorTime = st.LastErrorTime.Format("2006-01-02 15:04:05")
+		}
+		if !st.LastSuccess.IsZero() {
+			o.LastSuccess = st.LastSuccess.Format("2006-01-02 15:04:05")
+		}
+		switch {
+		case !o.Healthy:
+			o.Health = fmt.Sprintf("failing (%d)", st.Failures)
+			o.HealthClass = "text-error"
+		case st.Errors > 0:
+			o.Health = "recovered"
+			o.HealthClass = "text-success"
+		default:
+			o.Health = "ok"
+			o.HealthClass = "text-success"
+		}
+		if st.Queued > 0 {
+			o.OldestQueued = myDurationString(time.Since(st.OldestQueued))
+			o.QueueClass = "text-warning"
+		}
+		osw = append(osw, o)
+	}
+	return osw
+}
+
 func aboutHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 	wn := webNav{About: true}
 	err := templates.ExecuteTemplate(w, "about.html",
 		&webData{Nav: wn,
-			Data: map[string]string{
+			Data: map[string]interface{}{
 				"Version":       VERSION,
 				"GoEnvironment": getGoEnvironment(),
+				"Processes":     makeProcessStatusWeb(),
+				"Outputs":       makeOutputStatusWeb(),
+				"Admin":         isAdminUser(r.Username),
+				"Severities":    testNotifySeverities,
+			}})
+	if err != nil {
+		notify.Printf(notifier.ERR, "error executing template: %s", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// The choices of the test notification form, the first one is the default.
+var testNotifySeverities = []string{"info", "notice", "warning", "err", "crit", "alert", "emerg", "debug"}
+
+func testNotifyHandler(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	if r.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(&r.Request) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !isAdminUser(r.Username) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var s notifier.Severity
+	if _, err := fmt.Sscan(r.FormValue("severity"), &s); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	notify.Printf(notifier.INFO, `user "%s" sent a test notification with severity %s`, r.Username, s)
+	results, err := sendTestNotification(cfg, s, `web user "`+r.Username+`"`, false, testNotifyWebTimeout)
+	var errstr string
+	if err != nil {
+		errstr = err.Error()
+	}
+	wn := webNav{About: true}
+	err = templates.ExecuteTemplate(w, "testnotify.html",
+		&webData{Nav: wn,
+			Data: map[string]interface{}{
+				"Severity": s.String(),
+				"Results":  results,
+				"Error":    errstr,
 			}})
 	if err != nil {
 		notify.Printf(notifier.ERR, "error executing template: %s", err)
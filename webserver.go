@@ -28,6 +28,7 @@ import (
 	"html/template"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
@@ -46,6 +47,38 @@ func getUserSecret(username, realm string) string {
 	return ""
 }
 
+// Tells if the user may perform administrative actions such as sending
+// test notifications.
+func isAdminUser(username string) bool {
+	user, ok := cfg.Wwwuser[username]
+	return ok && user.Enable && user.Admin
+}
+
+// Tells if a POST request comes from a page of this web interface. The
+// browsers send the Origin or the Referer header, a request with neither
+// one is refused, as is the "null" origin of the sandboxed pages.
+func sameOrigin(r *http.Request) bool {
+	o := r.Header.Get("Origin")
+	if o == "null" {
+		return false
+	}
+	if o == "" {
+		o = r.Header.Get("Referer")
+	}
+	if o == "" {
+		return false
+	}
+	u, err := url.Parse(o)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func getMetricsUserSecret(username, realm string) string {
+	if username == "" || username != cfg.Metrics.User {
+		return ""
+	}
+	return cfg.Metrics.Password
+}
+
 func noDirListing(h http.Handler) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasSuffix(r.URL.Path, "/") {
@@ -60,7 +93,8 @@ func webServer() {
 	var err error
 
 	templates = template.New("zfswatcher").Funcs(template.FuncMap{
-		"nicenumber": niceNumber,
+		"nicenumber":    niceNumber,
+		"alertsenabled": func() bool { return cfg.Alerts.Enable },
 	})
 	templates, err = templates.ParseGlob(cfg.Www.Templatedir + "/*.html")
 	if err != nil {
@@ -81,8 +115,29 @@ func webServer() {
 	http.HandleFunc("/usage/", authenticator.Wrap(usageHandler))
 	http.HandleFunc("/statistics/", authenticator.Wrap(statisticsHandler))
 	http.HandleFunc("/logs/", authenticator.Wrap(logsHandler))
+	http.HandleFunc("/alerts/", authenticator.Wrap(alertsHandler))
+	http.HandleFunc("/alerts/ack", authenticator.Wrap(alertAckHandler))
+	http.HandleFunc("/silences/", authenticator.Wrap(silencesHandler))
+	http.HandleFunc("/silences/add", authenticator.Wrap(silenceAddHandler))
+	http.HandleFunc("/silences/remove", authenticator.Wrap(silenceRemoveHandler))
 	http.HandleFunc("/about/", authenticator.Wrap(aboutHandler))
 	http.HandleFunc("/locate/", authenticator.Wrap(locateHandler))
+	http.HandleFunc("/testnotify/", authenticator.Wrap(testNotifyHandler))
+
+	if cfg.Metrics.Enable {
+		metricsAuthHandler := func(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+			metricsHandler(w, &r.Request)
+		}
+		switch cfg.Metrics.Auth {
+		case "none":
+			http.HandleFunc("/metrics", metricsHandler)
+		case "user":
+			metricsAuthenticator := auth.NewBasicAuthenticator("zfswatcher metrics", getMetricsUserSecret)
+			http.HandleFunc("/metrics", metricsAuthenticator.Wrap(metricsAuthHandler))
+		default:
+			http.HandleFunc("/metrics", authenticator.Wrap(metricsAuthHandler))
+		}
+	}
 
 	if cfg.Www.Certfile != "" && cfg.Www.Keyfile != "" {
 		err = http.ListenAndServeTLS(cfg.Www.Bind, cfg.Www.Certfile, cfg.Www.Keyfile, nil)
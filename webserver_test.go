@@ -0,0 +1,59 @@
+//
+// webserver_test.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+var sameOriginTests = []struct {
+	name    string
+	origin  string
+	referer string
+	want    bool
+}{
+	{"no headers", "", "", false},
+	{"matching origin", "http://zfs.example.com:8990", "", true},
+	{"other origin", "http://evil.example.com", "", false},
+	{"null origin", "null", "http://zfs.example.com:8990/alerts", false},
+	{"matching referer", "", "http://zfs.example.com:8990/alerts", true},
+	{"other referer", "", "http://evil.example.com/zfs.example.com:8990", false},
+	{"origin overrides referer", "http://evil.example.com", "http://zfs.example.com:8990/", false},
+}
+
+func TestSameOrigin(t *testing.T) {
+	for _, tt := range sameOriginTests {
+		r := httptest.NewRequest("POST", "http://zfs.example.com:8990/alerts/ack", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if tt.referer != "" {
+			r.Header.Set("Referer", tt.referer)
+		}
+		if got := sameOrigin(r); got != tt.want {
+			t.Errorf("%s: sameOrigin() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// eof
@@ -31,6 +31,7 @@ package main
 import (
 	"fmt"
 	"github.com/damicon/zfswatcher/notifier"
+	"io"
 	"os"
 	"os/signal"
 	"runtime"
@@ -44,18 +45,77 @@ import (
 var notify *notifier.Notifier
 var optDebug bool
 
+// Protects cfg and notify, which reconfigure() replaces, for the
+// goroutines which run independently of the main loop. The main loop
+// uses them directly.
+var globalsMutex sync.RWMutex
+
+// Returns the current configuration and notifier. For the goroutines
+// which run independently of the main loop.
+func currentGlobals() (*cfgType, *notifier.Notifier) {
+	globalsMutex.RLock()
+	defer globalsMutex.RUnlock()
+
+	return cfg, notify
+}
+
 var currentState struct {
 	state []*PoolType
 	usage map[string]*PoolUsageType
 	mutex sync.RWMutex
 }
 var iostat struct {
-	process *BackgroundProcess
-	ch      chan *ZpoolIostatTable
+	process     *SupervisedProcess
+	ch          chan *ZpoolIostatTable
+	histprocess *SupervisedProcess
+	histch      chan []*ZpoolIostatHist
 }
 
 var startTime time.Time
 
+// Find a pool from the current state by name, returns nil if not found.
+func findPool(name string) *PoolType {
+	currentState.mutex.RLock()
+	defer currentState.mutex.RUnlock()
+
+	for _, pool := range currentState.state {
+		if pool.name == name {
+			return pool
+		}
+	}
+	return nil
+}
+
+// Returns the current state of the pools for the notification templates.
+func getPoolSummary() []notifier.PoolSummary {
+	currentState.mutex.RLock()
+	defer currentState.mutex.RUnlock()
+
+	var pss []notifier.PoolSummary
+	for _, pool := range currentState.state {
+		ps := notifier.PoolSummary{Name: pool.name, State: pool.state, Used: -1}
+		if u, ok := currentState.usage[pool.name]; ok && u.Avail+u.Used > 0 {
+			ps.Used = u.GetUsedPercent()
+		}
+		pss = append(pss, ps)
+	}
+	return pss
+}
+
+// Send a notification about an event related to a pool or a device. The
+// event is usually named after the corresponding "severity" setting.
+func notifyEvent(s notifier.Severity, event, pool, dev, format string, v ...interface{}) {
+	f := notifier.Fields{"event": event}
+	if pool != "" {
+		f["pool"] = pool
+	}
+	if dev != "" {
+		f["device"] = dev
+	}
+	_, n := currentGlobals()
+	n.PrintfFields(s, f, format, v...)
+}
+
 // Keep track of highest (numerically lowest) severity level per pool.
 func trackNotifications(notificationSev map[string]notifier.Severity, name string, s notifier.Severity) {
 	if ns, ok := notificationSev[name]; ok {
@@ -88,14 +148,16 @@ func checkZpoolStatus(os, ns []*PoolType) {
 	// go through old pool list to check for disappeared pools:
 	for name := range os_pools {
 		if ns_pools[name] == nil {
-			notify.Printf(cfg.Severity.Poolremoved, `pool "%s" removed`, name)
+			notifyEvent(cfg.Severity.Poolremoved, "poolremoved", name, "",
+				`pool "%s" removed`, name)
 		}
 	}
 	// go though new pool list:
 	for name := range ns_pools {
 		// check for new pools:
 		if os_pools[name] == nil {
-			notify.Printf(cfg.Severity.Pooladded, `pool "%s" added`, name)
+			notifyEvent(cfg.Severity.Pooladded, "pooladded", name, "",
+				`pool "%s" added`, name)
 			trackNotifications(notificationSev, name, cfg.Severity.Pooladded)
 			continue
 		}
@@ -117,8 +179,8 @@ func checkZpoolStatus(os, ns []*PoolType) {
 				continue
 			}
 			if ns_devs[dname] == nil {
-				notify.Printf(cfg.Severity.Devremoved, `pool "%s" device "%s" removed`,
-					name, dname)
+				notifyEvent(cfg.Severity.Devremoved, "devremoved", name, dname,
+					`pool "%s" device "%s" removed`, name, dname)
 				trackNotifications(notificationSev, name, cfg.Severity.Devremoved)
 			}
 		}
@@ -129,33 +191,34 @@ func checkZpoolStatus(os, ns []*PoolType) {
 			}
 			// check for new devices:
 			if os_devs[dname] == nil {
-				notify.Printf(cfg.Severity.Devadded, `pool "%s" device "%s" added`,
-					name, dname)
+				notifyEvent(cfg.Severity.Devadded, "devadded", name, dname,
+					`pool "%s" device "%s" added`, name, dname)
 				trackNotifications(notificationSev, name, cfg.Severity.Devadded)
 				continue
 			}
 			// pre-existing device, perform checks to find changes:
 			if ns_devs[dname].read > os_devs[dname].read {
-				notify.Printf(cfg.Severity.Devreaderrorsincreased,
+				notifyEvent(cfg.Severity.Devreaderrorsincreased, "devreaderrorsincreased", name, dname,
 					`pool "%s" device "%s" read errors increased: %d -> %d`,
 					name, dname, os_devs[dname].read, ns_devs[dname].read)
 				trackNotifications(notificationSev, name, cfg.Severity.Devreaderrorsincreased)
 			}
 			if ns_devs[dname].write > os_devs[dname].write {
-				notify.Printf(cfg.Severity.Devwriteerrorsincreased,
+				notifyEvent(cfg.Severity.Devwriteerrorsincreased, "devwriteerrorsincreased", name, dname,
 					`pool "%s" device "%s" write errors increased: %d -> %d`,
 					name, dname, os_devs[dname].write, ns_devs[dname].write)
 				trackNotifications(notificationSev, name, cfg.Severity.Devwriteerrorsincreased)
 			}
 			if ns_devs[dname].cksum > os_devs[dname].cksum {
-				notify.Printf(cfg.Severity.Devcksumerrorsincreased,
+				notifyEvent(cfg.Severity.Devcksumerrorsincreased, "devcksumerrorsincreased", name, dname,
 					`pool "%s" device "%s" cksum errors increased: %d -> %d`,
 					name, dname, os_devs[dname].cksum, ns_devs[dname].cksum)
 				trackNotifications(notificationSev, name, cfg.Severity.Devcksumerrorsincreased)
 			}
 			if ns_devs[dname].state != os_devs[dname].state {
 				severity := cfg.Severity.Devstatemap.getSeverity(ns_devs[dname].state)
-				notify.Printf(severity, `pool "%s" device "%s" state changed: %s -> %s`,
+				notifyEvent(severity, "devstatechanged", name, dname,
+					`pool "%s" device "%s" state changed: %s -> %s`,
 					name, dname, os_devs[dname].state, ns_devs[dname].state)
 				trackNotifications(notificationSev, name, severity)
 				// set leds
@@ -165,13 +228,13 @@ func checkZpoolStatus(os, ns []*PoolType) {
 			}
 			if ns_devs[dname].rest != os_devs[dname].rest {
 				if ns_devs[dname].rest != "" {
-					notify.Printf(cfg.Severity.Devadditionalinfochanged,
+					notifyEvent(cfg.Severity.Devadditionalinfochanged, "devadditionalinfochanged", name, dname,
 						`pool "%s" device "%s" new additional info: %s`,
 						name, dname, ns_devs[dname].rest)
 					trackNotifications(notificationSev, name,
 						cfg.Severity.Devadditionalinfochanged)
 				} else {
-					notify.Printf(cfg.Severity.Devadditionalinfocleared,
+					notifyEvent(cfg.Severity.Devadditionalinfocleared, "devadditionalinfocleared", name, dname,
 						`pool "%s" device "%s" additional info cleared`,
 						name, dname)
 					trackNotifications(notificationSev, name,
@@ -182,30 +245,35 @@ func checkZpoolStatus(os, ns []*PoolType) {
 		// check changes in the general pool information:
 		if ns_pools[name].status != os_pools[name].status {
 			if ns_pools[name].status != "" {
-				notify.Printf(cfg.Severity.Poolstatuschanged, `pool "%s" new status: %s`,
+				notifyEvent(cfg.Severity.Poolstatuschanged, "poolstatuschanged", name, "",
+					`pool "%s" new status: %s`,
 					name, ns_pools[name].status)
 				trackNotifications(notificationSev, name, cfg.Severity.Poolstatuschanged)
 			} else {
-				notify.Printf(cfg.Severity.Poolstatuscleared, `pool "%s" status cleared`,
+				notifyEvent(cfg.Severity.Poolstatuscleared, "poolstatuscleared", name, "",
+					`pool "%s" status cleared`,
 					name)
 				trackNotifications(notificationSev, name, cfg.Severity.Poolstatuscleared)
 			}
 		}
 		if ns_pools[name].errors != os_pools[name].errors {
-			notify.Printf(cfg.Severity.Poolerrorschanged, `pool "%s" new errors: %s`,
+			notifyEvent(cfg.Severity.Poolerrorschanged, "poolerrorschanged", name, "",
+				`pool "%s" new errors: %s`,
 				name, ns_pools[name].errors)
 			trackNotifications(notificationSev, name, cfg.Severity.Poolerrorschanged)
 		}
 		if ns_pools[name].state != os_pools[name].state {
 			severity := cfg.Severity.Poolstatemap.getSeverity(ns_pools[name].state)
-			notify.Printf(severity, `pool "%s" state changed: %s -> %s`,
+			notifyEvent(severity, "poolstatechanged", name, "",
+				`pool "%s" state changed: %s -> %s`,
 				name, os_pools[name].state, ns_pools[name].state)
 			trackNotifications(notificationSev, name, severity)
 		}
 	}
 	// attach complete pool status for pools which had notifications
 	for name, severity := range notificationSev {
-		notify.Attach(severity, ns_pools[name].infostr)
+		notify.AttachFields(severity, notifier.Fields{"pool": name},
+			ns_pools[name].infostr)
 	}
 	// update device LEDs
 	if cfg.Leds.Enable && len(ledsToSet) > 0 {
@@ -234,7 +302,7 @@ func checkZfsUsage(oldusage, newusage map[string]*PoolUsageType) {
 			}
 		}
 		if maxlevel != 0 {
-			notify.Printf(cfg.Severity.Usedspace[maxlevel],
+			notifyEvent(cfg.Severity.Usedspace[maxlevel], "usedspace", pool, "",
 				`pool "%s" usage reached %d%%`,
 				pool, maxlevel)
 		}
@@ -259,7 +327,7 @@ func setupLeds(state []*PoolType) {
 func version() {
 	fmt.Println("zfswatcher", VERSION, "- ZFS pool monitoring and notification daemon")
 	fmt.Println("Built with", getGoEnvironment())
-	fmt.Println(`
+	fmt.Print(`
 Copyright © 2012-2013 Damicon Kraa Oy
 
 Zfswatcher is free software: you can redistribute it and/or modify
@@ -285,11 +353,11 @@ func main() {
 	setup()
 
 	// setup signal handlers:
-	sigCexit := make(chan os.Signal)
+	sigCexit := make(chan os.Signal, 1)
 	signal.Notify(sigCexit, syscall.SIGTERM, syscall.SIGINT) // terminate gracefully
-	sigChup := make(chan os.Signal)
+	sigChup := make(chan os.Signal, 1)
 	signal.Notify(sigChup, syscall.SIGHUP) // reopen log files
-	sigCusr1 := make(chan os.Signal)
+	sigCusr1 := make(chan os.Signal, 1)
 	signal.Notify(sigCusr1, syscall.SIGUSR1) // debug output
 
 	// create a pid file if desired, remove it at the end of main()
@@ -299,11 +367,13 @@ func main() {
 	}
 
 	notify.Print(notifier.INFO, "zfswatcher starting")
+	loadSilences(notify, true)
 
 	var statusTicker, zfslistTicker *time.Ticker
 
 	// get the initial zpool status:
-	out, err := getCommandOutput(cfg.Main.Zpoolstatuscmd)
+	out, err := getCommandOutputTimeout("ZFS status", cfg.Main.Zpoolstatuscmd,
+		time.Duration(cfg.Main.Zpoolstatustimeout)*time.Second)
 	if err != nil {
 		notify.Print(notifier.CRIT, "exiting, getting ZFS status failed")
 		goto EXIT
@@ -313,7 +383,8 @@ func main() {
 		notify.Print(notifier.CRIT, "exiting, parsing ZFS status failed")
 		goto EXIT
 	}
-	out, err = getCommandOutput(cfg.Main.Zfslistcmd)
+	out, err = getCommandOutputTimeout("ZFS list", cfg.Main.Zfslistcmd,
+		time.Duration(cfg.Main.Zfslisttimeout)*time.Second)
 	if err != nil {
 		notify.Print(notifier.CRIT, "exiting, getting ZFS disk usage failed")
 		goto EXIT
@@ -323,8 +394,14 @@ func main() {
 		notify.Print(notifier.CRIT, "exiting, parsing ZFS disk usage failed")
 		goto EXIT
 	}
+	statAddUsage(time.Now(), currentState.usage)
+	if err = statAddArc(time.Now()); err != nil {
+		notify.Printf(notifier.DEBUG, "ARC statistics not available: %s", err)
+	}
 
-	// alert about big problems here if desired XXX
+	// alert about big problems:
+	loadAlerts()
+	updateAlerts(time.Now(), true)
 	// make device map XXX
 	// load previous state from disk? XXX
 
@@ -333,27 +410,28 @@ func main() {
 		setupLeds(currentState.state)
 	}
 
-	// start iostat goroutine:
+	// start iostat goroutines:
 	if cfg.Main.Zpooliostatcmd != "" {
-		iostat.process, err = NewBackgroundProcess(cfg.Main.Zpooliostatcmd)
-		if err != nil {
-			notify.Print(notifier.ERR, "failed to start iostat command")
-		} else {
-			iostat.ch = make(chan *ZpoolIostatTable)
-			go ZpoolIostatStreamReader(iostat.ch, iostat.process.Out)
-			// for now just print the output to stdout: XXX
-			go func() {
-				for i := range iostat.ch {
-					fmt.Printf("iostat output: %+v\n", *i)
-				}
-			}()
-		}
+		iostat.ch = make(chan *ZpoolIostatTable)
+		go iostatReceiver(iostat.ch)
+		iostat.process = NewSupervisedProcess("iostat", cfg.Main.Zpooliostatcmd,
+			func(r io.Reader) { ZpoolIostatStreamReader(iostat.ch, r) })
+	}
+	if cfg.Main.Zpooliostathistcmd != "" {
+		iostat.histch = make(chan []*ZpoolIostatHist)
+		go iostatHistReceiver(iostat.histch)
+		iostat.histprocess = NewSupervisedProcess("iostat histogram", cfg.Main.Zpooliostathistcmd,
+			func(r io.Reader) { ZpoolIostatHistStreamReader(iostat.histch, r) })
 	}
 
 	// start a web server goroutine:
 	if cfg.Www.Enable {
 		go webServer()
 	}
+	// start publishing the state to MQTT:
+	if cfg.Mqtt.Enable {
+		startMqtt()
+	}
 
 	// initialize ticker timers and go in main loop:
 	statusTicker = time.NewTicker(time.Duration(cfg.Main.Zpoolstatusrefresh) * time.Second)
@@ -366,7 +444,13 @@ MAINLOOP:
 		select {
 		// when the statusTicker ticks, get the new zpool status and compare:
 		case <-statusTicker.C:
-			zpoolStatusOutput, err := getCommandOutput(cfg.Main.Zpoolstatuscmd)
+			loadSilences(notify, false) // modified from the command line?
+			checkSilencesEnded()
+			zpoolStatusOutput, err := getCommandOutputTimeout("ZFS status",
+				cfg.Main.Zpoolstatuscmd, time.Duration(cfg.Main.Zpoolstatustimeout)*time.Second)
+			if err == errCommandSkipped || err == errCommandTimeout {
+				continue // hung (already notified) or backing off
+			}
 			if err != nil {
 				notify.Print(notifier.CRIT, "getting ZFS status failed")
 				continue
@@ -380,9 +464,15 @@ MAINLOOP:
 			currentState.mutex.Lock()
 			currentState.state = newstate
 			currentState.mutex.Unlock()
+			updateAlerts(time.Now(), false)
+			mqttStateChanged()
 		// get disk usage statistics:
 		case <-zfslistTicker.C:
-			zfsListOutput, err := getCommandOutput(cfg.Main.Zfslistcmd)
+			zfsListOutput, err := getCommandOutputTimeout("ZFS list",
+				cfg.Main.Zfslistcmd, time.Duration(cfg.Main.Zfslisttimeout)*time.Second)
+			if err == errCommandSkipped || err == errCommandTimeout {
+				continue // hung (already notified) or backing off
+			}
 			if err != nil {
 				notify.Print(notifier.CRIT, "getting ZFS disk usage failed")
 				continue
@@ -393,9 +483,15 @@ MAINLOOP:
 				continue
 			}
 			checkZfsUsage(currentState.usage, newusage)
+			statAddUsage(time.Now(), newusage)
+			statAddArc(time.Now())
 			currentState.mutex.Lock()
 			currentState.usage = newusage
 			currentState.mutex.Unlock()
+			updateAlerts(time.Now(), false)
+			mqttStateChanged()
+		case text := <-commandRecoveredC:
+			notifyEvent(cfg.Severity.Commandrecovered, "commandrecovered", "", "", "%s", text)
 		// signals:
 		case <-sigCexit:
 			break MAINLOOP
@@ -418,8 +514,15 @@ EXIT:
 
 	if iostat.process != nil {
 		iostat.process.Stop()
+		close(iostat.ch)
+	}
+	if iostat.histprocess != nil {
+		iostat.histprocess.Stop()
+		close(iostat.histch)
 	}
 
+	stopMqtt()
+
 	// XXX persist data?
 
 	// ask logger to stop:
@@ -27,6 +27,7 @@ import (
 	"io"
 	"runtime"
 	"strings"
+	"time"
 )
 
 // ZFS pool disk usage.
@@ -180,6 +181,16 @@ type PoolType struct {
 	infostr string
 }
 
+// Find a device by name, returns -1 if not found.
+func (p *PoolType) findDev(name string) int {
+	for n, dev := range p.devs {
+		if dev.name == name {
+			return n
+		}
+	}
+	return -1
+}
+
 // Internal parser state for parseZpoolStatus() function.
 type zpoolStatusParserState int
 
@@ -276,7 +287,7 @@ func parseZpoolStatus(zpoolStatusOutput string) (pools []*PoolType, err error) {
 			// this is the end of a pool!
 			curpool.devs, err = parseConfstr(confstr)
 			if err != nil {
-				notify.Print(notifier.ERR, "device configuration parse error: %s", err)
+				notify.Printf(notifier.ERR, "device configuration parse error: %s", err)
 				notify.Attach(notifier.ERR, confstr)
 			}
 			confstr = ""
@@ -317,6 +328,18 @@ vmstore                   17.5G  50.5G      0      0     14      1
 ------------------------  -----  -----  -----  -----  -----  -----
 */
 
+/*
+With "-l" option the latency columns are added:
+
+              capacity     operations     bandwidth    total_wait     disk_wait    syncq_wait    asyncq_wait  scrub   trim
+pool        alloc   free   read  write   read  write   read  write   read  write   read  write   read  write   wait   wait
+----------  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----
+tank        1.72T  8.03T     18     72   303K  6.43M    8ms    2ms    7ms    1ms   15us    3us    2us  748us   10ms      -
+
+Older versions do not have the "trim" column, OpenZFS 2.x adds a "rebuild"
+wait column after it. The columns after "scrub" are ignored.
+*/
+
 type ZpoolIostatRow struct {
 	Dev             string
 	CapacityAlloc   int64
@@ -325,6 +348,44 @@ type ZpoolIostatRow struct {
 	OperationsWrite int64
 	BandwidthRead   int64
 	BandwidthWrite  int64
+	// latencies are -1 if not available:
+	TotalWaitRead   time.Duration
+	TotalWaitWrite  time.Duration
+	DiskWaitRead    time.Duration
+	DiskWaitWrite   time.Duration
+	SyncqWaitRead   time.Duration
+	SyncqWaitWrite  time.Duration
+	AsyncqWaitRead  time.Duration
+	AsyncqWaitWrite time.Duration
+	ScrubWait       time.Duration
+}
+
+// Average disk latency of read and write operations weighted by the
+// amount of operations. Returns -1 if not available.
+func (r *ZpoolIostatRow) GetDiskWait() time.Duration {
+	var sum, ops float64
+	if r.OperationsRead > 0 && r.DiskWaitRead >= 0 {
+		sum += float64(r.OperationsRead) * float64(r.DiskWaitRead)
+		ops += float64(r.OperationsRead)
+	}
+	if r.OperationsWrite > 0 && r.DiskWaitWrite >= 0 {
+		sum += float64(r.OperationsWrite) * float64(r.DiskWaitWrite)
+		ops += float64(r.OperationsWrite)
+	}
+	if ops == 0 {
+		return -1
+	}
+	return time.Duration(sum / ops)
+}
+
+// Convert a latency value such as "748us" or "1.5ms" to time.Duration.
+// Returns -1 if the value is not available ("-") or invalid.
+func unniceLatency(str string) time.Duration {
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return -1
+	}
+	return d
 }
 
 type ZpoolIostatEntry map[string]*ZpoolIostatRow
@@ -333,11 +394,12 @@ type ZpoolIostatTable map[string]ZpoolIostatEntry
 func zpoolIostatParseRow(str string) *ZpoolIostatRow {
 	f := strings.Fields(str)
 
-	if len(f) != 7 {
+	// the known leading columns, the newer versions add more at the end:
+	if len(f) < 7 || (len(f) > 7 && len(f) < 16) {
 		return nil
 	}
 
-	return &ZpoolIostatRow{
+	row := &ZpoolIostatRow{
 		Dev:             f[0],
 		CapacityAlloc:   unniceNumber(f[1]),
 		CapacityFree:    unniceNumber(f[2]),
@@ -345,7 +407,28 @@ func zpoolIostatParseRow(str string) *ZpoolIostatRow {
 		OperationsWrite: unniceNumber(f[4]),
 		BandwidthRead:   unniceNumber(f[5]),
 		BandwidthWrite:  unniceNumber(f[6]),
+		TotalWaitRead:   -1,
+		TotalWaitWrite:  -1,
+		DiskWaitRead:    -1,
+		DiskWaitWrite:   -1,
+		SyncqWaitRead:   -1,
+		SyncqWaitWrite:  -1,
+		AsyncqWaitRead:  -1,
+		AsyncqWaitWrite: -1,
+		ScrubWait:       -1,
+	}
+	if len(f) >= 16 {
+		row.TotalWaitRead = unniceLatency(f[7])
+		row.TotalWaitWrite = unniceLatency(f[8])
+		row.DiskWaitRead = unniceLatency(f[9])
+		row.DiskWaitWrite = unniceLatency(f[10])
+		row.SyncqWaitRead = unniceLatency(f[11])
+		row.SyncqWaitWrite = unniceLatency(f[12])
+		row.AsyncqWaitRead = unniceLatency(f[13])
+		row.AsyncqWaitWrite = unniceLatency(f[14])
+		row.ScrubWait = unniceLatency(f[15])
 	}
+	return row
 }
 
 type zpoolIostatParserState int
@@ -401,7 +484,9 @@ func ZpoolIostatParser(str string) *ZpoolIostatTable {
 	return &table
 }
 
-func ZpoolIostatStreamReader(ch chan *ZpoolIostatTable, r io.Reader) {
+// Read a stream of reports separated by empty lines and call the given
+// function for each report.
+func readReports(r io.Reader, f func(string)) error {
 	readbuf := make([]byte, 4096)
 	var collectbuf string
 
@@ -409,21 +494,142 @@ func ZpoolIostatStreamReader(ch chan *ZpoolIostatTable, r io.Reader) {
 		n, err := r.Read(readbuf)
 		if n > 0 {
 			collectbuf = collectbuf + string(readbuf[:n])
-			// two consecutive newlines (an empty line) separates two iostat entries:
-			if pos := strings.Index(collectbuf, "\n\n"); pos != -1 {
-				ch <- ZpoolIostatParser(collectbuf[:pos+1]) // include 1 newline
-				collectbuf = collectbuf[pos+2:]             // skip both newlines
+			// two consecutive newlines (an empty line) separates two reports:
+			for pos := strings.Index(collectbuf, "\n\n"); pos != -1; pos = strings.Index(collectbuf, "\n\n") {
+				f(collectbuf[:pos+1])           // include 1 newline
+				collectbuf = collectbuf[pos+2:] // skip both newlines
 			}
 		}
 		if err != nil && err != io.EOF {
-			// unexpected error XXX
-			ch <- nil
+			return err
 		}
 		if err != nil || n == 0 {
-			// end of input or error
-			close(ch)
+			// end of input
+			return nil
+		}
+	}
+}
+
+// Read "zpool iostat" output until the end of input and send the parsed
+// reports to the channel (nil in case of errors).
+func ZpoolIostatStreamReader(ch chan *ZpoolIostatTable, r io.Reader) {
+	err := readReports(r, func(report string) {
+		if strings.TrimSpace(report) == "" {
+			return
+		}
+		ch <- ZpoolIostatParser(report)
+	})
+	if err != nil {
+		ch <- nil
+	}
+}
+
+/*
+Latency histograms from "zpool iostat -w -v". There is a separate block
+for the pool and each vdev:
+
+tank         total_wait     disk_wait    syncq_wait    asyncq_wait
+latency      read  write   read  write   read  write   read  write  scrub   trim
+----------  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----
+1ns             0      0      0      0      0      0      0      0      0      0
+...
+1ms            26    133     45    160      0      0      0     15      0      0
+...
+137s            0      0      0      0      0      0      0      0      0      0
+--------------------------------------------------------------------------------
+
+Older versions do not have the "trim" column, OpenZFS 2.x adds a "rebuild"
+column after it. The columns after "asyncq_wait" are ignored.
+*/
+
+type ZpoolIostatHistBucket struct {
+	Latency         time.Duration // upper limit of the bucket
+	TotalWaitRead   int64
+	TotalWaitWrite  int64
+	DiskWaitRead    int64
+	DiskWaitWrite   int64
+	SyncqWaitRead   int64
+	SyncqWaitWrite  int64
+	AsyncqWaitRead  int64
+	AsyncqWaitWrite int64
+}
+
+type ZpoolIostatHist struct {
+	Dev     string
+	Buckets []*ZpoolIostatHistBucket
+}
+
+// Return the latency below which the given percentage of the disk
+// operations (both reads and writes) fall. Returns -1 if there are no
+// operations.
+func (h *ZpoolIostatHist) GetDiskWaitPercentile(percent float64) time.Duration {
+	var total int64
+	for _, b := range h.Buckets {
+		total += b.DiskWaitRead + b.DiskWaitWrite
+	}
+	if total == 0 {
+		return -1
+	}
+	limit := float64(total) * percent / 100
+	var cum int64
+	for _, b := range h.Buckets {
+		cum += b.DiskWaitRead + b.DiskWaitWrite
+		if float64(cum) >= limit {
+			return b.Latency
+		}
+	}
+	return h.Buckets[len(h.Buckets)-1].Latency
+}
+
+// Parse "zpool iostat -w" output. Returns nil in case of errors.
+func ZpoolIostatHistParser(str string) []*ZpoolIostatHist {
+	var hists []*ZpoolIostatHist
+	var curr *ZpoolIostatHist
+
+	for _, row := range strings.Split(str, "\n") {
+		f := strings.Fields(row)
+		switch {
+		case len(f) == 0:
+			// skip
+		case len(f) == 5 && f[1] == "total_wait":
+			curr = &ZpoolIostatHist{Dev: f[0]}
+			hists = append(hists, curr)
+		case f[0] == "latency" || row[0:1] == "-":
+			// skip headers and separators
+		case curr != nil && len(f) >= 10:
+			lat := unniceLatency(f[0])
+			if lat < 0 {
+				return nil // error
+			}
+			curr.Buckets = append(curr.Buckets, &ZpoolIostatHistBucket{
+				Latency:         lat,
+				TotalWaitRead:   unniceNumber(f[1]),
+				TotalWaitWrite:  unniceNumber(f[2]),
+				DiskWaitRead:    unniceNumber(f[3]),
+				DiskWaitWrite:   unniceNumber(f[4]),
+				SyncqWaitRead:   unniceNumber(f[5]),
+				SyncqWaitWrite:  unniceNumber(f[6]),
+				AsyncqWaitRead:  unniceNumber(f[7]),
+				AsyncqWaitWrite: unniceNumber(f[8]),
+			})
+		default:
+			return nil // error
+		}
+	}
+	return hists
+}
+
+// Read "zpool iostat -w" output until the end of input and send the parsed
+// histograms to the channel (nil in case of errors).
+func ZpoolIostatHistStreamReader(ch chan []*ZpoolIostatHist, r io.Reader) {
+	err := readReports(r, func(report string) {
+		if strings.TrimSpace(report) == "" {
 			return
 		}
+		ch <- ZpoolIostatHistParser(report)
+	})
+	if err != nil {
+		ch <- nil
 	}
 }
 
@@ -0,0 +1,241 @@
+//
+// zparse_test.go
+//
+// Copyright © 2012-2013 Damicon Kraa Oy
+//
+// This file is part of zfswatcher.
+//
+// Zfswatcher is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Zfswatcher is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with zfswatcher. If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var zpoolIostatTests = []struct {
+	name       string
+	input      string
+	pool       string
+	dev        string
+	opsWrite   int64
+	diskWaitRd time.Duration
+	scrubWait  time.Duration
+}{
+	{
+		name: "without latencies",
+		input: `                             capacity     operations    bandwidth
+pool                      alloc   free   read  write   read  write
+------------------------  -----  -----  -----  -----  -----  -----
+tank                      1.72T  8.03T     18     72   303K  6.43M
+  raidz2                   586G  2.68T      7     24   102K  2.14M
+    sdi                       -      -      2      7  16.8K   550K
+    sdj                       -      -      0      7  14.8K   550K
+------------------------  -----  -----  -----  -----  -----  -----
+`,
+		pool:       "tank",
+		dev:        "sdi",
+		opsWrite:   7,
+		diskWaitRd: -1,
+		scrubWait:  -1,
+	},
+	{
+		name: "ZoL 0.7 with latencies",
+		input: `              capacity     operations     bandwidth    total_wait     disk_wait    syncq_wait    asyncq_wait  scrub
+pool        alloc   free   read  write   read  write   read  write   read  write   read  write   read  write   wait
+----------  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----
+tank        1.72T  8.03T     18     72   303K  6.43M    8ms    2ms    7ms    1ms   15us    3us    2us  748us   10ms
+  mirror     882G  4.02T      9     36   151K  3.21M    8ms    2ms    7ms    1ms   15us    3us    2us  735us   10ms
+    sda         -      -      4     18  75.7K  1.61M    8ms    2ms    7ms    1ms   14us    3us    2us  740us   10ms
+    sdb         -      -      4     18  75.4K  1.61M    9ms    2ms    8ms    1ms   16us    3us    2us  730us   10ms
+----------  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----
+`,
+		pool:       "tank",
+		dev:        "sdb",
+		opsWrite:   18,
+		diskWaitRd: 8 * time.Millisecond,
+		scrubWait:  10 * time.Millisecond,
+	},
+	{
+		name: "ZoL 0.8 with trim",
+		input: `              capacity     operations     bandwidth    total_wait     disk_wait    syncq_wait    asyncq_wait  scrub   trim
+pool        alloc   free   read  write   read  write   read  write   read  write   read  write   read  write   wait   wait
+----------  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----
+tank        1.72T  8.03T     18     72   303K  6.43M    8ms    2ms    7ms    1ms   15us    3us    2us  748us   10ms      -
+  mirror     882G  4.02T      9     36   151K  3.21M    8ms    2ms    7ms    1ms   15us    3us    2us  735us   10ms      -
+    sda         -      -      4     18  75.7K  1.61M    8ms    2ms    7ms    1ms   14us    3us    2us  740us   10ms      -
+    sdb         -      -      4     18  75.4K  1.61M    8ms    2ms    7ms    1ms   16us    3us    2us  730us   10ms      -
+----------  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----
+`,
+		pool:       "tank",
+		dev:        "mirror",
+		opsWrite:   36,
+		diskWaitRd: 7 * time.Millisecond,
+		scrubWait:  10 * time.Millisecond,
+	},
+	{
+		name: "OpenZFS 2.x with rebuild",
+		input: `              capacity     operations     bandwidth    total_wait     disk_wait    syncq_wait    asyncq_wait  scrub   trim  rebuild
+pool        alloc   free   read  write   read  write   read  write   read  write   read  write   read  write   wait   wait   wait
+----------  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----
+rpool       45.6G   186G      3     39  75.5K   719K  452us  339us  374us  232us    3us    1us  105us  130us  144us      -      -
+  mirror-0  45.6G   186G      3     39  75.5K   719K  452us  339us  374us  232us    3us    1us  105us  130us  144us      -      -
+    nvme0n1p3      -      -      1     19  37.8K   360K  463us  336us  385us  230us    3us    1us  107us  128us  148us      -      -
+    nvme1n1p3      -      -      1     19  37.7K   360K  441us  342us  363us  234us    3us    1us  103us  132us  140us      -      -
+----------  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----
+`,
+		pool:       "rpool",
+		dev:        "nvme0n1p3",
+		opsWrite:   19,
+		diskWaitRd: 385 * time.Microsecond,
+		scrubWait:  148 * time.Microsecond,
+	},
+}
+
+func TestZpoolIostatParser(t *testing.T) {
+	for _, tt := range zpoolIostatTests {
+		table := ZpoolIostatParser(tt.input)
+		if table == nil {
+			t.Errorf("%s: parser error", tt.name)
+			continue
+		}
+		row := (*table)[tt.pool][tt.dev]
+		if row == nil {
+			t.Errorf("%s: no row for %s/%s", tt.name, tt.pool, tt.dev)
+			continue
+		}
+		if row.OperationsWrite != tt.opsWrite {
+			t.Errorf("%s: OperationsWrite = %d, want %d", tt.name, row.OperationsWrite, tt.opsWrite)
+		}
+		if row.DiskWaitRead != tt.diskWaitRd {
+			t.Errorf("%s: DiskWaitRead = %v, want %v", tt.name, row.DiskWaitRead, tt.diskWaitRd)
+		}
+		if row.ScrubWait != tt.scrubWait {
+			t.Errorf("%s: ScrubWait = %v, want %v", tt.name, row.ScrubWait, tt.scrubWait)
+		}
+	}
+}
+
+func TestZpoolIostatParserError(t *testing.T) {
+	input := `----------  -----  -----  -----  -----  -----  -----  -----  -----
+tank        1.72T  8.03T     18     72   303K  6.43M    8ms    2ms
+`
+	if ZpoolIostatParser(input) != nil {
+		t.Errorf("truncated latency columns accepted")
+	}
+}
+
+var zpoolIostatHistTests = []struct {
+	name    string
+	input   string
+	devs    []string
+	buckets int
+	bucket  int
+	latency time.Duration
+	diskRd  int64
+	diskWr  int64
+}{
+	{
+		name: "ZoL 0.7",
+		input: `tank         total_wait     disk_wait    syncq_wait    asyncq_wait
+latency      read  write   read  write   read  write   read  write  scrub
+----------  -----  -----  -----  -----  -----  -----  -----  -----  -----
+511ns           0      0      0      0     12     48      4    112      0
+1us             0      0      0      0     37    103     10    380      0
+1ms            26    133     45    160      0      0      0     15      0
+137s            0      0      0      0      0      0      0      0      0
+-------------------------------------------------------------------------
+`,
+		devs:    []string{"tank"},
+		buckets: 4,
+		bucket:  2,
+		latency: time.Millisecond,
+		diskRd:  45,
+		diskWr:  160,
+	},
+	{
+		name: "ZoL 0.8 with trim",
+		input: `tank         total_wait     disk_wait    syncq_wait    asyncq_wait
+latency      read  write   read  write   read  write   read  write  scrub   trim
+----------  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----
+1ns             0      0      0      0      0      0      0      0      0      0
+1ms            26    133     45    160      0      0      0     15      0      0
+137s            0      0      0      0      0      0      0      0      0      0
+--------------------------------------------------------------------------------
+
+sda          total_wait     disk_wait    syncq_wait    asyncq_wait
+latency      read  write   read  write   read  write   read  write  scrub   trim
+----------  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----
+1ns             0      0      0      0      0      0      0      0      0      0
+1ms            13     67     22     80      0      0      0      8      0      0
+137s            0      0      0      0      0      0      0      0      0      0
+--------------------------------------------------------------------------------
+`,
+		devs:    []string{"tank", "sda"},
+		buckets: 3,
+		bucket:  1,
+		latency: time.Millisecond,
+		diskRd:  45,
+		diskWr:  160,
+	},
+	{
+		name: "OpenZFS 2.x with rebuild",
+		input: `rpool        total_wait     disk_wait    syncq_wait    asyncq_wait
+latency      read  write   read  write   read  write   read  write  scrub   trim  rebuild
+----------  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----  -----
+1ns             0      0      0      0      0      0      0      0      0      0      0
+131us       1.02K  5.91K  1.35K  7.04K     43    210     97  1.12K     12      0      0
+262us         802  4.21K    911  4.93K     11     54     41    789      4      0      0
+137s            0      0      0      0      0      0      0      0      0      0      0
+--------------------------------------------------------------------------------------
+`,
+		devs:    []string{"rpool"},
+		buckets: 4,
+		bucket:  1,
+		latency: 131 * time.Microsecond,
+		diskRd:  1382,
+		diskWr:  7208,
+	},
+}
+
+func TestZpoolIostatHistParser(t *testing.T) {
+	for _, tt := range zpoolIostatHistTests {
+		hists := ZpoolIostatHistParser(tt.input)
+		if hists == nil {
+			t.Errorf("%s: parser error", tt.name)
+			continue
+		}
+		if len(hists) != len(tt.devs) {
+			t.Errorf("%s: %d histograms, want %d", tt.name, len(hists), len(tt.devs))
+			continue
+		}
+		for i, dev := range tt.devs {
+			if hists[i].Dev != dev {
+				t.Errorf("%s: histogram %d is for %s, want %s", tt.name, i, hists[i].Dev, dev)
+			}
+			if len(hists[i].Buckets) != tt.buckets {
+				t.Errorf("%s: %s has %d buckets, want %d", tt.name, dev, len(hists[i].Buckets), tt.buckets)
+			}
+		}
+		b := hists[0].Buckets[tt.bucket]
+		if b.Latency != tt.latency || b.DiskWaitRead != tt.diskRd || b.DiskWaitWrite != tt.diskWr {
+			t.Errorf("%s: bucket %d = %v %d/%d, want %v %d/%d", tt.name, tt.bucket,
+				b.Latency, b.DiskWaitRead, b.DiskWaitWrite, tt.latency, tt.diskRd, tt.diskWr)
+		}
+	}
+}
+
+// eof